@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/hippo-an/sync-net/pkg/config"
+	"github.com/hippo-an/sync-net/pkg/identity"
+	"github.com/hippo-an/sync-net/pkg/transfer"
+	"github.com/hippo-an/sync-net/pkg/trust"
+	"github.com/hippo-an/sync-net/pkg/versioning"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const usage = `usage:
+  syncnet                          run the sync daemon
+  syncnet versions <path>          list archived versions of a file
+  syncnet restore <path> <version> restore a version printed by "versions"
+  syncnet pair <address>           pair with the device at address
+  syncnet unpair <device-id>       stop trusting a paired device
+  syncnet peers                    list paired devices`
+
+var errUsage = errors.New(usage)
+
+func runCommand(conf *config.Config, args []string) error {
+	switch args[0] {
+	case "versions":
+		if len(args) != 2 {
+			return errUsage
+		}
+		return listVersions(conf, args[1])
+	case "restore":
+		if len(args) != 3 {
+			return errUsage
+		}
+		return restoreVersion(conf, args[1], args[2])
+	case "pair":
+		if len(args) != 2 {
+			return errUsage
+		}
+		return pair(conf, args[1])
+	case "unpair":
+		if len(args) != 2 {
+			return errUsage
+		}
+		return unpair(conf, args[1])
+	case "peers":
+		if len(args) != 1 {
+			return errUsage
+		}
+		return listPeers(conf)
+	default:
+		return errUsage
+	}
+}
+
+func listVersions(conf *config.Config, path string) error {
+	v, err := versioning.New(conf)
+	if err != nil {
+		return err
+	}
+
+	relPath, err := folderPath(conf, path)
+	if err != nil {
+		return err
+	}
+
+	versions, err := v.List(relPath)
+	if err != nil {
+		return err
+	}
+
+	if len(versions) == 0 {
+		fmt.Println("no versions of", relPath)
+		return nil
+	}
+
+	for _, version := range versions {
+		fmt.Printf("%s\t%d bytes\n", versioning.FormatTime(version.Time), version.Size)
+	}
+	return nil
+}
+
+func restoreVersion(conf *config.Config, path, version string) error {
+	v, err := versioning.New(conf)
+	if err != nil {
+		return err
+	}
+
+	relPath, err := folderPath(conf, path)
+	if err != nil {
+		return err
+	}
+
+	at, err := versioning.ParseTime(version)
+	if err != nil {
+		return err
+	}
+
+	err = v.Restore(relPath, at)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("restored %s from %s\n", relPath, version)
+	return nil
+}
+
+// pair asks the device at address to pair and trusts it once the user
+// confirmed that both devices show the same pairing code.
+func pair(conf *config.Config, address string) error {
+	id, err := identity.Open(conf)
+	if err != nil {
+		return err
+	}
+
+	peers, err := trust.Open(conf)
+	if err != nil {
+		return err
+	}
+
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, strconv.Itoa(conf.Discovery.TcpPort))
+	}
+
+	peer, err := transfer.RequestPairing(address, id)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("this device:  ", id.DeviceID)
+	fmt.Println("other device: ", peer)
+	fmt.Println("pairing code: ", trust.PairingCode(id.DeviceID, peer))
+	fmt.Print("Does the other device show the same code? [y/N] ")
+
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && answer == "" {
+		return err
+	}
+
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	if answer != "y" && answer != "yes" {
+		fmt.Println("not paired")
+		return nil
+	}
+
+	err = peers.Add(peer, address)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("paired with", peer)
+	return nil
+}
+
+func unpair(conf *config.Config, deviceId string) error {
+	peers, err := trust.Open(conf)
+	if err != nil {
+		return err
+	}
+
+	err = peers.Remove(deviceId)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("unpaired", deviceId)
+	return nil
+}
+
+func listPeers(conf *config.Config) error {
+	peers, err := trust.Open(conf)
+	if err != nil {
+		return err
+	}
+
+	devices := peers.List()
+	if len(devices) == 0 {
+		fmt.Println("no paired devices")
+		return nil
+	}
+
+	for _, d := range devices {
+		fmt.Printf("%s\t%s\t%s\n", d.ID, d.Address, d.PairedAt.Format("2006-01-02 15:04:05"))
+	}
+	return nil
+}
+
+// folderPath turns a path given on the command line into the slash separated
+// path relative to the synced folder. Relative paths are taken as relative
+// to the folder.
+func folderPath(conf *config.Config, path string) (string, error) {
+	if !filepath.IsAbs(path) {
+		return filepath.ToSlash(filepath.Clean(path)), nil
+	}
+
+	rel, err := filepath.Rel(conf.Watcher.Path, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is not inside %s", path, conf.Watcher.Path)
+	}
+
+	return filepath.ToSlash(rel), nil
+}
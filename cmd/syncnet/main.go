@@ -3,9 +3,15 @@ package main
 import (
 	"github.com/hippo-an/sync-net/pkg/config"
 	"github.com/hippo-an/sync-net/pkg/discovery"
+	"github.com/hippo-an/sync-net/pkg/identity"
+	"github.com/hippo-an/sync-net/pkg/ignore"
+	"github.com/hippo-an/sync-net/pkg/index"
 	"github.com/hippo-an/sync-net/pkg/transfer"
+	"github.com/hippo-an/sync-net/pkg/trust"
+	"github.com/hippo-an/sync-net/pkg/versioning"
 	"github.com/hippo-an/sync-net/pkg/watcher"
 	"log"
+	"os"
 	"sync"
 )
 
@@ -15,28 +21,75 @@ func main() {
 		log.Fatal("application configuration error", err)
 	}
 
-	w, err := watcher.NewWatcher(conf)
+	if len(os.Args) > 1 {
+		err = runCommand(conf, os.Args[1:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	ignores, err := ignore.Load(conf)
+	if err != nil {
+		log.Fatal("application ignore error", err)
+	}
+
+	w, err := watcher.NewWatcher(conf, ignores)
 	if err != nil {
 		log.Fatal("application watcher error", err)
 	}
 
 	defer w.TearDown()
 
+	id, err := identity.Open(conf)
+	if err != nil {
+		log.Fatal("application identity error", err)
+	}
+	log.Println("device id:", id.DeviceID)
+
+	idx, err := index.Open(conf, id.DeviceID, ignores)
+	if err != nil {
+		log.Fatal("application index error", err)
+	}
+
+	peers, err := trust.Open(conf)
+	if err != nil {
+		log.Fatal("application trust store error", err)
+	}
+
+	err = idx.Scan()
+	if err != nil {
+		log.Fatal("application index scan error", err)
+	}
+
 	wg := sync.WaitGroup{}
 	wg.Add(1)
 	go watcher.StartWatch(w)
 
-	ds := discovery.NewServer(conf)
+	ds := discovery.NewServer(conf, id)
+
+	client := transfer.NewClient(conf, w, ds, idx, id, peers)
+	go client.HandleEvents()
+
+	versioner, err := versioning.New(conf)
+	if err != nil {
+		log.Fatal("application versioning error", err)
+	}
+	go versioner.Run()
+
+	ts := transfer.NewServer(conf, idx, id, peers, transfer.WithVersioner(versioner), transfer.WithIgnore(ignores), transfer.WithInbound(w.Inbound))
+	go ts.ListenAndConnect(conf.Discovery.TcpPort)
+
+	// subscribed before discovery starts, every peer found gets a sync
+	syncer := transfer.NewSyncer(conf, ds, ts)
+	go syncer.Run()
+
 	go ds.Listen()
 
-	b := discovery.NewBroadcaster(conf)
+	b := discovery.NewBroadcaster(conf, id, transfer.ProtocolVersion)
 	go b.Broadcast()
 
-	client := transfer.NewClient(conf, w, ds)
-	go client.HandleEvents()
-
-	ts := transfer.NewServer(conf)
-	go ts.ListenAndConnect(9000)
+	go transfer.NewStaticPeers(conf, ds, id).Run()
 
 	wg.Wait()
 }
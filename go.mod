@@ -4,7 +4,6 @@ go 1.22.4
 
 require (
 	github.com/fsnotify/fsnotify v1.7.0
-	github.com/google/uuid v1.6.0
 	github.com/spf13/viper v1.19.0
 	github.com/stretchr/testify v1.9.0
 )
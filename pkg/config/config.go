@@ -2,8 +2,10 @@ package config
 
 import (
 	"fmt"
+	"github.com/hippo-an/sync-net/pkg/utils"
 	"github.com/spf13/viper"
 	"log"
+	"os"
 	"path/filepath"
 	"runtime"
 	"strings"
@@ -29,9 +31,40 @@ func GetProjectRoot() string {
 	}
 }
 
+const defaultStateDir = ".sync-net"
+
+// defaultReplayWindow applies to config files written before the option
+// existed. Without a window every announcement would be rejected as stale.
+const defaultReplayWindow = 2 * time.Minute
+
+// defaultMulticastPort is used when no multicast port is configured, port 0
+// would have every node listen and send on a different random port.
+const defaultMulticastPort = 21027
+
+// defaultQuietPeriod is used when no quiet period is configured. Without one
+// every event of a burst is reported on its own and half written files are
+// sent to peers.
+const defaultQuietPeriod = 500 * time.Millisecond
+
 type Config struct {
+	Node struct {
+		StateDir string `yaml:"stateDir"`
+		// Name is shown to peers next to the device ID.
+		Name string `yaml:"name"`
+	} `yaml:"node"`
+
 	Watcher struct {
 		Path string `yaml:"path"`
+		// FolderID names the synced folder towards peers, only folders with
+		// the same ID are synced with each other. Peers announcing other
+		// folders are neither sent changes nor synced with.
+		FolderID string `yaml:"folderId"`
+		// Ignore holds gitignore-style patterns, applied before those in
+		// the .syncignore file of the folder.
+		Ignore []string `yaml:"ignore"`
+		// QuietPeriod is how long a path has to stay untouched before its
+		// changes are reported, bursts of events within it are coalesced.
+		QuietPeriod time.Duration `yaml:"quietPeriod"`
 	} `yaml:"watcher"`
 
 	Discovery struct {
@@ -39,14 +72,44 @@ type Config struct {
 		TcpPort           int           `yaml:"tcpPort"`
 		BroadcastInterval time.Duration `yaml:"broadcastInterval"`
 		BufferSize        int           `yaml:"bufferSize"`
+		ReplayWindow      time.Duration `yaml:"replayWindow"`
+		StaticPeers       []StaticPeer  `yaml:"staticPeers"`
+		Multicast         struct {
+			Port      int    `yaml:"port"`
+			IPv4Group string `yaml:"ipv4Group"`
+			IPv6Group string `yaml:"ipv6Group"`
+			// Interfaces are the names of the interfaces to announce on,
+			// empty selects every interface that is up and multicast
+			// capable.
+			Interfaces []string `yaml:"interfaces"`
+		} `yaml:"multicast"`
 	} `yaml:"discovery"`
 
 	Transfer struct {
 		BufferSize  int `yaml:"bufferSize"`
 		Consistency struct {
-			OnConflict string `yaml:"onConflict"`
+			OnConflict        string   `yaml:"onConflict"`
+			MaxConflictCopies int      `yaml:"maxConflictCopies"`
+			DevicePriority    []string `yaml:"devicePriority"`
 		} `yaml:"consistency"`
 	} `yaml:"transfer"`
+
+	Versioning struct {
+		Type          string        `yaml:"type"`
+		Keep          int           `yaml:"keep"`
+		MaxAge        time.Duration `yaml:"maxAge"`
+		CleanoutAfter time.Duration `yaml:"cleanoutAfter"`
+		CleanInterval time.Duration `yaml:"cleanInterval"`
+	} `yaml:"versioning"`
+}
+
+// StaticPeer is a peer that is probed directly instead of waiting for its
+// broadcast, for networks where broadcasts do not get through.
+type StaticPeer struct {
+	// Address is the host:port of the peer's transfer server.
+	Address string `yaml:"address"`
+	// DeviceID, if set, is the device the peer has to prove to be.
+	DeviceID string `yaml:"deviceId"`
 }
 
 func NewConfig() (*Config, error) {
@@ -67,5 +130,25 @@ func NewConfig() (*Config, error) {
 		return nil, err
 	}
 
+	if c.Node.StateDir == "" {
+		c.Node.StateDir = utils.PathJoinWithHome(defaultStateDir)
+	}
+
+	if c.Node.Name == "" {
+		c.Node.Name, _ = os.Hostname()
+	}
+
+	if c.Watcher.QuietPeriod <= 0 {
+		c.Watcher.QuietPeriod = defaultQuietPeriod
+	}
+
+	if c.Discovery.ReplayWindow <= 0 {
+		c.Discovery.ReplayWindow = defaultReplayWindow
+	}
+
+	if c.Discovery.Multicast.Port <= 0 {
+		c.Discovery.Multicast.Port = defaultMulticastPort
+	}
+
 	return &c, nil
 }
@@ -1,6 +1,7 @@
 package config
 
 import (
+	"github.com/hippo-an/sync-net/pkg/utils"
 	"github.com/stretchr/testify/require"
 	"os"
 	"testing"
@@ -13,42 +14,103 @@ func TestNewConfig(t *testing.T) {
 	require.NoError(t, err)
 	require.NotNil(t, config)
 
+	require.Equal(t, utils.PathJoinWithHome(".sync-net"), config.Node.StateDir)
+	hostname, _ := os.Hostname()
+	require.Equal(t, hostname, config.Node.Name)
 	require.Equal(t, "/opt/sync-net/", config.Watcher.Path)
+	require.Equal(t, "default", config.Watcher.FolderID)
+	require.Equal(t, []string{"*.swp", "*~", "*.backup", ".git/", "node_modules/"}, config.Watcher.Ignore)
+	require.Equal(t, 500*time.Millisecond, config.Watcher.QuietPeriod)
 	require.Equal(t, 9999, config.Discovery.BroadcastPort)
 	require.Equal(t, 9000, config.Discovery.TcpPort)
 	require.Equal(t, 1*time.Minute, config.Discovery.BroadcastInterval)
 	require.Equal(t, 4096, config.Discovery.BufferSize)
+	require.Equal(t, 2*time.Minute, config.Discovery.ReplayWindow)
+	require.Empty(t, config.Discovery.StaticPeers)
+	require.Equal(t, 21027, config.Discovery.Multicast.Port)
+	require.Equal(t, "239.255.42.99", config.Discovery.Multicast.IPv4Group)
+	require.Equal(t, "ff12::8384", config.Discovery.Multicast.IPv6Group)
+	require.Empty(t, config.Discovery.Multicast.Interfaces)
 	require.Equal(t, 32768, config.Transfer.BufferSize)
 	require.Equal(t, "overwrite", config.Transfer.Consistency.OnConflict)
+	require.Equal(t, 5, config.Transfer.Consistency.MaxConflictCopies)
+	require.Equal(t, "simple", config.Versioning.Type)
+	require.Equal(t, 5, config.Versioning.Keep)
+	require.Equal(t, 365*24*time.Hour, config.Versioning.MaxAge)
+	require.Equal(t, 30*24*time.Hour, config.Versioning.CleanoutAfter)
+	require.Equal(t, time.Hour, config.Versioning.CleanInterval)
 
 	// 환경 변수 테스트
+	os.Setenv("NODE_STATEDIR", "/var/lib/sync-net")
+	os.Setenv("NODE_NAME", "laptop")
 	os.Setenv("WATCHER_PATH", "/opt/lib/sync-net")
+	os.Setenv("WATCHER_FOLDERID", "photos")
+	os.Setenv("WATCHER_IGNORE", "*.tmp,build/")
+	os.Setenv("WATCHER_QUIETPERIOD", "2s")
 	os.Setenv("DISCOVERY_BROADCASTPORT", "8888")
 	os.Setenv("DISCOVERY_TCPPORT", "8000")
 	os.Setenv("DISCOVERY_BROADCASTINTERVAL", "30s")
 	os.Setenv("DISCOVERY_BUFFERSIZE", "1024")
+	os.Setenv("DISCOVERY_REPLAYWINDOW", "10s")
+	os.Setenv("DISCOVERY_MULTICAST_IPV6GROUP", "ff02::1")
 	os.Setenv("TRANSFER_BUFFERSIZE", "1024")
 	os.Setenv("TRANSFER_CONSISTENCY_ONCONFLICT", "backupAndCreate")
+	os.Setenv("TRANSFER_CONSISTENCY_MAXCONFLICTCOPIES", "2")
+	os.Setenv("VERSIONING_TYPE", "trashcan")
+	os.Setenv("VERSIONING_CLEANOUTAFTER", "48h")
 
 	config, err = NewConfig()
 	require.NoError(t, err)
 	require.NotNil(t, config)
 
+	require.Equal(t, "/var/lib/sync-net", config.Node.StateDir)
+	require.Equal(t, "laptop", config.Node.Name)
 	require.Equal(t, "/opt/lib/sync-net", config.Watcher.Path)
+	require.Equal(t, "photos", config.Watcher.FolderID)
+	require.Equal(t, []string{"*.tmp", "build/"}, config.Watcher.Ignore)
+	require.Equal(t, 2*time.Second, config.Watcher.QuietPeriod)
 	require.Equal(t, 8888, config.Discovery.BroadcastPort)
 	require.Equal(t, 8000, config.Discovery.TcpPort)
 	require.Equal(t, 30*time.Second, config.Discovery.BroadcastInterval)
 	require.Equal(t, 1024, config.Discovery.BufferSize)
+	require.Equal(t, 10*time.Second, config.Discovery.ReplayWindow)
+	require.Equal(t, "ff02::1", config.Discovery.Multicast.IPv6Group)
 	require.Equal(t, 1024, config.Transfer.BufferSize)
 	require.Equal(t, "backupAndCreate", config.Transfer.Consistency.OnConflict)
+	require.Equal(t, 2, config.Transfer.Consistency.MaxConflictCopies)
+	require.Equal(t, "trashcan", config.Versioning.Type)
+	require.Equal(t, 48*time.Hour, config.Versioning.CleanoutAfter)
 
 	// 환경 변수 초기화
-	os.Unsetenv("")
+	os.Unsetenv("NODE_STATEDIR")
+	os.Unsetenv("NODE_NAME")
+	os.Unsetenv("WATCHER_PATH")
+	os.Unsetenv("WATCHER_FOLDERID")
+	os.Unsetenv("WATCHER_IGNORE")
+	os.Unsetenv("WATCHER_QUIETPERIOD")
 	os.Unsetenv("DISCOVERY_BROADCASTPORT")
 	os.Unsetenv("DISCOVERY_TCPPORT")
 	os.Unsetenv("DISCOVERY_BROADCASTINTERVAL")
 	os.Unsetenv("DISCOVERY_BUFFERSIZE")
+	os.Unsetenv("DISCOVERY_REPLAYWINDOW")
+	os.Unsetenv("DISCOVERY_MULTICAST_IPV6GROUP")
 	os.Unsetenv("TRANSFER_BUFFERSIZE")
 	os.Unsetenv("TRANSFER_CONSISTENCY_ONCONFLICT")
+	os.Unsetenv("TRANSFER_CONSISTENCY_MAXCONFLICTCOPIES")
+	os.Unsetenv("VERSIONING_TYPE")
+	os.Unsetenv("VERSIONING_CLEANOUTAFTER")
 
 }
+
+func TestNewConfigDefaults(t *testing.T) {
+	// as in config files written before these options existed
+	t.Setenv("DISCOVERY_REPLAYWINDOW", "0")
+	t.Setenv("DISCOVERY_MULTICAST_PORT", "0")
+	t.Setenv("WATCHER_QUIETPERIOD", "0")
+
+	config, err := NewConfig()
+	require.NoError(t, err)
+	require.Equal(t, defaultQuietPeriod, config.Watcher.QuietPeriod)
+	require.Equal(t, defaultReplayWindow, config.Discovery.ReplayWindow)
+	require.Equal(t, defaultMulticastPort, config.Discovery.Multicast.Port)
+}
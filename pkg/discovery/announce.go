@@ -0,0 +1,147 @@
+package discovery
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/hippo-an/sync-net/pkg/identity"
+	"sync"
+	"time"
+)
+
+const (
+	nonceSize = 16
+	// announcePrefix keeps announcement signatures from being valid for
+	// anything else the device key signs.
+	announcePrefix = "syncnet-announce"
+)
+
+var (
+	ErrInvalidSignature = errors.New("invalid announcement signature")
+	ErrStaleMessage     = errors.New("stale announcement")
+	ErrReplayedMessage  = errors.New("replayed announcement")
+)
+
+// Message is the announcement a node broadcasts. It tells peers who the node
+// is and how to reach its transfer server. It is signed with the device key,
+// whose certificate is sent along, and carries a timestamp and a random nonce
+// so a captured announcement cannot be replayed.
+type Message struct {
+	DeviceID string `json:"deviceId"`
+	Name     string `json:"name"`
+	// Port is the TCP port of the transfer server.
+	Port int `json:"port"`
+	// Version is the transfer protocol version the node speaks.
+	Version uint8 `json:"version"`
+	// Folders are the IDs of the folders the node shares.
+	Folders []string `json:"folders"`
+
+	Timestamp   int64  `json:"timestamp"`
+	Nonce       string `json:"nonce"`
+	Certificate []byte `json:"certificate,omitempty"`
+	Signature   []byte `json:"signature,omitempty"`
+}
+
+// newMessage creates a signed announcement for the device from the node
+// details in m.
+func newMessage(m Message, id *identity.Identity, now time.Time) (*Message, error) {
+	nonce := make([]byte, nonceSize)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	m.DeviceID = id.DeviceID
+	m.Timestamp = now.UnixNano()
+	m.Nonce = hex.EncodeToString(nonce)
+	m.Certificate = id.Certificate.Certificate[0]
+
+	data, err := m.signedData()
+	if err != nil {
+		return nil, err
+	}
+
+	m.Signature, err = id.Sign(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &m, nil
+}
+
+// signedData is what the signature covers, everything but the signature and
+// the certificate, which has to match the device ID anyway.
+func (m *Message) signedData() ([]byte, error) {
+	c := *m
+	c.Certificate = nil
+	c.Signature = nil
+
+	data, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte(announcePrefix+"\n"), data...), nil
+}
+
+// verify checks that the announcement was signed by the device it claims to
+// come from.
+func (m *Message) verify() error {
+	data, err := m.signedData()
+	if err != nil {
+		return err
+	}
+
+	device, err := identity.Verify(m.Certificate, data, m.Signature)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidSignature, err)
+	}
+
+	if device != m.DeviceID {
+		return fmt.Errorf("%w: signed by %s, not %s", ErrInvalidSignature, device, m.DeviceID)
+	}
+
+	return nil
+}
+
+// replayGuard rejects announcements that are older than the window, or that
+// were already accepted within it. Nonces only have to be remembered for the
+// window, older messages are rejected for their timestamp.
+type replayGuard struct {
+	mu     sync.Mutex
+	window time.Duration
+	seen   map[string]time.Time
+}
+
+func newReplayGuard(window time.Duration) *replayGuard {
+	return &replayGuard{
+		window: window,
+		seen:   map[string]time.Time{},
+	}
+}
+
+func (g *replayGuard) check(m *Message, now time.Time) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	sent := time.Unix(0, m.Timestamp)
+	if sent.Before(now.Add(-g.window)) || sent.After(now.Add(g.window)) {
+		return fmt.Errorf("%w: sent at %s", ErrStaleMessage, sent.Format(time.RFC3339))
+	}
+
+	for key, at := range g.seen {
+		if at.Before(now.Add(-g.window)) {
+			delete(g.seen, key)
+		}
+	}
+
+	key := m.DeviceID + "/" + m.Nonce
+	if _, ok := g.seen[key]; ok {
+		return ErrReplayedMessage
+	}
+	g.seen[key] = sent
+
+	return nil
+}
@@ -0,0 +1,66 @@
+package discovery
+
+import (
+	"github.com/hippo-an/sync-net/pkg/identity"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+var details = Message{
+	Name:    "peer",
+	Port:    9000,
+	Version: 4,
+	Folders: []string{"default"},
+}
+
+func TestAnnouncementSignature(t *testing.T) {
+	id, err := identity.New()
+	require.NoError(t, err)
+	other, err := identity.New()
+	require.NoError(t, err)
+
+	m, err := newMessage(details, id, time.Now())
+	require.NoError(t, err)
+	require.NoError(t, m.verify())
+
+	tampered := *m
+	tampered.Timestamp++
+	require.ErrorIs(t, tampered.verify(), ErrInvalidSignature)
+
+	redirected := *m
+	redirected.Port = 9001
+	require.ErrorIs(t, redirected.verify(), ErrInvalidSignature)
+
+	// a valid signature of another device cannot be passed off as ours
+	impostor, err := newMessage(details, other, time.Now())
+	require.NoError(t, err)
+	impostor.DeviceID = id.DeviceID
+	require.ErrorIs(t, impostor.verify(), ErrInvalidSignature)
+}
+
+func TestServerRejectsStaleAndReplayedAnnouncements(t *testing.T) {
+	id, err := identity.New()
+	require.NoError(t, err)
+	s := NewServer(conf, id)
+	now := time.Now()
+	window := conf.Discovery.ReplayWindow
+
+	m, err := newMessage(details, id, now)
+	require.NoError(t, err)
+	require.NoError(t, s.accept(m, now))
+	require.ErrorIs(t, s.accept(m, now.Add(time.Second)), ErrReplayedMessage)
+	require.ErrorIs(t, s.accept(m, now.Add(window+time.Second)), ErrStaleMessage)
+
+	old, err := newMessage(details, id, now.Add(-window-time.Second))
+	require.NoError(t, err)
+	require.ErrorIs(t, s.accept(old, now), ErrStaleMessage)
+
+	future, err := newMessage(details, id, now.Add(window+time.Second))
+	require.NoError(t, err)
+	require.ErrorIs(t, s.accept(future, now), ErrStaleMessage)
+
+	fresh, err := newMessage(details, id, now.Add(time.Second))
+	require.NoError(t, err)
+	require.NoError(t, s.accept(fresh, now.Add(time.Second)))
+}
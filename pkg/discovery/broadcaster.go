@@ -3,26 +3,41 @@ package discovery
 import (
 	"encoding/json"
 	"github.com/hippo-an/sync-net/pkg/config"
+	"github.com/hippo-an/sync-net/pkg/identity"
 	"log"
 	"net"
 	"time"
 )
 
 type Broadcaster struct {
-	addr *net.UDPAddr
-	conf *config.Config
+	addr    *net.UDPAddr
+	conf    *config.Config
+	id      *identity.Identity
+	details Message
 }
 
-func NewBroadcaster(conf *config.Config) *Broadcaster {
+// NewBroadcaster announces the node with its device ID, name, transfer port
+// and shared folder. version is the transfer protocol version the node
+// speaks.
+func NewBroadcaster(conf *config.Config, id *identity.Identity, version uint8) *Broadcaster {
 	return &Broadcaster{
 		addr: &net.UDPAddr{
 			Port: conf.Discovery.BroadcastPort,
 			IP:   net.IPv4bcast,
 		},
 		conf: conf,
+		id:   id,
+		details: Message{
+			Name:    conf.Node.Name,
+			Port:    conf.Discovery.TcpPort,
+			Version: version,
+			Folders: []string{conf.Watcher.FolderID},
+		},
 	}
 }
 
+// Broadcast announces the node to the broadcast address and to the
+// configured multicast groups once per broadcast interval.
 func (b *Broadcaster) Broadcast() {
 	conn, err := net.DialUDP("udp", nil, b.addr)
 	if err != nil {
@@ -31,17 +46,27 @@ func (b *Broadcaster) Broadcast() {
 	}
 	defer conn.Close()
 
+	conns := []*net.UDPConn{conn}
+	multicast, err := dialMulticast(b.conf)
+	if err != nil {
+		log.Println("Error setting up multicast announcements:", err)
+	}
+	for _, c := range multicast {
+		defer c.Close()
+		conns = append(conns, c)
+	}
+
 	ticker := time.NewTicker(b.conf.Discovery.BroadcastInterval)
 	defer ticker.Stop()
 
-	err = notify(conn)
+	err = b.notifyAll(conns)
 	if err != nil {
 		log.Fatal("Error notifying initialize broadcasting:", err)
 	}
 	for {
 		select {
 		case <-ticker.C:
-			err = notify(conn)
+			err = b.notifyAll(conns)
 			if err != nil {
 				log.Println("Error notifying broadcasting:", err)
 				continue
@@ -52,9 +77,34 @@ func (b *Broadcaster) Broadcast() {
 	}
 }
 
-func notify(conn *net.UDPConn) error {
-	message := Message{
-		Hash: generateHash(),
+// notifyAll announces the node on every connection. It only fails if no
+// announcement could be sent at all, a single interface going down is not
+// fatal.
+func (b *Broadcaster) notifyAll(conns []*net.UDPConn) error {
+	var sent bool
+	var err error
+	for _, conn := range conns {
+		e := notify(conn, b.details, b.id)
+		if e != nil {
+			err = e
+			continue
+		}
+		sent = true
+	}
+
+	if sent {
+		return nil
+	}
+	return err
+}
+
+// notify sends a freshly signed announcement, each one with its own
+// timestamp and nonce.
+func notify(conn *net.UDPConn, details Message, id *identity.Identity) error {
+	message, err := newMessage(details, id, time.Now())
+	if err != nil {
+		log.Println("Error signing discovery message:", err)
+		return err
 	}
 
 	jsonData, err := json.Marshal(message)
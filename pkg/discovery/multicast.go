@@ -0,0 +1,153 @@
+package discovery
+
+import (
+	"fmt"
+	"github.com/hippo-an/sync-net/pkg/config"
+	"log"
+	"net"
+)
+
+// Besides the IPv4 broadcast, announcements are sent to an IPv4 and an IPv6
+// multicast group on every selected interface, so peers are found on
+// IPv6-only and dual-stack networks as well. Multicast uses its own port:
+// the sockets joining a group have to share it, which the broadcast socket
+// does not allow.
+
+// multicastInterfaces returns the interfaces named in the config, or every
+// interface that is up and multicast capable if none are named.
+func multicastInterfaces(conf *config.Config) ([]net.Interface, error) {
+	names := conf.Discovery.Multicast.Interfaces
+	if len(names) > 0 {
+		ifis := make([]net.Interface, 0, len(names))
+		for _, name := range names {
+			ifi, err := net.InterfaceByName(name)
+			if err != nil {
+				return nil, fmt.Errorf("multicast interface %s: %w", name, err)
+			}
+			ifis = append(ifis, *ifi)
+		}
+		return ifis, nil
+	}
+
+	all, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	var ifis []net.Interface
+	for _, ifi := range all {
+		if ifi.Flags&net.FlagUp != 0 && ifi.Flags&net.FlagMulticast != 0 {
+			ifis = append(ifis, ifi)
+		}
+	}
+	return ifis, nil
+}
+
+// multicastGroups returns the configured groups, IPv4 first.
+func multicastGroups(conf *config.Config) ([]*net.UDPAddr, error) {
+	var groups []*net.UDPAddr
+	for _, g := range []string{conf.Discovery.Multicast.IPv4Group, conf.Discovery.Multicast.IPv6Group} {
+		if g == "" {
+			continue
+		}
+
+		ip := net.ParseIP(g)
+		if ip == nil || !ip.IsMulticast() {
+			return nil, fmt.Errorf("invalid multicast group: %s", g)
+		}
+		groups = append(groups, &net.UDPAddr{IP: ip, Port: conf.Discovery.Multicast.Port})
+	}
+	return groups, nil
+}
+
+func network(group *net.UDPAddr) string {
+	if group.IP.To4() != nil {
+		return "udp4"
+	}
+	return "udp6"
+}
+
+// ipv4Addr returns the first IPv4 address of the interface.
+func ipv4Addr(ifi *net.Interface) net.IP {
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil
+	}
+
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			if to4 := ipNet.IP.To4(); to4 != nil {
+				return to4
+			}
+		}
+	}
+	return nil
+}
+
+// listenMulticast joins every configured group on every selected interface.
+// Interfaces that cannot join a group are skipped.
+func listenMulticast(conf *config.Config) ([]*net.UDPConn, error) {
+	ifis, err := multicastInterfaces(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	groups, err := multicastGroups(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	var conns []*net.UDPConn
+	for _, group := range groups {
+		for i := range ifis {
+			conn, err := net.ListenMulticastUDP(network(group), &ifis[i], group)
+			if err != nil {
+				log.Printf("Error joining %s on %s: %s\n", group.IP, ifis[i].Name, err)
+				continue
+			}
+			conns = append(conns, conn)
+		}
+	}
+	return conns, nil
+}
+
+// dialMulticast opens a socket per selected interface and configured group
+// that sends to the group through that interface. IPv4 picks the interface
+// by its source address, IPv6 by the zone of the group address.
+func dialMulticast(conf *config.Config) ([]*net.UDPConn, error) {
+	ifis, err := multicastInterfaces(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	groups, err := multicastGroups(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	var conns []*net.UDPConn
+	for _, group := range groups {
+		for i := range ifis {
+			var laddr *net.UDPAddr
+			raddr := &net.UDPAddr{IP: group.IP, Port: group.Port}
+
+			if network(group) == "udp4" {
+				ip := ipv4Addr(&ifis[i])
+				if ip == nil {
+					continue
+				}
+				laddr = &net.UDPAddr{IP: ip}
+			} else {
+				raddr.Zone = ifis[i].Name
+			}
+
+			conn, err := net.DialUDP(network(group), laddr, raddr)
+			if err != nil {
+				log.Printf("Error setting up multicast to %s on %s: %s\n", group.IP, ifis[i].Name, err)
+				continue
+			}
+			conns = append(conns, conn)
+		}
+	}
+	return conns, nil
+}
@@ -0,0 +1,110 @@
+package discovery
+
+import (
+	"github.com/hippo-an/sync-net/pkg/config"
+	"github.com/hippo-an/sync-net/pkg/identity"
+	"github.com/stretchr/testify/require"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// multicastConf returns a copy of the config that announces only on the
+// given group and interfaces, on a port picked by the system.
+func multicastConf(ipv4Group, ipv6Group string, interfaces ...string) *config.Config {
+	c := *conf
+	c.Discovery.Multicast.Port = 0
+	c.Discovery.Multicast.IPv4Group = ipv4Group
+	c.Discovery.Multicast.IPv6Group = ipv6Group
+	c.Discovery.Multicast.Interfaces = interfaces
+	return &c
+}
+
+// announceOverMulticast joins the configured group, sends an announcement
+// of a new device to it and returns the event the listening server
+// published.
+func announceOverMulticast(t *testing.T, c *config.Config) PeerEvent {
+	t.Helper()
+
+	self, err := identity.New()
+	require.NoError(t, err)
+	s := NewServer(c, self)
+	events := s.Peers.Subscribe()
+
+	conns, err := listenMulticast(c)
+	require.NoError(t, err)
+	if len(conns) == 0 {
+		t.Skip("cannot join multicast group")
+	}
+	for _, conn := range conns {
+		t.Cleanup(func() { conn.Close() })
+		go s.serve(conn)
+	}
+	c.Discovery.Multicast.Port = conns[0].LocalAddr().(*net.UDPAddr).Port
+
+	senders, err := dialMulticast(c)
+	require.NoError(t, err)
+	if len(senders) == 0 {
+		t.Skip("cannot send to multicast group")
+	}
+
+	id, err := identity.New()
+	require.NoError(t, err)
+	for _, sender := range senders {
+		defer sender.Close()
+		require.NoError(t, notify(sender, details, id))
+	}
+
+	select {
+	case e := <-events:
+		require.Equal(t, id.DeviceID, e.Peer.Id)
+		return e
+	case <-time.After(2 * time.Second):
+		t.Fatal("announcement was not received")
+		return PeerEvent{}
+	}
+}
+
+func TestMulticastOverLoopback(t *testing.T) {
+	e := announceOverMulticast(t, multicastConf("239.255.42.99", "", "lo"))
+	require.Equal(t, PeerJoined, e.Type)
+	require.Equal(t, "127.0.0.1", e.Peer.Ip)
+}
+
+func TestMulticastIPv6(t *testing.T) {
+	e := announceOverMulticast(t, multicastConf("", "ff12::8384"))
+	require.Equal(t, PeerJoined, e.Type)
+	require.True(t, strings.Contains(e.Peer.Ip, ":"), e.Peer.Ip)
+}
+
+func TestInvalidMulticastGroup(t *testing.T) {
+	_, err := multicastGroups(multicastConf("10.0.0.1", ""))
+	require.Error(t, err)
+}
+
+func TestValidateAddr(t *testing.T) {
+	tests := []struct {
+		addr    net.UDPAddr
+		want    string
+		wantErr bool
+	}{
+		{net.UDPAddr{IP: net.ParseIP("192.168.1.2")}, "192.168.1.2", false},
+		{net.UDPAddr{IP: net.ParseIP("127.0.0.1")}, "127.0.0.1", false},
+		{net.UDPAddr{IP: net.ParseIP("2001:db8::1")}, "2001:db8::1", false},
+		{net.UDPAddr{IP: net.ParseIP("fe80::1"), Zone: "eth0"}, "fe80::1%eth0", false},
+		{net.UDPAddr{IP: net.ParseIP("fe80::1")}, "", true},
+		{net.UDPAddr{IP: net.ParseIP("239.255.42.99")}, "", true},
+		{net.UDPAddr{IP: net.IPv4zero}, "", true},
+	}
+
+	for _, tt := range tests {
+		got, err := validateAddr(&tt.addr)
+		if tt.wantErr {
+			require.Error(t, err, tt.addr.String())
+			continue
+		}
+		require.NoError(t, err)
+		require.Equal(t, tt.want, got)
+	}
+}
@@ -0,0 +1,213 @@
+package discovery
+
+import (
+	"log"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// offlineAfter is how many broadcast intervals a peer may stay silent before
+// it is marked offline.
+const offlineAfter = 3
+
+type PeerEventType int
+
+const (
+	// PeerJoined is sent for a peer seen for the first time or coming back
+	// after having been offline.
+	PeerJoined PeerEventType = iota + 1
+	// PeerLeft is sent when a peer went silent or was removed.
+	PeerLeft
+	// PeerChanged is sent when an online peer announced a new address or
+	// other new details.
+	PeerChanged
+)
+
+func (t PeerEventType) String() string {
+	switch t {
+	case PeerJoined:
+		return "joined"
+	case PeerLeft:
+		return "left"
+	case PeerChanged:
+		return "changed"
+	default:
+		return "unknown"
+	}
+}
+
+// PeerEvent carries a copy of the peer as it was when the event happened.
+type PeerEvent struct {
+	Type PeerEventType
+	Peer *ServerInfo
+}
+
+// PeerRegistry holds every peer seen on the network, keyed by device ID. It
+// is safe for concurrent use. All peers handed out are copies.
+type PeerRegistry struct {
+	mu          sync.Mutex
+	peers       map[string]*ServerInfo
+	timeout     time.Duration
+	subscribers []chan PeerEvent
+}
+
+// NewPeerRegistry creates a registry that marks peers offline once they have
+// not been updated for timeout.
+func NewPeerRegistry(timeout time.Duration) *PeerRegistry {
+	return &PeerRegistry{
+		peers:   map[string]*ServerInfo{},
+		timeout: timeout,
+	}
+}
+
+// List returns all known peers, online or not, ordered by device ID.
+func (r *PeerRegistry) List() []*ServerInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	peers := make([]*ServerInfo, 0, len(r.peers))
+	for _, p := range r.peers {
+		c := *p
+		peers = append(peers, &c)
+	}
+
+	sort.Slice(peers, func(a, b int) bool {
+		return peers[a].Id < peers[b].Id
+	})
+
+	return peers
+}
+
+// Get returns the peer with the given device ID.
+func (r *PeerRegistry) Get(id string) (*ServerInfo, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	p, ok := r.peers[id]
+	if !ok {
+		return nil, false
+	}
+
+	c := *p
+	return &c, true
+}
+
+// Upsert records si as the latest state of the peer si.Id and marks it
+// online. CreatedAt is kept from the first time the peer was seen.
+func (r *PeerRegistry) Upsert(si *ServerInfo) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := *si
+	n.Online = true
+	if n.UpdatedAt.IsZero() {
+		n.UpdatedAt = time.Now()
+	}
+
+	o, ok := r.peers[n.Id]
+	switch {
+	case !ok:
+		if n.CreatedAt.IsZero() {
+			n.CreatedAt = n.UpdatedAt
+		}
+		r.peers[n.Id] = &n
+		if !n.Self {
+			r.publish(PeerJoined, &n)
+		}
+	case !o.Online:
+		n.CreatedAt = o.CreatedAt
+		r.peers[n.Id] = &n
+		r.publish(PeerJoined, &n)
+	default:
+		n.CreatedAt = o.CreatedAt
+		r.peers[n.Id] = &n
+		if !n.Self && !o.sameDetails(&n) {
+			r.publish(PeerChanged, &n)
+		}
+	}
+}
+
+// Remove forgets the peer with the given device ID.
+func (r *PeerRegistry) Remove(id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	p, ok := r.peers[id]
+	if !ok {
+		return false
+	}
+
+	delete(r.peers, id)
+	if p.Online && !p.Self {
+		p.Online = false
+		r.publish(PeerLeft, p)
+	}
+
+	return true
+}
+
+// Expire marks peers offline that have not been updated within the timeout.
+// Our own entry never expires.
+func (r *PeerRegistry) Expire(now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, p := range r.peers {
+		if p.Self || !p.Online || now.Sub(p.UpdatedAt) <= r.timeout {
+			continue
+		}
+
+		p.Online = false
+		log.Printf("Server %s (%s) went offline\n", p.Name, p.Id)
+		r.publish(PeerLeft, p)
+	}
+}
+
+// Subscribe returns a channel receiving every peer event from now on. A
+// subscriber that does not keep up misses events rather than blocking the
+// registry.
+func (r *PeerRegistry) Subscribe() <-chan PeerEvent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ch := make(chan PeerEvent, 16)
+	r.subscribers = append(r.subscribers, ch)
+	return ch
+}
+
+// Unsubscribe stops delivering events to ch and closes it.
+func (r *PeerRegistry) Unsubscribe(ch <-chan PeerEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i, s := range r.subscribers {
+		if s == ch {
+			r.subscribers = append(r.subscribers[:i], r.subscribers[i+1:]...)
+			close(s)
+			return
+		}
+	}
+}
+
+func (r *PeerRegistry) publish(t PeerEventType, si *ServerInfo) {
+	for _, s := range r.subscribers {
+		c := *si
+		select {
+		case s <- PeerEvent{Type: t, Peer: &c}:
+		default:
+			log.Printf("Peer event channel is full, dropping %s event for: %s\n", t, si.Id)
+		}
+	}
+}
+
+// sameDetails reports whether both describe the peer at the same address with
+// the same announced details.
+func (si *ServerInfo) sameDetails(o *ServerInfo) bool {
+	return si.Ip == o.Ip &&
+		si.Port == o.Port &&
+		si.Name == o.Name &&
+		si.Version == o.Version &&
+		slices.Equal(si.Folders, o.Folders)
+}
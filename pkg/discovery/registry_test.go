@@ -0,0 +1,129 @@
+package discovery
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+	"time"
+)
+
+func requireEvent(t *testing.T, events <-chan PeerEvent, want PeerEventType) PeerEvent {
+	t.Helper()
+
+	select {
+	case e := <-events:
+		require.Equal(t, want, e.Type)
+		return e
+	case <-time.After(time.Second):
+		t.Fatalf("no %s event", want)
+		return PeerEvent{}
+	}
+}
+
+func requireNoEvent(t *testing.T, events <-chan PeerEvent) {
+	t.Helper()
+
+	select {
+	case e := <-events:
+		t.Fatalf("unexpected %s event for %s", e.Type, e.Peer.Id)
+	default:
+	}
+}
+
+func TestRegistryEvents(t *testing.T) {
+	r := NewPeerRegistry(time.Minute)
+	events := r.Subscribe()
+	now := time.Now()
+
+	r.Upsert(&ServerInfo{Id: "self", Self: true, UpdatedAt: now})
+	requireNoEvent(t, events)
+
+	r.Upsert(&ServerInfo{Id: "a", Ip: "10.0.0.2", Port: "9000", UpdatedAt: now})
+	e := requireEvent(t, events, PeerJoined)
+	require.True(t, e.Peer.Online)
+
+	r.Upsert(&ServerInfo{Id: "a", Ip: "10.0.0.2", Port: "9000", UpdatedAt: now.Add(time.Second)})
+	requireNoEvent(t, events)
+
+	r.Upsert(&ServerInfo{Id: "a", Ip: "10.0.0.3", Port: "9000", UpdatedAt: now.Add(2 * time.Second)})
+	e = requireEvent(t, events, PeerChanged)
+	require.Equal(t, "10.0.0.3", e.Peer.Ip)
+
+	r.Expire(now.Add(time.Minute))
+	requireNoEvent(t, events)
+
+	r.Expire(now.Add(2 * time.Minute))
+	e = requireEvent(t, events, PeerLeft)
+	require.False(t, e.Peer.Online)
+	a, ok := r.Get("a")
+	require.True(t, ok)
+	require.False(t, a.Online)
+	require.Equal(t, now, a.CreatedAt)
+
+	// our own entry never goes offline
+	self, ok := r.Get("self")
+	require.True(t, ok)
+	require.True(t, self.Online)
+
+	r.Upsert(&ServerInfo{Id: "a", Ip: "10.0.0.3", Port: "9000", UpdatedAt: now.Add(3 * time.Minute)})
+	requireEvent(t, events, PeerJoined)
+
+	require.True(t, r.Remove("a"))
+	requireEvent(t, events, PeerLeft)
+	require.False(t, r.Remove("a"))
+	_, ok = r.Get("a")
+	require.False(t, ok)
+
+	r.Unsubscribe(events)
+	_, open := <-events
+	require.False(t, open)
+}
+
+func TestRegistryHandsOutCopies(t *testing.T) {
+	r := NewPeerRegistry(time.Minute)
+	r.Upsert(&ServerInfo{Id: "b", Ip: "10.0.0.3"})
+	r.Upsert(&ServerInfo{Id: "a", Ip: "10.0.0.2"})
+
+	peers := r.List()
+	require.Len(t, peers, 2)
+	require.Equal(t, "a", peers[0].Id)
+	require.Equal(t, "b", peers[1].Id)
+
+	peers[0].Ip = "changed"
+	a, _ := r.Get("a")
+	require.Equal(t, "10.0.0.2", a.Ip)
+}
+
+func TestRegistryConcurrentUse(t *testing.T) {
+	r := NewPeerRegistry(time.Minute)
+	events := r.Subscribe()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				r.Upsert(&ServerInfo{Id: fmt.Sprint(i), Ip: fmt.Sprint(j)})
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				for _, p := range r.List() {
+					_ = p.Ip
+				}
+				r.Expire(time.Now())
+			}
+		}()
+	}
+	go func() {
+		for range events {
+		}
+	}()
+
+	wg.Wait()
+	r.Unsubscribe(events)
+	require.Len(t, r.List(), 8)
+}
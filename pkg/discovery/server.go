@@ -4,20 +4,37 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/google/uuid"
 	"github.com/hippo-an/sync-net/pkg/config"
+	"github.com/hippo-an/sync-net/pkg/identity"
 	"log"
 	"net"
 	"os"
+	"slices"
+	"strconv"
+	"sync"
 	"time"
 )
 
+// switchAfter is how many broadcast intervals the address a peer is known at
+// may stay silent before we switch to another one it announces itself from.
+// On dual-stack networks every announcement arrives over IPv4 and IPv6.
+const switchAfter = 2
+
 type Server struct {
-	ServerInfos map[string]*ServerInfo
-	conf        *config.Config
+	// Peers holds every peer seen on the network, including ourselves.
+	// Being seen does not make a peer trusted, that is decided by the device
+	// ID it presents when connecting to the transfer server.
+	Peers *PeerRegistry
+	self  string
+	conf  *config.Config
+	guard *replayGuard
+	mu    sync.Mutex
+	// heard holds when each device last announced itself from each of its
+	// addresses.
+	heard map[string]map[string]time.Time
 }
 
-func NewServer(conf *config.Config) *Server {
+func NewServer(conf *config.Config, id *identity.Identity) *Server {
 	now := time.Now()
 
 	ip, err := getIp()
@@ -26,56 +43,124 @@ func NewServer(conf *config.Config) *Server {
 	}
 
 	s := ServerInfo{
-		Id:        uuid.New(),
+		Id:        id.DeviceID,
+		Name:      conf.Node.Name,
 		Ip:        ip,
 		Port:      fmt.Sprint(conf.Discovery.TcpPort),
+		Folders:   []string{conf.Watcher.FolderID},
 		CreatedAt: now,
 		UpdatedAt: now,
 		Self:      true,
 	}
 
+	peers := NewPeerRegistry(offlineAfter * conf.Discovery.BroadcastInterval)
+	peers.Upsert(&s)
+
 	return &Server{
-		ServerInfos: map[string]*ServerInfo{
-			ip: &s,
-		},
-		conf: conf,
+		Peers: peers,
+		self:  id.DeviceID,
+		conf:  conf,
+		guard: newReplayGuard(conf.Discovery.ReplayWindow),
+		heard: map[string]map[string]time.Time{},
 	}
 }
 
-type Message struct {
-	Hash string `json:"hash"`
-}
-
+// ServerInfo is what is known about a peer from its latest announcement.
 type ServerInfo struct {
-	Id        uuid.UUID `json:"id"`
+	// Id is the device ID of the peer.
+	Id        string    `json:"id"`
+	Name      string    `json:"name"`
 	Ip        string    `json:"ip"`
 	Port      string    `json:"port"`
+	Version   uint8     `json:"version"`
+	Folders   []string  `json:"folders"`
 	CreatedAt time.Time `json:"createdAt"`
 	UpdatedAt time.Time `json:"updatedAt"`
 	Self      bool      `json:"self"`
+	// Online is false once the peer stopped announcing itself.
+	Online bool `json:"online"`
 }
 
-func (s *Server) add(ip string) {
-	o, ok := s.ServerInfos[ip]
-	now := time.Now()
+// Shares reports whether the peer announced the folder folderID. Only
+// folders with the same ID are synced with each other.
+func (si *ServerInfo) Shares(folderID string) bool {
+	return slices.Contains(si.Folders, folderID)
+}
+
+// update takes over the details the peer announced.
+func (si *ServerInfo) update(m *Message) {
+	si.Id = m.DeviceID
+	si.Name = m.Name
+	si.Port = strconv.Itoa(m.Port)
+	si.Version = m.Version
+	si.Folders = m.Folders
+}
+
+// add records an announcement of the device m.DeviceID received at now. A
+// peer keeps the address it is known at as long as it announces itself from
+// there, and only moves to a different one once that went silent. Our own
+// announcements coming back are ignored.
+func (s *Server) add(ip string, m *Message, now time.Time) {
+	if m.DeviceID == s.self {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	si := ServerInfo{Ip: ip, UpdatedAt: now}
+	si.update(m)
 
+	o, ok := s.Peers.Get(si.Id)
+	if ok && o.Online && o.Ip != ip && s.heardFrom(si.Id, o.Ip, now) {
+		si.Ip = o.Ip
+	}
+	s.hear(si.Id, ip, now)
+
+	if !ok {
+		log.Printf("Seen server %s (%s) at %s\n", si.Name, si.Id, ip)
+	} else if o.Ip != si.Ip {
+		log.Printf("Server %s moved from %s to %s\n", si.Id, o.Ip, si.Ip)
+	}
+
+	s.Peers.Upsert(&si)
+}
+
+// heardFrom reports whether the device id still announces itself from ip.
+func (s *Server) heardFrom(id, ip string, now time.Time) bool {
+	at, ok := s.heard[id][ip]
+	return ok && now.Sub(at) <= switchAfter*s.conf.Discovery.BroadcastInterval
+}
+
+// hear records an announcement of the device id from ip and forgets the
+// addresses it went silent at.
+func (s *Server) hear(id, ip string, now time.Time) {
+	addrs, ok := s.heard[id]
 	if !ok {
-		nsi := ServerInfo{
-			Id:        uuid.New(),
-			Ip:        ip,
-			CreatedAt: now,
-			UpdatedAt: now,
-			Self:      false,
+		addrs = map[string]time.Time{}
+		s.heard[id] = addrs
+	}
+
+	addrs[ip] = now
+	for a := range addrs {
+		if !s.heardFrom(id, a, now) {
+			delete(addrs, a)
 		}
+	}
+}
+
+// expire marks peers offline that stopped announcing themselves.
+func (s *Server) expire() {
+	ticker := time.NewTicker(s.conf.Discovery.BroadcastInterval)
+	defer ticker.Stop()
 
-		s.ServerInfos[ip] = &nsi
-		log.Println("Added server:", ip)
-	} else {
-		o.UpdatedAt = now
-		log.Println("Updated server:", ip)
+	for now := range ticker.C {
+		s.Peers.Expire(now)
 	}
 }
 
+// Listen receives announcements sent to the broadcast port and to the
+// configured multicast groups.
 func (s *Server) Listen() {
 	addr := net.UDPAddr{
 		Port: s.conf.Discovery.BroadcastPort,
@@ -89,12 +174,33 @@ func (s *Server) Listen() {
 	}
 
 	defer conn.Close()
+
+	go s.expire()
+
+	conns, err := listenMulticast(s.conf)
+	if err != nil {
+		log.Println("Error setting up multicast discovery:", err)
+	}
+	for _, c := range conns {
+		go func(c *net.UDPConn) {
+			defer c.Close()
+			s.serve(c)
+		}(c)
+	}
+
 	log.Println("Listening for broadcast messages...")
+	s.serve(conn)
+}
 
+// serve reads announcements from conn until it is closed.
+func (s *Server) serve(conn *net.UDPConn) {
 	buffer := make([]byte, s.conf.Discovery.BufferSize)
 	for {
 		n, clientAddr, err := conn.ReadFromUDP(buffer)
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			log.Println("Error reading UDP message:", err)
 			continue
 		}
@@ -114,44 +220,78 @@ func (s *Server) Listen() {
 			continue
 		}
 
-		if err := validateHash(receivedMessage.Hash); err != nil {
-			log.Printf(
-				"Invalid hash: %s\n",
-				receivedMessage.Hash,
-			)
+		now := time.Now()
+		err = s.accept(&receivedMessage, now)
+		if errors.Is(err, ErrReplayedMessage) {
+			// every socket that joined a group gets its own copy of a
+			// multicast announcement
+			continue
+		}
+		if err != nil {
+			log.Printf("Rejected announcement from %s: %s\n", ip, err)
 			continue
 		}
-		s.add(ip)
+		s.add(ip, &receivedMessage, now)
+	}
+}
+
+// accept checks that an announcement is signed by the device it names and is
+// neither stale nor a replay of one already seen.
+func (s *Server) accept(m *Message, now time.Time) error {
+	err := m.verify()
+	if err != nil {
+		return err
 	}
+
+	return s.guard.check(m, now)
 }
 
+// validateAddr returns the address peers are dialed at. Loopback is accepted
+// so several nodes can run on one host. Link-local IPv6 addresses keep their
+// zone, without it they cannot be dialed.
 func validateAddr(addr *net.UDPAddr) (string, error) {
-	if !addr.IP.IsGlobalUnicast() {
-		return "", errors.New("invalid address: is not global uni cast")
+	if addr.IP.IsUnspecified() || addr.IP.IsMulticast() {
+		return "", errors.New("invalid address: is not a unicast address")
 	}
 
-	to4 := addr.IP.To4()
-	if addr.IP.IsLoopback() || to4 == nil {
-		return "", errors.New("invalid address: is not loop back or not an IPv4 address")
+	if to4 := addr.IP.To4(); to4 != nil {
+		return to4.String(), nil
 	}
 
-	return to4.String(), nil
+	if addr.IP.IsLinkLocalUnicast() {
+		if addr.Zone == "" {
+			return "", errors.New("invalid address: link-local address without zone")
+		}
+		return addr.IP.String() + "%" + addr.Zone, nil
+	}
+
+	return addr.IP.String(), nil
 }
 
+// getIp returns the first IPv4 address of the host, or its first global IPv6
+// address on IPv6-only hosts.
 func getIp() (string, error) {
 	addrs, err := net.InterfaceAddrs()
 	if err != nil {
 		return "", err
 	}
 
+	var ipv6 string
 	for _, addr := range addrs {
 		if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() {
 			to4 := ipNet.IP.To4()
 			if to4 != nil {
 				return to4.String(), nil
 			}
+			if ipv6 == "" && ipNet.IP.IsGlobalUnicast() {
+				ipv6 = ipNet.IP.String()
+			}
 		}
 	}
 
+	if ipv6 != "" {
+		return ipv6, nil
+	}
+
 	return "", errors.New("no ip found")
 }
@@ -3,6 +3,7 @@ package discovery
 import (
 	"encoding/json"
 	"github.com/hippo-an/sync-net/pkg/config"
+	"github.com/hippo-an/sync-net/pkg/identity"
 	"github.com/stretchr/testify/require"
 	"log"
 	"net"
@@ -21,7 +22,11 @@ func TestMain(m *testing.M) {
 		log.Fatal(err)
 	}
 	conf = c
-	s := NewServer(c)
+	id, err := identity.New()
+	if err != nil {
+		log.Fatal(err)
+	}
+	s := NewServer(c, id)
 
 	go s.Listen()
 
@@ -31,16 +36,15 @@ func TestMain(m *testing.M) {
 
 func TestUDPBroadcastHandling(t *testing.T) {
 
-	message := Message{
-		Hash: generateHash(),
-	}
+	id, err := identity.New()
+	require.NoError(t, err)
+	message, err := newMessage(details, id, time.Now())
+	require.NoError(t, err)
 
 	jsonData1, err := json.Marshal(message)
 	require.NoError(t, err)
 
-	message = Message{
-		Hash: "invalid hash please",
-	}
+	message.Signature = []byte("invalid signature please")
 
 	jsonData2, err := json.Marshal(message)
 	require.NoError(t, err)
@@ -57,3 +61,95 @@ func TestUDPBroadcastHandling(t *testing.T) {
 	require.NoError(t, err, "failed to send UDP message")
 	time.Sleep(5 * time.Second)
 }
+
+func TestAddNotifiesSubscribers(t *testing.T) {
+	self, err := identity.New()
+	require.NoError(t, err)
+	s := NewServer(conf, self)
+	events := s.Peers.Subscribe()
+	id, err := identity.New()
+	require.NoError(t, err)
+	m, err := newMessage(details, id, time.Now())
+	require.NoError(t, err)
+
+	s.add("10.0.0.2", m, time.Now())
+	e := requireEvent(t, events, PeerJoined)
+	require.Equal(t, "10.0.0.2", e.Peer.Ip)
+	require.Equal(t, id.DeviceID, e.Peer.Id)
+	require.Equal(t, "peer", e.Peer.Name)
+	require.Equal(t, "9000", e.Peer.Port)
+	require.Equal(t, uint8(4), e.Peer.Version)
+	require.Equal(t, []string{"default"}, e.Peer.Folders)
+
+	s.add("10.0.0.2", m, time.Now())
+	requireNoEvent(t, events)
+
+	s.Peers.Expire(time.Now().Add((offlineAfter + 1) * conf.Discovery.BroadcastInterval))
+	requireEvent(t, events, PeerLeft)
+
+	s.add("10.0.0.2", m, time.Now())
+	e = requireEvent(t, events, PeerJoined)
+	require.Equal(t, "10.0.0.2", e.Peer.Ip)
+}
+
+func TestPeersAreTrackedByDeviceID(t *testing.T) {
+	self, err := identity.New()
+	require.NoError(t, err)
+	s := NewServer(conf, self)
+	me, ok := s.Peers.Get(self.DeviceID)
+	require.True(t, ok)
+	require.True(t, me.Self)
+
+	id, err := identity.New()
+	require.NoError(t, err)
+	m, err := newMessage(details, id, time.Now())
+	require.NoError(t, err)
+
+	now := time.Now()
+	s.add("10.0.0.2", m, now)
+	s.add("10.0.0.3", m, now)
+	require.Len(t, s.Peers.List(), 2)
+	peer, ok := s.Peers.Get(id.DeviceID)
+	require.True(t, ok)
+	require.Equal(t, "10.0.0.2", peer.Ip)
+
+	// the old address went silent
+	s.add("10.0.0.3", m, now.Add((switchAfter+1)*conf.Discovery.BroadcastInterval))
+	require.Len(t, s.Peers.List(), 2)
+	peer, ok = s.Peers.Get(id.DeviceID)
+	require.True(t, ok)
+	require.Equal(t, "10.0.0.3", peer.Ip)
+
+	// our own announcement coming back does not add a peer
+	own, err := newMessage(details, self, time.Now())
+	require.NoError(t, err)
+	s.add("10.0.0.4", own, time.Now())
+	require.Len(t, s.Peers.List(), 2)
+}
+
+func TestDualStackPeerKeepsItsAddress(t *testing.T) {
+	self, err := identity.New()
+	require.NoError(t, err)
+	s := NewServer(conf, self)
+	events := s.Peers.Subscribe()
+	id, err := identity.New()
+	require.NoError(t, err)
+	m, err := newMessage(details, id, time.Now())
+	require.NoError(t, err)
+
+	now := time.Now()
+	s.add("10.0.0.2", m, now)
+	requireEvent(t, events, PeerJoined)
+
+	// every interval the peer is heard over IPv4 and IPv6
+	for i := 0; i < 3; i++ {
+		at := now.Add(time.Duration(i) * conf.Discovery.BroadcastInterval)
+		s.add("fe80::2%eth0", m, at)
+		s.add("10.0.0.2", m, at)
+		s.add("fe80::2%eth0", m, at)
+	}
+	requireNoEvent(t, events)
+	peer, ok := s.Peers.Get(id.DeviceID)
+	require.True(t, ok)
+	require.Equal(t, "10.0.0.2", peer.Ip)
+}
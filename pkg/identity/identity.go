@@ -0,0 +1,255 @@
+package identity
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base32"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/hippo-an/sync-net/pkg/config"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	certFileName = "cert.pem"
+	keyFileName  = "key.pem"
+	commonName   = "syncnet"
+	validFor     = 20 * 365 * 24 * time.Hour
+
+	// signatureAlgorithm is what device keys sign with outside of TLS.
+	signatureAlgorithm = x509.ECDSAWithSHA256
+)
+
+var (
+	ErrNoPeerCertificate = errors.New("no peer certificate")
+	ErrNotSigner         = errors.New("private key cannot sign")
+)
+
+// deviceIdEncoding renders certificate fingerprints as upper case base32
+// without padding.
+var deviceIdEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Identity is the key pair a node uses for all peer connections. Its
+// DeviceID is derived from the certificate, so peers can recognise the node
+// regardless of its address.
+type Identity struct {
+	Certificate tls.Certificate
+	DeviceID    string
+}
+
+// Open loads the key pair from the state directory and generates it on
+// first run.
+func Open(conf *config.Config) (*Identity, error) {
+	certPath := filepath.Join(conf.Node.StateDir, certFileName)
+	keyPath := filepath.Join(conf.Node.StateDir, keyFileName)
+
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err == nil {
+		return fromCertificate(cert)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	certPEM, keyPEM, err := generate()
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.MkdirAll(conf.Node.StateDir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.WriteFile(keyPath, keyPEM, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.WriteFile(certPath, certPEM, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err = tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	return fromCertificate(cert)
+}
+
+// New generates an identity that is not stored anywhere.
+func New() (*Identity, error) {
+	certPEM, keyPEM, err := generate()
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	return fromCertificate(cert)
+}
+
+func fromCertificate(cert tls.Certificate) (*Identity, error) {
+	if len(cert.Certificate) == 0 {
+		return nil, ErrNoPeerCertificate
+	}
+
+	return &Identity{
+		Certificate: cert,
+		DeviceID:    DeviceID(cert.Certificate[0]),
+	}, nil
+}
+
+// generate creates a self-signed ECDSA certificate and returns it and its
+// key PEM encoded.
+func generate() ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(validFor),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{commonName},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
+
+// DeviceID returns the fingerprint of a DER encoded certificate.
+func DeviceID(der []byte) string {
+	sum := sha256.Sum256(der)
+	return deviceIdEncoding.EncodeToString(sum[:])
+}
+
+// ServerConfig accepts TLS 1.3 connections from peers presenting any
+// certificate. Which devices are welcome is decided from PeerID.
+func (id *Identity) ServerConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:            tls.VersionTLS13,
+		Certificates:          []tls.Certificate{id.Certificate},
+		ClientAuth:            tls.RequireAnyClientCert,
+		VerifyPeerCertificate: verifySelfSigned,
+	}
+}
+
+// ClientConfig connects with TLS 1.3 to a peer presenting a self-signed
+// certificate. There is no CA to check it against, the peer is identified by
+// the certificate fingerprint instead.
+func (id *Identity) ClientConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:            tls.VersionTLS13,
+		Certificates:          []tls.Certificate{id.Certificate},
+		InsecureSkipVerify:    true,
+		VerifyPeerCertificate: verifySelfSigned,
+	}
+}
+
+// verifySelfSigned checks that the peer holds the key of the certificate it
+// presented, which TLS already proved, and that the certificate is a valid,
+// self-signed one.
+func verifySelfSigned(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return ErrNoPeerCertificate
+	}
+
+	cert, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+		return fmt.Errorf("peer certificate %s is not valid at %s", DeviceID(rawCerts[0]), now.Format(time.RFC3339))
+	}
+
+	return cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature)
+}
+
+// PeerID completes the handshake of conn and returns the device ID of the
+// peer.
+func PeerID(conn *tls.Conn) (string, error) {
+	err := conn.Handshake()
+	if err != nil {
+		return "", err
+	}
+
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return "", ErrNoPeerCertificate
+	}
+
+	return DeviceID(certs[0].Raw), nil
+}
+
+// Sign signs data with the device key. Anyone holding the certificate can
+// check the signature with Verify.
+func (id *Identity) Sign(data []byte) ([]byte, error) {
+	signer, ok := id.Certificate.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, ErrNotSigner
+	}
+
+	digest := sha256.Sum256(data)
+	return signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+}
+
+// Verify checks that sig is a signature of data made with the key of the
+// DER encoded device certificate and returns the ID of that device.
+func Verify(der, data, sig []byte) (string, error) {
+	err := verifySelfSigned([][]byte{der}, nil)
+	if err != nil {
+		return "", err
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return "", err
+	}
+
+	err = cert.CheckSignature(signatureAlgorithm, data, sig)
+	if err != nil {
+		return "", err
+	}
+
+	return DeviceID(der), nil
+}
@@ -0,0 +1,134 @@
+package identity
+
+import (
+	"crypto/tls"
+	"github.com/hippo-an/sync-net/pkg/config"
+	"github.com/stretchr/testify/require"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func createConf(t *testing.T) *config.Config {
+	t.Helper()
+	conf, err := config.NewConfig()
+	require.NoError(t, err)
+	conf.Node.StateDir = filepath.Join(t.TempDir(), "state")
+
+	return conf
+}
+
+func TestOpenPersistsIdentity(t *testing.T) {
+	conf := createConf(t)
+
+	id, err := Open(conf)
+	require.NoError(t, err)
+	require.Len(t, id.DeviceID, 52)
+
+	info, err := os.Stat(filepath.Join(conf.Node.StateDir, keyFileName))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	again, err := Open(conf)
+	require.NoError(t, err)
+	require.Equal(t, id.DeviceID, again.DeviceID)
+
+	other, err := New()
+	require.NoError(t, err)
+	require.NotEqual(t, id.DeviceID, other.DeviceID)
+}
+
+// handshake connects a client and a server over loopback and returns the
+// peer IDs each side saw.
+func handshake(t *testing.T, server, client *tls.Config) (string, string, error, error) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	type result struct {
+		id  string
+		err error
+	}
+	done := make(chan result)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			done <- result{"", err}
+			return
+		}
+		defer conn.Close()
+
+		id, err := PeerID(tls.Server(conn, server))
+		done <- result{id, err}
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+
+	// with TLS 1.3 the client may finish before the server has checked its
+	// certificate, closing lets a waiting server see the outcome
+	clientSaw, clientErr := PeerID(tls.Client(conn, client))
+	conn.Close()
+	r := <-done
+	return r.id, clientSaw, r.err, clientErr
+}
+
+func TestMutualAuthentication(t *testing.T) {
+	server, err := New()
+	require.NoError(t, err)
+	client, err := New()
+	require.NoError(t, err)
+
+	serverSaw, clientSaw, serverErr, clientErr := handshake(t, server.ServerConfig(), client.ClientConfig())
+	require.NoError(t, serverErr)
+	require.NoError(t, clientErr)
+	require.Equal(t, client.DeviceID, serverSaw)
+	require.Equal(t, server.DeviceID, clientSaw)
+}
+
+func TestRejectsClientsWithoutCertificate(t *testing.T) {
+	server, err := New()
+	require.NoError(t, err)
+
+	anonymous := &tls.Config{InsecureSkipVerify: true, MinVersion: tls.VersionTLS13}
+	_, _, serverErr, _ := handshake(t, server.ServerConfig(), anonymous)
+	require.Error(t, serverErr)
+}
+
+func TestRejectsOldTLSVersions(t *testing.T) {
+	server, err := New()
+	require.NoError(t, err)
+	client, err := New()
+	require.NoError(t, err)
+
+	old := client.ClientConfig()
+	old.MinVersion = tls.VersionTLS12
+	old.MaxVersion = tls.VersionTLS12
+	_, _, serverErr, clientErr := handshake(t, server.ServerConfig(), old)
+	require.Error(t, serverErr)
+	require.Error(t, clientErr)
+}
+
+func TestSignAndVerify(t *testing.T) {
+	id, err := New()
+	require.NoError(t, err)
+	other, err := New()
+	require.NoError(t, err)
+
+	der := id.Certificate.Certificate[0]
+	sig, err := id.Sign([]byte("announcement"))
+	require.NoError(t, err)
+
+	device, err := Verify(der, []byte("announcement"), sig)
+	require.NoError(t, err)
+	require.Equal(t, id.DeviceID, device)
+
+	_, err = Verify(der, []byte("tampered"), sig)
+	require.Error(t, err)
+
+	_, err = Verify(other.Certificate.Certificate[0], []byte("announcement"), sig)
+	require.Error(t, err)
+}
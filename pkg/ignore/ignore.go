@@ -0,0 +1,209 @@
+package ignore
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/hippo-an/sync-net/pkg/config"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// FileName is the file in the root of the synced folder holding ignore
+// patterns. It is local to the device and never synced itself.
+const FileName = ".syncignore"
+
+// rule is one gitignore-style pattern split into path segments.
+type rule struct {
+	segments []string
+	negate   bool
+	dirOnly  bool
+}
+
+// Matcher decides which paths are left out of syncing. Patterns follow the
+// gitignore rules: the last matching pattern wins, "!" re-includes, a
+// trailing "/" only matches directories, a pattern containing a "/" is
+// anchored to the root, and "**" matches any number of directories.
+//
+// A nil Matcher ignores nothing.
+type Matcher struct {
+	mu     sync.RWMutex
+	root   string
+	extra  []string
+	rules  []rule
+	loaded []byte
+}
+
+// Load reads the patterns from the config and from the .syncignore file in
+// the synced folder. Patterns in the file take precedence.
+func Load(conf *config.Config) (*Matcher, error) {
+	m := &Matcher{
+		root:  conf.Watcher.Path,
+		extra: conf.Watcher.Ignore,
+	}
+
+	_, err := m.Reload()
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// New creates a matcher from patterns alone, without a .syncignore file.
+func New(patterns ...string) *Matcher {
+	m := &Matcher{extra: patterns}
+	m.rules = parse(patterns)
+	return m
+}
+
+// Reload reads the .syncignore file again and reports whether the patterns
+// changed.
+func (m *Matcher) Reload() (bool, error) {
+	if m.root == "" {
+		return false, nil
+	}
+
+	data, err := os.ReadFile(filepath.Join(m.root, FileName))
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.rules != nil && bytes.Equal(data, m.loaded) {
+		return false, nil
+	}
+
+	patterns := append([]string{}, m.extra...)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		patterns = append(patterns, scanner.Text())
+	}
+
+	m.rules = parse(patterns)
+	m.loaded = data
+	return true, nil
+}
+
+// Match reports whether the slash separated path relative to the root is
+// ignored. Everything below an ignored directory is ignored as well, like
+// with git a file cannot be re-included if its directory is excluded.
+func (m *Matcher) Match(relPath string, isDir bool) bool {
+	if m == nil {
+		return false
+	}
+
+	relPath = strings.Trim(path.Clean(relPath), "/")
+	if relPath == "." || relPath == "" {
+		return false
+	}
+
+	if relPath == FileName {
+		return true
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	parts := strings.Split(relPath, "/")
+	for i := 1; i < len(parts); i++ {
+		if m.match(parts[:i], true) {
+			return true
+		}
+	}
+
+	return m.match(parts, isDir)
+}
+
+func (m *Matcher) match(parts []string, isDir bool) bool {
+	ignored := false
+	for _, r := range m.rules {
+		if r.dirOnly && !isDir {
+			continue
+		}
+		if matchSegments(r.segments, parts) {
+			ignored = !r.negate
+		}
+	}
+	return ignored
+}
+
+func parse(patterns []string) []rule {
+	rules := make([]rule, 0, len(patterns))
+	for _, p := range patterns {
+		r, ok := parseRule(p)
+		if ok {
+			rules = append(rules, r)
+		}
+	}
+	return rules
+}
+
+func parseRule(p string) (rule, bool) {
+	p = strings.TrimRight(p, " \t\r")
+	if p == "" || strings.HasPrefix(p, "#") {
+		return rule{}, false
+	}
+
+	var r rule
+	if strings.HasPrefix(p, "!") {
+		r.negate = true
+		p = p[1:]
+	} else if strings.HasPrefix(p, `\!`) || strings.HasPrefix(p, `\#`) {
+		p = p[1:]
+	}
+
+	if strings.HasSuffix(p, "/") {
+		r.dirOnly = true
+		p = strings.TrimRight(p, "/")
+	}
+
+	if p == "" {
+		return rule{}, false
+	}
+
+	// a pattern without a slash matches at any depth
+	anchored := strings.Contains(p, "/")
+	p = strings.TrimPrefix(p, "/")
+	r.segments = strings.Split(p, "/")
+	if !anchored {
+		r.segments = append([]string{"**"}, r.segments...)
+	}
+
+	return r, true
+}
+
+// matchSegments matches path segments against pattern segments, where "**"
+// stands for any number of segments. A trailing "**" needs at least one.
+func matchSegments(pattern, parts []string) bool {
+	if len(pattern) == 0 {
+		return len(parts) == 0
+	}
+
+	if pattern[0] == "**" {
+		if len(pattern) == 1 {
+			return len(parts) > 0
+		}
+		for i := 0; i <= len(parts); i++ {
+			if matchSegments(pattern[1:], parts[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if len(parts) == 0 {
+		return false
+	}
+
+	ok, err := path.Match(pattern[0], parts[0])
+	if err != nil || !ok {
+		return false
+	}
+
+	return matchSegments(pattern[1:], parts[1:])
+}
@@ -0,0 +1,102 @@
+package ignore
+
+import (
+	"github.com/hippo-an/sync-net/pkg/config"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	m := New(
+		"# editor files",
+		"*.swp",
+		"build/",
+		"/root.txt",
+		"docs/*.pdf",
+		"**/cache/**",
+		"a/**/z",
+		"*.log",
+		"!keep.log",
+		`\!bang`,
+	)
+
+	tests := []struct {
+		path  string
+		isDir bool
+		want  bool
+	}{
+		{".file.swp", false, true},
+		{"dir/.file.swp", false, true},
+		{"build", true, true},
+		{"build", false, false},
+		{"build/out.bin", false, true},
+		{"src/build/out.bin", false, true},
+		{"root.txt", false, true},
+		{"dir/root.txt", false, false},
+		{"docs/manual.pdf", false, true},
+		{"docs/sub/manual.pdf", false, false},
+		{"x/cache", true, false},
+		{"x/cache/entry", false, true},
+		{"a/z", false, true},
+		{"a/b/c/z", false, true},
+		{"debug.log", false, true},
+		{"keep.log", false, false},
+		{"dir/keep.log", false, false},
+		{"!bang", false, true},
+		{"bang", false, false},
+		{FileName, false, true},
+		{"main.go", false, false},
+		{".", true, false},
+	}
+
+	for _, tt := range tests {
+		require.Equal(t, tt.want, m.Match(tt.path, tt.isDir), tt.path)
+	}
+}
+
+func TestNegationCannotReincludeInsideIgnoredDirectory(t *testing.T) {
+	m := New("logs/", "!logs/keep.log")
+	require.True(t, m.Match("logs/keep.log", false))
+
+	m = New("logs/*", "!logs/keep.log")
+	require.False(t, m.Match("logs/keep.log", false))
+	require.True(t, m.Match("logs/other.log", false))
+}
+
+func TestNilMatcherIgnoresNothing(t *testing.T) {
+	var m *Matcher
+	require.False(t, m.Match("anything", false))
+}
+
+func TestLoadReadsConfigAndFile(t *testing.T) {
+	conf, err := config.NewConfig()
+	require.NoError(t, err)
+	conf.Watcher.Path = t.TempDir()
+	conf.Watcher.Ignore = []string{"*.tmp", "*.log"}
+
+	m, err := Load(conf)
+	require.NoError(t, err)
+	require.True(t, m.Match("a.tmp", false))
+	require.True(t, m.Match("a.log", false))
+
+	// the file comes after the config, so it can re-include
+	file := filepath.Join(conf.Watcher.Path, FileName)
+	require.NoError(t, os.WriteFile(file, []byte("!a.log\nnode_modules/\n"), 0644))
+	changed, err := m.Reload()
+	require.NoError(t, err)
+	require.True(t, changed)
+	require.False(t, m.Match("a.log", false))
+	require.True(t, m.Match("node_modules", true))
+
+	changed, err = m.Reload()
+	require.NoError(t, err)
+	require.False(t, changed)
+
+	require.NoError(t, os.Remove(file))
+	changed, err = m.Reload()
+	require.NoError(t, err)
+	require.True(t, changed)
+	require.True(t, m.Match("a.log", false))
+}
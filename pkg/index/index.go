@@ -0,0 +1,546 @@
+package index
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/hippo-an/sync-net/pkg/config"
+	"github.com/hippo-an/sync-net/pkg/ignore"
+	"github.com/hippo-an/sync-net/pkg/utils"
+	"github.com/hippo-an/sync-net/pkg/watcher"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const indexFileName = "index.json"
+
+// saveDelay is how long changes may wait before the index is written. They
+// are saved in batches, syncing many files does not rewrite the whole index
+// for each of them.
+const saveDelay = time.Second
+
+var (
+	ErrOutsideRoot = errors.New("path is outside of the sync root")
+	ErrNotRegular  = errors.New("not a regular file")
+)
+
+// FileInfo is what the index knows about a single path. Paths are relative
+// to the sync root and slash separated, the same form used on the wire.
+type FileInfo struct {
+	Path    string      `json:"path"`
+	Size    int64       `json:"size"`
+	ModTime time.Time   `json:"modTime"`
+	Mode    os.FileMode `json:"mode"`
+	Hash    string      `json:"hash"`
+	Version uint64      `json:"version"`
+	Vector  Vector      `json:"vector,omitempty"`
+	Deleted bool        `json:"deleted"`
+	// Dir marks a directory. Directories only carry their mode.
+	Dir bool `json:"dir,omitempty"`
+	// ModifiedBy is the device that made the latest change.
+	ModifiedBy string `json:"modifiedBy,omitempty"`
+}
+
+// Index holds an entry for every path in the sync root. Entries are replaced
+// on change, never modified in place.
+type Index struct {
+	mu       sync.RWMutex
+	root     string
+	stateDir string
+	file     string
+	device   string
+	ignores  *ignore.Matcher
+	files    map[string]*FileInfo
+	// saveMu serializes writes of the index file.
+	saveMu sync.Mutex
+	// dirty is set while there are changes not saved yet, scheduled while
+	// a save is due.
+	dirty     bool
+	scheduled bool
+}
+
+// Open loads the index stored in the node's state directory, or starts an
+// empty one if there is none yet. Local changes are counted in version
+// vectors under device, the node's persistent device ID. Paths matched by
+// ignores are left out of scans.
+func Open(conf *config.Config, device string, ignores *ignore.Matcher) (*Index, error) {
+	err := os.MkdirAll(conf.Node.StateDir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	i := &Index{
+		root:     conf.Watcher.Path,
+		stateDir: conf.Node.StateDir,
+		file:     filepath.Join(conf.Node.StateDir, indexFileName),
+		device:   device,
+		ignores:  ignores,
+		files:    map[string]*FileInfo{},
+	}
+
+	data, err := os.ReadFile(i.file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return i, nil
+		}
+		return nil, err
+	}
+
+	var files []*FileInfo
+	err = json.Unmarshal(data, &files)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range files {
+		i.files[f.Path] = f
+	}
+
+	return i, nil
+}
+
+func (i *Index) Root() string {
+	return i.root
+}
+
+func (i *Index) DeviceID() string {
+	return i.device
+}
+
+// Get returns a copy of the entry for path.
+func (i *Index) Get(path string) (*FileInfo, bool) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	f, ok := i.files[path]
+	if !ok {
+		return nil, false
+	}
+
+	c := *f
+	return &c, true
+}
+
+// List returns a copy of all entries, tombstones included, sorted by path.
+func (i *Index) List() []*FileInfo {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	files := make([]*FileInfo, 0, len(i.files))
+	for _, f := range i.files {
+		c := *f
+		files = append(files, &c)
+	}
+
+	sort.Slice(files, func(a, b int) bool {
+		return files[a].Path < files[b].Path
+	})
+
+	return files
+}
+
+// Below returns a copy of the entries inside the directory path, tombstones
+// included, sorted by path so that directories come before their content.
+func (i *Index) Below(path string) []*FileInfo {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	prefix := path + "/"
+	var files []*FileInfo
+	for p, f := range i.files {
+		if strings.HasPrefix(p, prefix) {
+			c := *f
+			files = append(files, &c)
+		}
+	}
+
+	sort.Slice(files, func(a, b int) bool {
+		return files[a].Path < files[b].Path
+	})
+
+	return files
+}
+
+// Update re-reads path from disk and records it as a local change. A known
+// path that no longer exists is marked as deleted; for an unknown path that
+// does not exist nil is returned.
+func (i *Index) Update(path string) (*FileInfo, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	old := i.files[path]
+	f, err := i.update(path)
+	if err != nil || f == nil {
+		return nil, err
+	}
+
+	if f != old {
+		i.changed()
+	}
+
+	c := *f
+	return &c, nil
+}
+
+// MarkDeleted records a tombstone for path as a local change. Deleting a
+// directory deletes everything inside it as well.
+func (i *Index) MarkDeleted(path string) (*FileInfo, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	old := i.files[path]
+	f := i.markDeleted(path)
+	if f != old {
+		i.changed()
+	}
+
+	c := *f
+	return &c, nil
+}
+
+// Merge records the on-disk state of path after a change received from a
+// peer was applied. The peer's vector is merged into ours without counting
+// the change as a local one.
+func (i *Index) Merge(path string, remote *FileInfo) (*FileInfo, error) {
+	return i.record(path, remote, false)
+}
+
+// Supersede records the on-disk state of path after a conflict with remote
+// was resolved locally, by keeping our copy or by merging both. The result
+// counts as a local change that descends from both versions.
+func (i *Index) Supersede(path string, remote *FileInfo) (*FileInfo, error) {
+	return i.record(path, remote, true)
+}
+
+func (i *Index) record(path string, remote *FileInfo, local bool) (*FileInfo, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	old, ok := i.files[path]
+
+	f, _, err := i.read(path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if f == nil {
+		f = &FileInfo{
+			Path:    path,
+			ModTime: time.Now(),
+			Deleted: true,
+			Dir:     remote.Dir,
+		}
+	}
+
+	f.Version = 1
+	f.Vector = remote.Vector.Copy()
+	if ok {
+		f.Version = old.Version
+		f.Vector = old.Vector.Merge(remote.Vector)
+		if old.Deleted != f.Deleted || old.Hash != f.Hash {
+			f.Version++
+		}
+	}
+
+	f.ModifiedBy = remote.ModifiedBy
+	if local {
+		f.Vector = f.Vector.Increment(i.device)
+		f.ModifiedBy = i.device
+	}
+
+	i.files[path] = f
+	i.changed()
+
+	c := *f
+	return &c, nil
+}
+
+// Scan walks the whole sync root, updates every file found and marks
+// entries that disappeared while the node was not running as deleted.
+// Ignored paths are skipped, and entries that became ignored are kept as
+// they are rather than reported as deleted to peers.
+func (i *Index) Scan() error {
+	err := i.scan()
+	if err != nil {
+		return err
+	}
+
+	return i.Flush()
+}
+
+func (i *Index) scan() error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	seen := map[string]bool{}
+	err := filepath.WalkDir(i.root, func(fullPath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() && (filepath.Clean(fullPath) == filepath.Clean(i.stateDir) || d.Name() == watcher.MetaDirName) {
+			return filepath.SkipDir
+		}
+
+		if filepath.Clean(fullPath) == filepath.Clean(i.root) {
+			return nil
+		}
+
+		path, err := i.relative(fullPath)
+		if err != nil {
+			return err
+		}
+
+		if i.ignores.Match(path, d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !d.IsDir() && (!d.Type().IsRegular() || watcher.IsTempFile(d.Name()) || watcher.IsConflictCopy(d.Name())) {
+			return nil
+		}
+
+		_, err = i.update(path)
+		if err != nil {
+			log.Printf("Error indexing %s: %s\n", fullPath, err)
+			return nil
+		}
+
+		seen[path] = true
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	for path, f := range i.files {
+		if !seen[path] && !f.Deleted && !i.ignores.Match(path, f.Dir) {
+			i.markDeleted(path)
+		}
+	}
+
+	i.changed()
+	return nil
+}
+
+func (i *Index) relative(fullPath string) (string, error) {
+	rel, err := filepath.Rel(i.root, fullPath)
+	if err != nil {
+		return "", err
+	}
+
+	rel = filepath.ToSlash(rel)
+	if rel == "." || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", ErrOutsideRoot
+	}
+
+	return rel, nil
+}
+
+func (i *Index) update(path string) (*FileInfo, error) {
+	old, ok := i.files[path]
+
+	f, changed, err := i.read(path, old)
+	if err != nil {
+		return nil, err
+	}
+
+	if f == nil {
+		if !ok {
+			return nil, nil
+		}
+		return i.markDeleted(path), nil
+	}
+
+	if !changed {
+		return old, nil
+	}
+
+	f.Version = 1
+	f.Vector = Vector{}.Increment(i.device)
+	f.ModifiedBy = i.device
+	if ok {
+		f.Version = old.Version
+		f.Vector = old.Vector
+		f.ModifiedBy = old.ModifiedBy
+		if old.Deleted || old.Dir != f.Dir || old.Hash != f.Hash || old.Mode != f.Mode {
+			f.Version++
+			f.Vector = old.Vector.Increment(i.device)
+			f.ModifiedBy = i.device
+		}
+	}
+
+	i.files[path] = f
+	return f, nil
+}
+
+// read returns the current state of path on disk, or nil if it does not
+// exist. The file is only hashed again when size, modification time or mode
+// differ from old. A directory only changes with its mode, its modification
+// time follows its content.
+func (i *Index) read(path string, old *FileInfo) (*FileInfo, bool, error) {
+	fullPath := filepath.Join(i.root, filepath.FromSlash(path))
+
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, true, nil
+		}
+		return nil, false, err
+	}
+
+	if info.IsDir() {
+		if old != nil && !old.Deleted && old.Dir && old.Mode == info.Mode() {
+			return old, false, nil
+		}
+
+		return &FileInfo{
+			Path:    path,
+			ModTime: info.ModTime(),
+			Mode:    info.Mode(),
+			Dir:     true,
+		}, true, nil
+	}
+
+	if !info.Mode().IsRegular() {
+		return nil, false, ErrNotRegular
+	}
+
+	if old != nil && !old.Deleted && old.Size == info.Size() && old.ModTime.Equal(info.ModTime()) && old.Mode == info.Mode() {
+		return old, false, nil
+	}
+
+	digest, size, err := utils.HashFile(fullPath)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return &FileInfo{
+		Path:    path,
+		Size:    size,
+		ModTime: info.ModTime(),
+		Mode:    info.Mode(),
+		Hash:    digest,
+	}, true, nil
+}
+
+// markDeleted records a tombstone for a known path and, for a directory,
+// for everything inside it. Unknown paths get no entry, there is nothing
+// peers could have seen of them.
+func (i *Index) markDeleted(path string) *FileInfo {
+	old, ok := i.files[path]
+	if !ok {
+		return &FileInfo{
+			Path:    path,
+			ModTime: time.Now(),
+			Deleted: true,
+		}
+	}
+
+	if old.Deleted {
+		return old
+	}
+
+	f := &FileInfo{
+		Path:    path,
+		ModTime: time.Now(),
+		Mode:    old.Mode,
+		Version: old.Version + 1,
+		Vector:  old.Vector.Increment(i.device),
+		Deleted: true,
+		Dir:     old.Dir,
+
+		ModifiedBy: i.device,
+	}
+
+	i.files[path] = f
+
+	if f.Dir {
+		prefix := path + "/"
+		for p, o := range i.files {
+			if strings.HasPrefix(p, prefix) && !o.Deleted {
+				i.markDeleted(p)
+			}
+		}
+	}
+
+	return f
+}
+
+// changed schedules a save of the index, unless one is due already. It is
+// called with i.mu held.
+func (i *Index) changed() {
+	i.dirty = true
+	if i.scheduled {
+		return
+	}
+
+	i.scheduled = true
+	time.AfterFunc(saveDelay, func() {
+		i.mu.Lock()
+		i.scheduled = false
+		i.mu.Unlock()
+
+		err := i.Flush()
+		if err != nil {
+			log.Println("Error saving index:", err)
+		}
+	})
+}
+
+// Flush writes the changes not saved yet to disk.
+func (i *Index) Flush() error {
+	i.saveMu.Lock()
+	defer i.saveMu.Unlock()
+
+	i.mu.Lock()
+	if !i.dirty {
+		i.mu.Unlock()
+		return nil
+	}
+
+	i.dirty = false
+	files := make([]*FileInfo, 0, len(i.files))
+	for _, f := range i.files {
+		files = append(files, f)
+	}
+	i.mu.Unlock()
+
+	err := i.save(files)
+	if err != nil {
+		// saved along with the next change
+		i.mu.Lock()
+		i.dirty = true
+		i.mu.Unlock()
+	}
+	return err
+}
+
+// save writes files as the index through a temporary file so a crash never
+// leaves a truncated index behind.
+func (i *Index) save(files []*FileInfo) error {
+	sort.Slice(files, func(a, b int) bool {
+		return files[a].Path < files[b].Path
+	})
+
+	data, err := json.Marshal(files)
+	if err != nil {
+		return err
+	}
+
+	tmp := i.file + ".tmp"
+	err = os.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, i.file)
+}
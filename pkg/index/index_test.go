@@ -0,0 +1,258 @@
+package index
+
+import (
+	"github.com/hippo-an/sync-net/pkg/config"
+	"github.com/hippo-an/sync-net/pkg/ignore"
+	"github.com/hippo-an/sync-net/pkg/utils"
+	"github.com/hippo-an/sync-net/pkg/watcher"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testDevice = "DEVICE"
+
+func createConf(t *testing.T) *config.Config {
+	t.Helper()
+	conf, err := config.NewConfig()
+	require.NoError(t, err)
+	conf.Watcher.Path = t.TempDir()
+	conf.Node.StateDir = t.TempDir()
+
+	return conf
+}
+
+// openTest opens an index that is saved before the test's temporary
+// directories are removed.
+func openTest(t *testing.T, conf *config.Config, ignores *ignore.Matcher) *Index {
+	t.Helper()
+
+	idx, err := Open(conf, testDevice, ignores)
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, idx.Flush()) })
+	return idx
+}
+
+func TestScan(t *testing.T) {
+	conf := createConf(t)
+	root := conf.Watcher.Path
+
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "dir"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "a.txt"), []byte("a"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "dir", "b.txt"), []byte("bb"), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(root, watcher.TempFilePrefix+"1"), []byte("tmp"), 0644))
+	require.NoError(t, os.MkdirAll(filepath.Join(root, watcher.MetaDirName), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(root, watcher.MetaDirName, "old.txt"), []byte("old"), 0644))
+
+	idx := openTest(t, conf, nil)
+	require.NoError(t, idx.Scan())
+
+	files := idx.List()
+	require.Len(t, files, 3)
+	require.Equal(t, "a.txt", files[0].Path)
+	require.Equal(t, "dir", files[1].Path)
+	require.True(t, files[1].Dir)
+	require.Equal(t, os.FileMode(0755), files[1].Mode.Perm())
+	require.Equal(t, "dir/b.txt", files[2].Path)
+
+	digest, _, err := utils.HashFile(filepath.Join(root, "dir", "b.txt"))
+	require.NoError(t, err)
+	require.Equal(t, digest, files[2].Hash)
+	require.Equal(t, int64(2), files[2].Size)
+	require.Equal(t, os.FileMode(0600), files[2].Mode.Perm())
+	require.Equal(t, uint64(1), files[2].Version)
+	require.False(t, files[2].Deleted)
+}
+
+func TestIndexPersistsAcrossRestarts(t *testing.T) {
+	conf := createConf(t)
+	root := conf.Watcher.Path
+	path := filepath.Join(root, "a.txt")
+
+	require.NoError(t, os.WriteFile(path, []byte("a"), 0644))
+
+	idx := openTest(t, conf, nil)
+	require.NoError(t, idx.Scan())
+
+	// changed and removed while the node was not running
+	require.NoError(t, os.Remove(path))
+
+	idx = openTest(t, conf, nil)
+	f, ok := idx.Get("a.txt")
+	require.True(t, ok)
+	require.False(t, f.Deleted)
+
+	require.NoError(t, idx.Scan())
+	f, ok = idx.Get("a.txt")
+	require.True(t, ok)
+	require.True(t, f.Deleted)
+	require.Equal(t, uint64(2), f.Version)
+}
+
+func TestUpdateBumpsVersionOnlyOnChange(t *testing.T) {
+	conf := createConf(t)
+	path := filepath.Join(conf.Watcher.Path, "a.txt")
+
+	idx := openTest(t, conf, nil)
+
+	require.NoError(t, os.WriteFile(path, []byte("first"), 0644))
+	f, err := idx.Update("a.txt")
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), f.Version)
+
+	f, err = idx.Update("a.txt")
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), f.Version)
+
+	require.NoError(t, os.WriteFile(path, []byte("second"), 0644))
+	f, err = idx.Update("a.txt")
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), f.Version)
+
+	f, err = idx.MarkDeleted("a.txt")
+	require.NoError(t, err)
+	require.True(t, f.Deleted)
+	require.Equal(t, uint64(3), f.Version)
+
+	require.NoError(t, os.WriteFile(path, []byte("second"), 0644))
+	f, err = idx.Update("a.txt")
+	require.NoError(t, err)
+	require.False(t, f.Deleted)
+	require.Equal(t, uint64(4), f.Version)
+}
+
+func TestLocalChangesIncrementOwnCounter(t *testing.T) {
+	conf := createConf(t)
+	path := filepath.Join(conf.Watcher.Path, "a.txt")
+
+	idx := openTest(t, conf, nil)
+	device := idx.DeviceID()
+	require.NotEmpty(t, device)
+
+	require.NoError(t, os.WriteFile(path, []byte("local"), 0644))
+	f, err := idx.Update("a.txt")
+	require.NoError(t, err)
+	require.Equal(t, Vector{device: 1}, f.Vector)
+
+	// a change received from a peer is merged, not counted as ours
+	require.NoError(t, os.WriteFile(path, []byte("from peer"), 0644))
+	f, err = idx.Merge("a.txt", &FileInfo{Vector: Vector{device: 1, "peer": 1}, ModifiedBy: "peer"})
+	require.NoError(t, err)
+	require.Equal(t, Vector{device: 1, "peer": 1}, f.Vector)
+	require.Equal(t, "peer", f.ModifiedBy)
+
+	f, err = idx.Update("a.txt")
+	require.NoError(t, err)
+	require.Equal(t, Vector{device: 1, "peer": 1}, f.Vector)
+
+	f, err = idx.MarkDeleted("a.txt")
+	require.NoError(t, err)
+	require.Equal(t, Vector{device: 2, "peer": 1}, f.Vector)
+	require.Equal(t, device, f.ModifiedBy)
+
+	// keeping our copy over a concurrent remote change supersedes both
+	f, err = idx.Supersede("a.txt", &FileInfo{Vector: Vector{device: 1, "peer": 2}, ModifiedBy: "peer"})
+	require.NoError(t, err)
+	require.Equal(t, Vector{device: 3, "peer": 2}, f.Vector)
+	require.Equal(t, device, f.ModifiedBy)
+
+	reopened := openTest(t, conf, nil)
+	require.Equal(t, device, reopened.DeviceID())
+}
+
+func TestScanSkipsIgnoredPaths(t *testing.T) {
+	conf := createConf(t)
+	root := conf.Watcher.Path
+
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "build"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "a.txt"), []byte("a"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "a.txt.swp"), []byte("swap"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "build", "out.bin"), []byte("out"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(root, ignore.FileName), []byte("*.swp\n"), 0644))
+
+	idx := openTest(t, conf, ignore.New("build/", "*.swp"))
+	require.NoError(t, idx.Scan())
+
+	files := idx.List()
+	require.Len(t, files, 1)
+	require.Equal(t, "a.txt", files[0].Path)
+
+	// a file that becomes ignored is not reported as deleted
+	idx.ignores = ignore.New("a.txt")
+	require.NoError(t, idx.Scan())
+	f, ok := idx.Get("a.txt")
+	require.True(t, ok)
+	require.False(t, f.Deleted)
+}
+
+func TestDirectories(t *testing.T) {
+	conf := createConf(t)
+	root := conf.Watcher.Path
+
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "dir", "empty"), 0700))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "dir", "a.txt"), []byte("a"), 0644))
+
+	idx := openTest(t, conf, nil)
+	require.NoError(t, idx.Scan())
+
+	// new content does not change the directory itself
+	require.NoError(t, os.WriteFile(filepath.Join(root, "dir", "b.txt"), []byte("b"), 0644))
+	d, err := idx.Update("dir")
+	require.NoError(t, err)
+	require.True(t, d.Dir)
+	require.Equal(t, uint64(1), d.Version)
+
+	require.NoError(t, os.Chmod(filepath.Join(root, "dir"), 0755))
+	d, err = idx.Update("dir")
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), d.Version)
+
+	_, err = idx.Update("dir/b.txt")
+	require.NoError(t, err)
+	below := idx.Below("dir")
+	require.Len(t, below, 3)
+	require.Equal(t, "dir/a.txt", below[0].Path)
+	require.Equal(t, "dir/b.txt", below[1].Path)
+	require.Equal(t, "dir/empty", below[2].Path)
+
+	// deleting a directory deletes its content
+	d, err = idx.MarkDeleted("dir")
+	require.NoError(t, err)
+	require.True(t, d.Deleted)
+	require.True(t, d.Dir)
+	for _, f := range idx.Below("dir") {
+		require.True(t, f.Deleted, f.Path)
+	}
+}
+
+func TestChangesAreSavedInBatches(t *testing.T) {
+	conf := createConf(t)
+	idx := openTest(t, conf, nil)
+
+	for _, name := range []string{"a.txt", "b.txt"} {
+		require.NoError(t, os.WriteFile(filepath.Join(conf.Watcher.Path, name), []byte(name), 0644))
+		_, err := idx.Update(name)
+		require.NoError(t, err)
+	}
+
+	// not written yet
+	reopened, err := Open(conf, testDevice, nil)
+	require.NoError(t, err)
+	require.Empty(t, reopened.List())
+
+	require.NoError(t, idx.Flush())
+	reopened, err = Open(conf, testDevice, nil)
+	require.NoError(t, err)
+	require.Len(t, reopened.List(), 2)
+
+	// written on its own after a while
+	_, err = idx.MarkDeleted("a.txt")
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		reopened, err := Open(conf, testDevice, nil)
+		require.NoError(t, err)
+		f, _ := reopened.Get("a.txt")
+		return f.Deleted
+	}, 3*saveDelay, saveDelay/10)
+}
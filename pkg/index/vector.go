@@ -0,0 +1,87 @@
+package index
+
+// Vector is a version vector: for every device that changed a file it holds
+// the number of changes that device made.
+type Vector map[string]uint64
+
+type Ordering int
+
+const (
+	// Equal means both vectors describe the same history.
+	Equal Ordering = iota
+	// Before means the other vector has seen everything this one has and
+	// more, so taking the other side is a fast-forward.
+	Before
+	// After means this vector has seen everything the other one has.
+	After
+	// Concurrent means both sides changed the file independently.
+	Concurrent
+)
+
+func (o Ordering) String() string {
+	switch o {
+	case Equal:
+		return "equal"
+	case Before:
+		return "before"
+	case After:
+		return "after"
+	default:
+		return "concurrent"
+	}
+}
+
+func (v Vector) Compare(other Vector) Ordering {
+	less, greater := false, false
+
+	for id, n := range v {
+		if n > other[id] {
+			greater = true
+		} else if n < other[id] {
+			less = true
+		}
+	}
+
+	for id, n := range other {
+		if _, ok := v[id]; !ok && n > 0 {
+			less = true
+		}
+	}
+
+	switch {
+	case less && greater:
+		return Concurrent
+	case less:
+		return Before
+	case greater:
+		return After
+	default:
+		return Equal
+	}
+}
+
+// Merge returns the element-wise maximum of both vectors.
+func (v Vector) Merge(other Vector) Vector {
+	m := v.Copy()
+	for id, n := range other {
+		if n > m[id] {
+			m[id] = n
+		}
+	}
+	return m
+}
+
+// Increment returns a copy of v with the counter of device id increased.
+func (v Vector) Increment(id string) Vector {
+	m := v.Copy()
+	m[id]++
+	return m
+}
+
+func (v Vector) Copy() Vector {
+	m := make(Vector, len(v))
+	for id, n := range v {
+		m[id] = n
+	}
+	return m
+}
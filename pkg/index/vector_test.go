@@ -0,0 +1,31 @@
+package index
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestVectorCompare(t *testing.T) {
+	a := Vector{"a": 1}
+	require.Equal(t, Equal, a.Compare(Vector{"a": 1}))
+	require.Equal(t, Equal, Vector{}.Compare(nil))
+	require.Equal(t, Before, a.Compare(Vector{"a": 2}))
+	require.Equal(t, Before, a.Compare(Vector{"a": 1, "b": 1}))
+	require.Equal(t, After, Vector{"a": 2, "b": 1}.Compare(a))
+	require.Equal(t, Concurrent, Vector{"a": 2}.Compare(Vector{"a": 1, "b": 1}))
+	require.Equal(t, Before, Vector(nil).Compare(a))
+}
+
+func TestVectorMergeAndIncrement(t *testing.T) {
+	a := Vector{"a": 2, "b": 1}
+	b := Vector{"a": 1, "c": 3}
+
+	m := a.Merge(b)
+	require.Equal(t, Vector{"a": 2, "b": 1, "c": 3}, m)
+	require.Equal(t, After, m.Compare(a))
+	require.Equal(t, After, m.Compare(b))
+
+	i := a.Increment("b")
+	require.Equal(t, Vector{"a": 2, "b": 2}, i)
+	require.Equal(t, Vector{"a": 2, "b": 1}, a)
+}
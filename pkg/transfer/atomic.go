@@ -0,0 +1,197 @@
+package transfer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/hippo-an/sync-net/pkg/watcher"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+var (
+	ErrSizeMismatch = errors.New("size mismatch")
+	ErrHashMismatch = errors.New("hash mismatch")
+)
+
+// atomicFile is a temporary file next to its target. Data is written to the
+// temporary file and only renamed over the target once it is complete and
+// verified, so readers of the synced folder never see partial content.
+type atomicFile struct {
+	file      *os.File
+	hash      hash.Hash
+	target    string
+	mode      os.FileMode
+	resumable bool
+}
+
+func createAtomic(target string) (*atomicFile, error) {
+	file, err := os.CreateTemp(filepath.Dir(target), watcher.TempFilePrefix+"*")
+	if err != nil {
+		return nil, err
+	}
+
+	return &atomicFile{
+		file:   file,
+		hash:   sha256.New(),
+		target: target,
+		mode:   targetMode(target),
+	}, nil
+}
+
+// resumeAtomic opens the partial download at partial, or creates it, and
+// returns how many bytes it already holds. Writes are appended to them. A
+// partial longer than size cannot belong to the transfer and starts over.
+func resumeAtomic(target, partial string, size int64) (*atomicFile, int64, error) {
+	file, err := os.OpenFile(partial, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	a := &atomicFile{
+		file:      file,
+		hash:      sha256.New(),
+		target:    target,
+		mode:      targetMode(target),
+		resumable: true,
+	}
+
+	offset, err := io.Copy(a.hash, file)
+	if err == nil && offset > size {
+		a.hash.Reset()
+		offset = 0
+		err = file.Truncate(0)
+		if err == nil {
+			_, err = file.Seek(0, io.SeekStart)
+		}
+	}
+	if err != nil {
+		a.Abort()
+		return nil, 0, err
+	}
+
+	return a, offset, nil
+}
+
+func targetMode(target string) os.FileMode {
+	if info, err := os.Stat(target); err == nil {
+		return info.Mode().Perm()
+	}
+	return 0644
+}
+
+func (a *atomicFile) Write(p []byte) (int, error) {
+	n, err := a.file.Write(p)
+	a.hash.Write(p[:n])
+	return n, err
+}
+
+// Commit flushes the temporary file to disk, checks that it holds size
+// bytes with the given SHA-256 digest and renames it over the target. The
+// temporary file is removed if any step fails.
+func (a *atomicFile) Commit(size int64, digest string) error {
+	err := a.Verify(size, digest)
+	if err != nil {
+		a.Abort()
+		return err
+	}
+
+	return a.Replace()
+}
+
+// Verify flushes the temporary file to disk and checks its size and digest.
+func (a *atomicFile) Verify(size int64, digest string) error {
+	err := a.file.Sync()
+	if err != nil {
+		return err
+	}
+
+	info, err := a.file.Stat()
+	if err != nil {
+		return err
+	}
+
+	if info.Size() != size {
+		return fmt.Errorf("%w: received %d bytes, expected %d", ErrSizeMismatch, info.Size(), size)
+	}
+
+	sum := hex.EncodeToString(a.hash.Sum(nil))
+	if sum != digest {
+		return fmt.Errorf("%w: received %s, expected %s", ErrHashMismatch, sum, digest)
+	}
+
+	return nil
+}
+
+// Replace renames the temporary file over the target without checking its
+// content, for data produced locally. The temporary file is removed if any
+// step fails.
+func (a *atomicFile) Replace() error {
+	err := a.replace()
+	if err != nil {
+		a.Abort()
+	}
+	return err
+}
+
+func (a *atomicFile) replace() error {
+	err := a.file.Sync()
+	if err != nil {
+		return err
+	}
+
+	err = a.file.Chmod(a.mode)
+	if err != nil {
+		return err
+	}
+
+	err = a.file.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(a.file.Name(), a.target)
+	if err != nil {
+		return err
+	}
+
+	syncDir(filepath.Dir(a.target))
+	return nil
+}
+
+// Release gives up on the transfer after an interrupted receive. A
+// resumable file is flushed and kept for the next attempt, any other
+// temporary file is removed.
+func (a *atomicFile) Release() {
+	if !a.resumable {
+		a.Abort()
+		return
+	}
+
+	_ = a.file.Sync()
+	_ = a.file.Close()
+}
+
+// Abort discards the temporary file.
+func (a *atomicFile) Abort() {
+	_ = a.file.Close()
+
+	err := os.Remove(a.file.Name())
+	if err != nil && !os.IsNotExist(err) {
+		log.Println("Error removing temporary file:", err)
+	}
+}
+
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	defer d.Close()
+
+	_ = d.Sync()
+}
@@ -0,0 +1,115 @@
+package transfer
+
+import (
+	"github.com/hippo-an/sync-net/pkg/watcher"
+	"github.com/stretchr/testify/require"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func requireNoTempFiles(t *testing.T, dir string) {
+	t.Helper()
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	for _, e := range entries {
+		require.False(t, watcher.IsTempFile(e.Name()), "temporary file %s left behind", e.Name())
+	}
+}
+
+func TestAtomicFileCommit(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "file.txt")
+	require.NoError(t, os.WriteFile(target, []byte("old"), 0600))
+
+	f, err := createAtomic(target)
+	require.NoError(t, err)
+
+	_, err = f.Write([]byte("new content"))
+	require.NoError(t, err)
+
+	data, err := os.ReadFile(target)
+	require.NoError(t, err)
+	require.Equal(t, []byte("old"), data)
+
+	require.NoError(t, f.Commit(int64(len("new content")), digestOf([]byte("new content"))))
+
+	data, err = os.ReadFile(target)
+	require.NoError(t, err)
+	require.Equal(t, []byte("new content"), data)
+
+	info, err := os.Stat(target)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	requireNoTempFiles(t, dir)
+}
+
+func TestAtomicFileCommitSizeMismatch(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "file.txt")
+	require.NoError(t, os.WriteFile(target, []byte("old"), 0644))
+
+	f, err := createAtomic(target)
+	require.NoError(t, err)
+
+	_, err = f.Write([]byte("short"))
+	require.NoError(t, err)
+
+	require.ErrorIs(t, f.Commit(100, digestOf([]byte("short"))), ErrSizeMismatch)
+
+	data, err := os.ReadFile(target)
+	require.NoError(t, err)
+	require.Equal(t, []byte("old"), data)
+	requireNoTempFiles(t, dir)
+}
+
+func TestAtomicFileCommitHashMismatch(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "file.txt")
+
+	f, err := createAtomic(target)
+	require.NoError(t, err)
+
+	_, err = f.Write([]byte("tampered"))
+	require.NoError(t, err)
+
+	require.ErrorIs(t, f.Commit(int64(len("tampered")), digestOf([]byte("original"))), ErrHashMismatch)
+
+	_, err = os.Stat(target)
+	require.True(t, os.IsNotExist(err))
+	requireNoTempFiles(t, dir)
+}
+
+func TestDroppedConnectionKeepsOriginal(t *testing.T) {
+	conf, err := getConfig(overwrite)
+	require.NoError(t, err)
+	dir := t.TempDir()
+	conf.Watcher.Path = dir
+	s := newTestServer(t, conf)
+
+	target := filepath.Join(dir, "file.txt")
+	require.NoError(t, os.WriteFile(target, []byte("original"), 0644))
+
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.handleConnection(server, testPeerID)
+	}()
+
+	_, err = clientHello(client)
+	require.NoError(t, err)
+	err = writeMessage(client, MsgFileHeader, FileHeader{EventType: watcher.Modify, Path: "file.txt", Size: 1024})
+	require.NoError(t, err)
+	err = WriteFrame(client, MsgData, []byte("partial"))
+	require.NoError(t, err)
+	client.Close()
+	<-done
+
+	data, err := os.ReadFile(target)
+	require.NoError(t, err)
+	require.Equal(t, []byte("original"), data)
+	requireNoTempFiles(t, dir)
+}
@@ -1,30 +1,50 @@
 package transfer
 
 import (
-	"encoding/binary"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"github.com/hippo-an/sync-net/pkg/config"
 	"github.com/hippo-an/sync-net/pkg/discovery"
+	"github.com/hippo-an/sync-net/pkg/identity"
+	"github.com/hippo-an/sync-net/pkg/index"
+	"github.com/hippo-an/sync-net/pkg/trust"
 	"github.com/hippo-an/sync-net/pkg/watcher"
 	"io"
 	"log"
 	"net"
 	"os"
+	"path/filepath"
+	"strings"
 	"sync"
+	"time"
+)
+
+const (
+	// maxSendAttempts bounds how often a change is pushed to a peer whose
+	// connection dropped. Resumable transfers continue where they stopped.
+	maxSendAttempts = 3
+	retryDelay      = time.Second
 )
 
 type Client struct {
-	conf *config.Config
-	w    *watcher.Watcher
-	s    *discovery.Server
-	wg   sync.WaitGroup
+	conf  *config.Config
+	w     *watcher.Watcher
+	s     *discovery.Server
+	idx   *index.Index
+	id    *identity.Identity
+	peers *trust.Store
+	wg    sync.WaitGroup
 }
 
-func NewClient(conf *config.Config, w *watcher.Watcher, s *discovery.Server) *Client {
+func NewClient(conf *config.Config, w *watcher.Watcher, s *discovery.Server, idx *index.Index, id *identity.Identity, peers *trust.Store) *Client {
 	return &Client{
-		conf: conf,
-		w:    w,
-		s:    s,
+		conf:  conf,
+		w:     w,
+		s:     s,
+		idx:   idx,
+		id:    id,
+		peers: peers,
 	}
 }
 
@@ -37,6 +57,8 @@ func (c *Client) HandleEvents() {
 			c.handleEvent(event)
 		case event := <-c.w.DeleteEventChan:
 			c.handleEvent(event)
+		case event := <-c.w.RenameEventChan:
+			c.handleEvent(event)
 		case err := <-c.w.ErrorChan:
 			log.Printf("error from watcher: %s\n", err)
 		case <-c.w.StopChan:
@@ -45,10 +67,22 @@ func (c *Client) HandleEvents() {
 	}
 }
 
+// change is a header to push together with the file its content is read
+// from.
+type change struct {
+	header   *FileHeader
+	fullPath string
+}
+
 func (c *Client) handleEvent(event *watcher.Event) {
-	for _, serverInfo := range c.s.ServerInfos {
+	changes := c.changesFor(event)
+	if len(changes) == 0 {
+		return
+	}
+
+	for _, serverInfo := range c.s.Peers.List() {
 
-		if serverInfo.Self {
+		if serverInfo.Self || !serverInfo.Online || !serverInfo.Shares(c.conf.Watcher.FolderID) {
 			continue
 		}
 
@@ -56,84 +90,325 @@ func (c *Client) handleEvent(event *watcher.Event) {
 
 		go func(s *discovery.ServerInfo) {
 			defer c.wg.Done()
-			log.Println("handshake with server: ", s.Ip)
-			conn, err := net.Dial("tcp", net.JoinHostPort(s.Ip, s.Port))
-			if err != nil {
-				log.Printf("Failed to connect to server %+v: %s\n", s, err)
-				return
-			}
-			defer conn.Close()
+			c.push(s, changes)
+		}(serverInfo)
+	}
 
-			err = c.handshake(conn, fmt.Sprintf("%d:%s", event.EventType, event.FullPath))
+	c.wg.Wait()
+	log.Println("File successfully sent to all servers.")
+}
+
+// push sends changes to a peer over one connection. When the connection
+// drops it reconnects and continues with the change that failed; a change
+// the peer refused is skipped.
+func (c *Client) push(s *discovery.ServerInfo, changes []*change) {
+	for attempt := 1; len(changes) > 0; attempt++ {
+		conn, err := dialPeer(s, c.id, c.peers)
+		if err != nil {
+			log.Printf("Failed to connect to server %+v: %s\n", s, err)
+			return
+		}
+
+		for len(changes) > 0 {
+			err = c.send(conn, changes[0].header, changes[0].fullPath)
 			if err != nil {
-				log.Printf("Failed to handshake with server %+v: %s\n", s, err)
-				return
+				break
 			}
+			changes = changes[1:]
+		}
+		conn.Close()
+		if err == nil {
+			return
+		}
 
-			if event.EventType != watcher.Delete {
-				err := c.fileTransfer(conn, event.Name)
-				if err != nil {
-					log.Printf("Failed to send file %+v: %s\n", s, err)
-					return
-				}
-			}
-		}(serverInfo)
+		relPath := changes[0].header.Path
+		var remoteErr *RemoteError
+		if errors.As(err, &remoteErr) {
+			log.Printf("Failed to send %s to server %+v: %s\n", relPath, s, err)
+			changes = changes[1:]
+			attempt = 0
+			continue
+		}
+
+		if attempt == maxSendAttempts {
+			log.Printf("Failed to send %s to server %+v: %s\n", relPath, s, err)
+			return
+		}
+
+		log.Printf("Sending %s to server %+v failed, retrying: %s\n", relPath, s, err)
+		time.Sleep(time.Duration(attempt) * retryDelay)
 	}
+}
 
-	c.wg.Wait()
-	log.Println("File successfully sent to all servers.")
+// changesFor records what the event changed in the index and returns the
+// changes to push to peers.
+func (c *Client) changesFor(event *watcher.Event) []*change {
+	relPath, err := relativePath(c.w.BasePath, event.FullPath)
+	if err != nil {
+		log.Printf("Skipping event outside of %s: %s\n", c.w.BasePath, event.FullPath)
+		return nil
+	}
+
+	switch {
+	case event.EventType == watcher.Rename && event.FileType == watcher.Directory:
+		return c.dirRename(relPath, event)
+	case event.EventType == watcher.Rename:
+		return c.fileRename(relPath, event)
+	case event.EventType == watcher.Delete:
+		return c.deletion(relPath, event.FullPath)
+	default:
+		return c.update(relPath, event.FullPath, event.EventType)
+	}
 }
 
-func (c *Client) fileTransfer(conn net.Conn, fileName string) error {
-	file, err := os.Open(fileName)
+// update sends the current state of a file or directory.
+func (c *Client) update(relPath, fullPath string, eventType watcher.EventType) []*change {
+	fi, err := c.idx.Update(relPath)
 	if err != nil {
-		log.Printf("Failed to open file %s: %s\n", fileName, err)
-		return err
+		log.Printf("Failed to index %s: %s\n", fullPath, err)
+		return nil
 	}
-	defer file.Close()
 
-	buffer := make([]byte, c.conf.Transfer.BufferSize)
-	for {
-		n, err := file.Read(buffer)
-		if err != nil {
-			if err != io.EOF {
-				log.Printf("Error reading file %s: %s\n", fileName, err)
-				return err
-			}
+	if fi == nil || fi.Deleted {
+		log.Printf("Skipping %s, it no longer exists\n", fullPath)
+		return nil
+	}
 
-			return nil
-		}
+	return []*change{{header: headerOf(eventType, fi), fullPath: fullPath}}
+}
 
-		if n == 0 {
-			break
+// deletion sends the removal of a file, or of a directory together with
+// everything that was inside it.
+func (c *Client) deletion(relPath, fullPath string) []*change {
+	fi, err := c.idx.MarkDeleted(relPath)
+	if err != nil {
+		log.Printf("Failed to index %s: %s\n", fullPath, err)
+		return nil
+	}
+
+	header := headerOf(watcher.Delete, fi)
+	if fi.Dir {
+		header.Children = c.idx.Below(relPath)
+	}
+
+	return []*change{{header: header, fullPath: fullPath}}
+}
+
+// fileRename sends a rename if the file still has the content its old path
+// had. A file renamed from a path we do not know is sent as a create, one
+// that changed on top of being renamed as the removal of the old path and
+// the creation of the new one.
+func (c *Client) fileRename(relPath string, event *watcher.Event) []*change {
+	relOld, err := relativePath(c.w.BasePath, event.OldFullPath)
+	if err != nil {
+		return c.update(relPath, event.FullPath, watcher.Create)
+	}
+
+	from, ok := c.idx.Get(relOld)
+	if !ok || from.Deleted || from.Dir {
+		return c.update(relPath, event.FullPath, watcher.Create)
+	}
+
+	changes := c.update(relPath, event.FullPath, watcher.Rename)
+	if len(changes) == 0 {
+		return nil
+	}
+
+	header := changes[0].header
+	if from.Hash != header.Hash {
+		header.EventType = watcher.Create
+		return append(c.deletion(relOld, event.OldFullPath), changes...)
+	}
+
+	from, err = c.idx.MarkDeleted(relOld)
+	if err != nil {
+		log.Printf("Failed to index %s: %s\n", event.OldFullPath, err)
+		return nil
+	}
+
+	header.From = from.Path
+	header.FromVector = from.Vector
+	return changes
+}
+
+// dirRename sends a renamed directory as the creation of the new one, a
+// rename for every file inside it and the removal of the old one. Peers
+// that have the files move them without any data being sent.
+func (c *Client) dirRename(relPath string, event *watcher.Event) []*change {
+	relOld, err := relativePath(c.w.BasePath, event.OldFullPath)
+	if err != nil {
+		return c.update(relPath, event.FullPath, watcher.Create)
+	}
+
+	changes := c.update(relPath, event.FullPath, watcher.Create)
+	for _, f := range c.idx.Below(relOld) {
+		if f.Deleted {
+			continue
 		}
 
-		_, err = conn.Write(buffer[:n])
+		suffix := filepath.FromSlash(strings.TrimPrefix(f.Path, relOld+"/"))
+		newRel := relPath + strings.TrimPrefix(f.Path, relOld)
+		newPath := filepath.Join(event.FullPath, suffix)
 
-		if err != nil {
-			log.Printf("Failed to send file %s to server: %s\n", fileName, err)
-			return err
+		if f.Dir {
+			changes = append(changes, c.update(newRel, newPath, watcher.Create)...)
+			continue
 		}
+
+		changes = append(changes, c.fileRename(newRel, &watcher.Event{
+			EventType:   watcher.Rename,
+			FullPath:    newPath,
+			OldFullPath: filepath.Join(event.OldFullPath, suffix),
+		})...)
 	}
 
-	log.Printf("Successfully sent file %s to server.\n", fileName)
-	return nil
+	return append(changes, c.deletion(relOld, event.OldFullPath)...)
+}
+
+// headerOf describes a change of fi to peers.
+func headerOf(eventType watcher.EventType, fi *index.FileInfo) *FileHeader {
+	header := &FileHeader{
+		EventType:  eventType,
+		Path:       fi.Path,
+		Size:       fi.Size,
+		Hash:       fi.Hash,
+		Vector:     fi.Vector,
+		ModTime:    fi.ModTime,
+		ModifiedBy: fi.ModifiedBy,
+		Dir:        fi.Dir,
+	}
+
+	if fi.Dir {
+		header.Mode = fi.Mode
+		return header
+	}
+
+	// a delta transfer only sends what changed and is not resumed
+	header.Delta = eventType == watcher.Modify
+	header.Resume = eventType == watcher.Create || eventType == watcher.Rename
+	return header
+}
+
+// send pushes one change over conn and waits for it to be accepted.
+func (c *Client) send(conn io.ReadWriter, header *FileHeader, fullPath string) error {
+	err := writeMessage(conn, MsgFileHeader, header)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case header.EventType == watcher.Delete || header.Dir:
+	case header.Delta:
+		err = c.deltaTransfer(conn, fullPath, header.Size)
+	case header.Resume:
+		err = c.resumableTransfer(conn, fullPath, header.Size)
+	default:
+		err = c.fileTransfer(conn, fullPath, header.Size)
+	}
+	if err != nil {
+		return err
+	}
+
+	return readMessage(conn, MsgAck, nil)
+}
+
+// fileTransfer streams the first size bytes of fileName. The receiver checks
+// them against the size and digest announced in the file header.
+func (c *Client) fileTransfer(conn io.Writer, fileName string, size int64) error {
+	return streamFile(conn, fileName, 0, size, c.conf.Transfer.BufferSize)
+}
+
+// resumableTransfer sends fileName from the offset the receiver answers the
+// file header with.
+func (c *Client) resumableTransfer(conn io.ReadWriter, fileName string, size int64) error {
+	return streamResumable(conn, fileName, size, c.conf.Transfer.BufferSize)
+}
+
+// deltaTransfer sends the first size bytes of fileName as a delta against
+// the block signatures the receiver answers the file header with.
+func (c *Client) deltaTransfer(conn io.ReadWriter, fileName string, size int64) error {
+	return streamDelta(conn, fileName, size, c.conf.Transfer.BufferSize)
 }
 
-func (c *Client) handshake(conn net.Conn, message string) error {
-	size := int64(len(message))
-	sizeBytes := make([]byte, 8)
-	binary.BigEndian.PutUint64(sizeBytes, uint64(size))
+// dialPeer opens a TLS connection to a peer's transfer server and exchanges
+// hellos. Discovered peers are only talked to once they were paired, and only
+// if the device answering at their address is the one s describes.
+func dialPeer(s *discovery.ServerInfo, id *identity.Identity, peers *trust.Store) (net.Conn, error) {
+	log.Println("handshake with server: ", s.Ip)
+	conn, err := tls.Dial("tcp", net.JoinHostPort(s.Ip, s.Port), id.ClientConfig())
+	if err != nil {
+		return nil, err
+	}
+
+	peer, err := identity.PeerID(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if peer != s.Id {
+		conn.Close()
+		return nil, fmt.Errorf("%w: %s is %s, expected %s", ErrUnexpectedDevice, conn.RemoteAddr(), peer, s.Id)
+	}
+
+	if !peers.Trusted(peer) {
+		conn.Close()
+		return nil, fmt.Errorf("%w: %s", trust.ErrUntrusted, peer)
+	}
+	log.Printf("Connected to device %s at %s\n", peer, s.Ip)
+
+	_, err = clientHello(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// streamFile sends the bytes of fileName from offset up to size as data
+// frames followed by an end-of-file frame.
+func streamFile(conn io.Writer, fileName string, offset, size int64, bufferSize int) error {
+	file, err := os.Open(fileName)
+	if err != nil {
+		log.Printf("Failed to open file %s: %s\n", fileName, err)
+		return err
+	}
+	defer file.Close()
 
-	_, err := conn.Write(sizeBytes)
+	_, err = file.Seek(offset, io.SeekStart)
 	if err != nil {
+		log.Printf("Failed to seek in file %s: %s\n", fileName, err)
 		return err
 	}
 
-	_, err = conn.Write([]byte(message))
+	r := io.LimitReader(file, size-offset)
+	buffer := make([]byte, bufferSize)
+	for {
+		n, err := r.Read(buffer)
+		if n > 0 {
+			werr := WriteFrame(conn, MsgData, buffer[:n])
+			if werr != nil {
+				log.Printf("Failed to send file %s: %s\n", fileName, werr)
+				return werr
+			}
+		}
+
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("Error reading file %s: %s\n", fileName, err)
+				return err
+			}
+			break
+		}
+	}
+
+	err = WriteFrame(conn, MsgEndOfFile, nil)
 	if err != nil {
+		log.Printf("Failed to send end of file %s: %s\n", fileName, err)
 		return err
 	}
 
+	log.Printf("Successfully sent file %s.\n", fileName)
 	return nil
 }
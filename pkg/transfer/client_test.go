@@ -1,13 +1,14 @@
 package transfer
 
 import (
-	"encoding/binary"
+	"bytes"
+	"crypto/tls"
 	"fmt"
 	"github.com/hippo-an/sync-net/pkg/config"
 	"github.com/hippo-an/sync-net/pkg/discovery"
+	"github.com/hippo-an/sync-net/pkg/index"
 	"github.com/hippo-an/sync-net/pkg/watcher"
 	"github.com/stretchr/testify/require"
-	"io"
 	"net"
 	"os"
 	"path/filepath"
@@ -16,6 +17,15 @@ import (
 	"time"
 )
 
+// discoveryOf returns a discovery server that has seen the given peers.
+func discoveryOf(peers ...*discovery.ServerInfo) *discovery.Server {
+	s := &discovery.Server{Peers: discovery.NewPeerRegistry(time.Minute)}
+	for _, p := range peers {
+		s.Peers.Upsert(p)
+	}
+	return s
+}
+
 func TestNewClient(t *testing.T) {
 	w := &watcher.Watcher{}
 	s := &discovery.Server{}
@@ -24,30 +34,38 @@ func TestNewClient(t *testing.T) {
 		require.NoError(t, err)
 	}
 
-	client := NewClient(conf, w, s)
+	conf.Node.StateDir = t.TempDir()
+	id := newTestIdentity(t)
+	idx := openTestIndex(t, conf, id.DeviceID)
+
+	peers := newTestTrust(t, conf)
+	client := NewClient(conf, w, s, idx, id, peers)
 
 	require.Equal(t, client.w, w)
 	require.Equal(t, client.s, s)
+	require.Equal(t, client.idx, idx)
+	require.Equal(t, client.id, id)
+	require.Equal(t, client.peers, peers)
 }
 
 func TestHandleEvents(t *testing.T) {
 	w := &watcher.Watcher{
+		BasePath:        "/test",
 		CreateEventChan: make(chan *watcher.Event),
 		ModifyEventChan: make(chan *watcher.Event),
 		DeleteEventChan: make(chan *watcher.Event),
 		ErrorChan:       make(chan error),
 		StopChan:        make(chan struct{}),
 	}
-	s := &discovery.Server{
-		ServerInfos: map[string]*discovery.ServerInfo{
-			"127.0.0.1": {Ip: "127.0.0.1", Port: "0", Self: false},
-		},
-	}
+	s := discoveryOf(&discovery.ServerInfo{Id: "peer", Ip: "127.0.0.1", Port: "0"})
 	conf, err := config.NewConfig()
 	if err != nil {
 		require.NoError(t, err)
 	}
-	client := NewClient(conf, w, s)
+	conf.Node.StateDir = t.TempDir()
+	id := newTestIdentity(t)
+	idx := openTestIndex(t, conf, id.DeviceID)
+	client := NewClient(conf, w, s, idx, id, newTestTrust(t, conf))
 
 	go client.HandleEvents()
 
@@ -66,7 +84,16 @@ func TestHandleEvents(t *testing.T) {
 	close(w.StopChan)
 }
 
-func TestHandshake(t *testing.T) {
+func TestFileTransfer(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "file-transfer-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	testFile := filepath.Join(tempDir, "test.txt")
+	testContent := []byte("This is a test file content")
+	err = os.WriteFile(testFile, testContent, 0644)
+	require.NoError(t, err)
+
 	listener, err := net.Listen("tcp", "127.0.0.1:0")
 	require.NoError(t, err)
 	defer listener.Close()
@@ -79,65 +106,362 @@ func TestHandshake(t *testing.T) {
 		require.NoError(t, err)
 		defer conn.Close()
 
-		buffer := make([]byte, 8)
-		n, err := conn.Read(buffer)
+		var receivedContent bytes.Buffer
+		_, err = receiveData(conn, &receivedContent)
 		require.NoError(t, err)
 
-		size := binary.BigEndian.Uint64(buffer[:8])
-		buffer = make([]byte, size)
-		n, err = conn.Read(buffer)
-		require.Equal(t, string(buffer[:n]), "1:/test/file.txt")
+		require.Equal(t, testContent, receivedContent.Bytes())
 	}(&wg)
 
 	conn, err := net.Dial("tcp", listener.Addr().String())
 	require.NoError(t, err)
-	defer conn.Close()
+
 	conf, err := config.NewConfig()
 	require.NoError(t, err)
 
-	c := NewClient(conf, nil, nil)
-	err = c.handshake(conn, "1:/test/file.txt")
+	c := NewClient(conf, nil, nil, nil, nil, nil)
+	err = c.fileTransfer(conn, testFile, int64(len(testContent)))
 	require.NoError(t, err)
+	conn.Close()
 	wg.Wait()
 }
 
-func TestFileTransfer(t *testing.T) {
-	tempDir, err := os.MkdirTemp("", "file-transfer-test")
+func TestClientSendsToServer(t *testing.T) {
+	conf, err := getConfig(overwrite)
 	require.NoError(t, err)
-	defer os.RemoveAll(tempDir)
 
-	testFile := filepath.Join(tempDir, "test.txt")
-	testContent := []byte("This is a test file content")
-	err = os.WriteFile(testFile, testContent, 0644)
-	require.NoError(t, err)
+	sendRoot := t.TempDir()
+	receiveRoot := t.TempDir()
+	conf.Watcher.Path = receiveRoot
 
-	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	server := newTestServer(t, conf)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", server.id.ServerConfig())
 	require.NoError(t, err)
 	defer listener.Close()
 
-	wg := sync.WaitGroup{}
-	wg.Add(1)
-	go func(w *sync.WaitGroup) {
-		defer w.Done()
-		conn, err := listener.Accept()
-		require.NoError(t, err)
-		defer conn.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.accept(conn)
+		}
+	}()
 
-		receivedContent, err := io.ReadAll(conn)
-		require.NoError(t, err)
+	_, port, err := net.SplitHostPort(listener.Addr().String())
+	require.NoError(t, err)
 
-		require.Equal(t, receivedContent, testContent)
-	}(&wg)
+	w := &watcher.Watcher{BasePath: sendRoot}
+	s := discoveryOf(&discovery.ServerInfo{Id: server.id.DeviceID, Ip: "127.0.0.1", Port: port, Folders: server.folders()})
+	conf.Watcher.Path = sendRoot
+	conf.Node.StateDir = t.TempDir()
+	id := newTestIdentity(t)
+	idx := openTestIndex(t, conf, id.DeviceID)
+	peers := newTestTrust(t, conf)
+	require.NoError(t, peers.Add(server.id.DeviceID, ""))
+	require.NoError(t, server.peers.Add(id.DeviceID, ""))
+	client := NewClient(conf, w, s, idx, id, peers)
 
-	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, os.MkdirAll(filepath.Join(sendRoot, "dir"), 0755))
+	require.NoError(t, os.MkdirAll(filepath.Join(receiveRoot, "dir"), 0755))
+	fullPath := filepath.Join(sendRoot, "dir", "file.txt")
+	content := []byte("relative paths only")
+	require.NoError(t, os.WriteFile(fullPath, content, 0644))
+
+	client.handleEvent(&watcher.Event{
+		EventType: watcher.Create,
+		FullPath:  fullPath,
+		Name:      "file.txt",
+		Size:      int64(len(content)),
+	})
+
+	data, err := os.ReadFile(filepath.Join(receiveRoot, "dir", "file.txt"))
 	require.NoError(t, err)
+	require.Equal(t, content, data)
+}
 
-	conf, err := config.NewConfig()
+// newPushingClient returns a client of local that pushes to remote.
+func newPushingClient(t *testing.T, local, remote *testNode) *Client {
+	t.Helper()
+
+	peer := remote.serve(t)
+	w := &watcher.Watcher{BasePath: local.root}
+	return NewClient(local.conf, w, discoveryOf(peer), local.idx, local.ts.id, local.ts.peers)
+}
+
+func TestClientSendsRenames(t *testing.T) {
+	local := newTestNode(t)
+	remote := newTestNode(t)
+	local.pair(t, remote)
+
+	local.write(t, "a.txt", "renamed without sending data")
+	require.NoError(t, NewSyncer(remote.conf, nil, remote.ts).SyncWith(local.serve(t)))
+	before, err := os.Stat(filepath.Join(remote.root, "a.txt"))
 	require.NoError(t, err)
 
-	c := NewClient(conf, nil, nil)
-	err = c.fileTransfer(conn, testFile)
+	client := newPushingClient(t, local, remote)
+
+	rename := func(from, to string) {
+		t.Helper()
+
+		oldPath := filepath.Join(local.root, from)
+		newPath := filepath.Join(local.root, filepath.FromSlash(to))
+		require.NoError(t, os.MkdirAll(filepath.Dir(newPath), 0755))
+		require.NoError(t, os.Rename(oldPath, newPath))
+		client.handleEvent(&watcher.Event{
+			EventType:   watcher.Rename,
+			FullPath:    newPath,
+			OldFullPath: oldPath,
+			Name:        filepath.Base(newPath),
+		})
+	}
+
+	rename("a.txt", "dir/b.txt")
+
+	require.Equal(t, "renamed without sending data", remote.read(t, "dir/b.txt"))
+	after, err := os.Stat(filepath.Join(remote.root, "dir", "b.txt"))
 	require.NoError(t, err)
-	conn.Close()
-	wg.Wait()
+	require.True(t, os.SameFile(before, after), "the remote should have moved its copy")
+	_, err = os.Stat(filepath.Join(remote.root, "a.txt"))
+	require.True(t, os.IsNotExist(err))
+
+	for _, name := range []string{"a.txt", "dir/b.txt"} {
+		l, _ := local.idx.Get(name)
+		r, ok := remote.idx.Get(name)
+		require.True(t, ok, name)
+		require.Equal(t, l.Deleted, r.Deleted, name)
+		require.Equal(t, index.Equal, l.Vector.Compare(r.Vector), name)
+	}
+
+	// the remote does not have the old path, so the content is sent
+	local.write(t, "c.txt", "only here")
+	rename("c.txt", "d.txt")
+	require.Equal(t, "only here", remote.read(t, "d.txt"))
+	_, ok := remote.idx.Get("c.txt")
+	require.False(t, ok)
+}
+
+func TestClientSendsRecursiveDeletes(t *testing.T) {
+	local := newTestNode(t)
+	remote := newTestNode(t)
+	local.pair(t, remote)
+
+	local.mkdir(t, "dir", 0755)
+	local.mkdir(t, "dir/sub", 0755)
+	local.write(t, "dir/a.txt", "a")
+	local.write(t, "dir/b.txt", "b")
+	local.write(t, "dir/sub/c.txt", "c")
+	require.NoError(t, NewSyncer(remote.conf, nil, remote.ts).SyncWith(local.serve(t)))
+
+	// changed and added on the remote since
+	remote.write(t, "dir/b.txt", "changed on the remote")
+	remote.write(t, "dir/new.txt", "only on the remote")
+
+	client := newPushingClient(t, local, remote)
+	require.NoError(t, os.RemoveAll(filepath.Join(local.root, "dir")))
+	client.handleEvent(&watcher.Event{
+		EventType: watcher.Delete,
+		FileType:  watcher.Deleted,
+		FullPath:  filepath.Join(local.root, "dir"),
+		Name:      "dir",
+	})
+
+	for _, name := range []string{"dir/a.txt", "dir/sub/c.txt", "dir/sub"} {
+		_, err := os.Stat(filepath.Join(remote.root, filepath.FromSlash(name)))
+		require.True(t, os.IsNotExist(err), name)
+		f, _ := remote.idx.Get(name)
+		require.True(t, f.Deleted, name)
+	}
+
+	require.Equal(t, "changed on the remote", remote.read(t, "dir/b.txt"))
+	require.Equal(t, "only on the remote", remote.read(t, "dir/new.txt"))
+	d, ok := remote.idx.Get("dir")
+	require.True(t, ok)
+	require.False(t, d.Deleted)
+	l, _ := local.idx.Get("dir")
+	require.Equal(t, index.After, d.Vector.Compare(l.Vector))
+}
+
+func TestClientSendsDirectoryRenames(t *testing.T) {
+	local := newTestNode(t)
+	remote := newTestNode(t)
+	local.pair(t, remote)
+
+	local.mkdir(t, "dir", 0755)
+	local.mkdir(t, "dir/sub", 0700)
+	local.write(t, "dir/sub/a.txt", "moved without sending data")
+	require.NoError(t, NewSyncer(remote.conf, nil, remote.ts).SyncWith(local.serve(t)))
+	before, err := os.Stat(filepath.Join(remote.root, "dir", "sub", "a.txt"))
+	require.NoError(t, err)
+
+	client := newPushingClient(t, local, remote)
+	oldPath := filepath.Join(local.root, "dir")
+	newPath := filepath.Join(local.root, "moved")
+	require.NoError(t, os.Rename(oldPath, newPath))
+	client.handleEvent(&watcher.Event{
+		EventType:   watcher.Rename,
+		FileType:    watcher.Directory,
+		FullPath:    newPath,
+		OldFullPath: oldPath,
+		Name:        "moved",
+	})
+
+	after, err := os.Stat(filepath.Join(remote.root, "moved", "sub", "a.txt"))
+	require.NoError(t, err)
+	require.True(t, os.SameFile(before, after), "the remote should have moved its copy")
+	info, err := os.Stat(filepath.Join(remote.root, "moved", "sub"))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0700), info.Mode().Perm())
+	_, err = os.Stat(filepath.Join(remote.root, "dir"))
+	require.True(t, os.IsNotExist(err))
+
+	for _, f := range local.idx.List() {
+		r, ok := remote.idx.Get(f.Path)
+		require.True(t, ok, f.Path)
+		require.Equal(t, f.Deleted, r.Deleted, f.Path)
+		require.Equal(t, index.Equal, f.Vector.Compare(r.Vector), f.Path)
+	}
+}
+
+func TestAppliedChangesAreNotSentBack(t *testing.T) {
+	testAppliedChangesAreNotSentBack(t, newTestNode(t))
+}
+
+func TestAppliedChangesUnderASymlinkedRootAreNotSentBack(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "real"), 0755))
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "real", "root"), 0755))
+	require.NoError(t, os.Symlink("real", filepath.Join(dir, "link")))
+
+	testAppliedChangesAreNotSentBack(t, newTestNodeAt(t, filepath.Join(dir, "link", "root")))
+}
+
+func testAppliedChangesAreNotSentBack(t *testing.T, local *testNode) {
+	remote := newTestNode(t)
+	local.pair(t, remote)
+
+	local.conf.Watcher.QuietPeriod = 50 * time.Millisecond
+	w, err := watcher.NewWatcher(local.conf, nil)
+	require.NoError(t, err)
+	defer w.TearDown()
+	local.ts.inbound = w.Inbound
+
+	go watcher.StartWatch(w)
+
+	requireNoEcho := func() {
+		t.Helper()
+
+		select {
+		case e := <-w.CreateEventChan:
+			t.Fatalf("create of %s sent back", e.FullPath)
+		case e := <-w.ModifyEventChan:
+			t.Fatalf("modify of %s sent back", e.FullPath)
+		case e := <-w.DeleteEventChan:
+			t.Fatalf("delete of %s sent back", e.FullPath)
+		case e := <-w.RenameEventChan:
+			t.Fatalf("rename of %s sent back", e.FullPath)
+		case <-time.After(4 * local.conf.Watcher.QuietPeriod):
+		}
+	}
+
+	client := newPushingClient(t, remote, local)
+	push := func(eventType watcher.EventType, fileType watcher.FileType, name, oldName string) {
+		t.Helper()
+
+		e := &watcher.Event{
+			EventType: eventType,
+			FileType:  fileType,
+			FullPath:  filepath.Join(remote.root, filepath.FromSlash(name)),
+		}
+		if oldName != "" {
+			e.OldFullPath = filepath.Join(remote.root, filepath.FromSlash(oldName))
+		}
+		client.handleEvent(e)
+	}
+
+	remote.mkdir(t, "dir", 0755)
+	push(watcher.Create, watcher.Directory, "dir", "")
+	remote.write(t, "dir/a.txt", "a")
+	push(watcher.Create, watcher.File, "dir/a.txt", "")
+	require.Equal(t, "a", local.read(t, "dir/a.txt"))
+	requireNoEcho()
+
+	require.NoError(t, os.WriteFile(filepath.Join(remote.root, "dir", "a.txt"), []byte("changed"), 0644))
+	push(watcher.Modify, watcher.File, "dir/a.txt", "")
+	require.Equal(t, "changed", local.read(t, "dir/a.txt"))
+	requireNoEcho()
+
+	require.NoError(t, os.Rename(filepath.Join(remote.root, "dir", "a.txt"), filepath.Join(remote.root, "b.txt")))
+	push(watcher.Rename, watcher.File, "b.txt", "dir/a.txt")
+	require.Equal(t, "changed", local.read(t, "b.txt"))
+	requireNoEcho()
+
+	require.NoError(t, os.Remove(filepath.Join(remote.root, "b.txt")))
+	push(watcher.Delete, watcher.Deleted, "b.txt", "")
+	requireNoEcho()
+
+	// local changes are still reported
+	require.NoError(t, os.WriteFile(filepath.Join(local.root, "dir", "c.txt"), []byte("c"), 0644))
+	select {
+	case e := <-w.CreateEventChan:
+		require.Equal(t, filepath.Join(local.root, "dir", "c.txt"), e.FullPath)
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for event")
+	}
+}
+
+func TestClientOnlySendsToTheAnnouncedDevice(t *testing.T) {
+	local := newTestNode(t)
+	remote := newTestNode(t)
+	other := newTestNode(t)
+	local.pair(t, remote)
+	local.pair(t, other)
+
+	// the address remote was announced at is now answered by another
+	// trusted device
+	peer := other.serve(t)
+	peer.Id = remote.ts.id.DeviceID
+	_, err := dialPeer(peer, local.ts.id, local.ts.peers)
+	require.ErrorIs(t, err, ErrUnexpectedDevice)
+
+	local.write(t, "a.txt", "meant for remote")
+	w := &watcher.Watcher{BasePath: local.root}
+	client := NewClient(local.conf, w, discoveryOf(peer), local.idx, local.ts.id, local.ts.peers)
+	client.handleEvent(&watcher.Event{
+		EventType: watcher.Create,
+		FileType:  watcher.File,
+		FullPath:  filepath.Join(local.root, "a.txt"),
+	})
+
+	_, err = os.Stat(filepath.Join(other.root, "a.txt"))
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestClientOnlySendsToPeersSharingTheFolder(t *testing.T) {
+	local := newTestNode(t)
+	remote := newTestNode(t)
+	local.pair(t, remote)
+
+	peer := remote.serve(t)
+	peer.Folders = []string{"other"}
+
+	local.write(t, "a.txt", "meant for the folder")
+	w := &watcher.Watcher{BasePath: local.root}
+	client := NewClient(local.conf, w, discoveryOf(peer), local.idx, local.ts.id, local.ts.peers)
+	client.handleEvent(&watcher.Event{
+		EventType: watcher.Create,
+		FileType:  watcher.File,
+		FullPath:  filepath.Join(local.root, "a.txt"),
+	})
+
+	_, err := os.Stat(filepath.Join(remote.root, "a.txt"))
+	require.True(t, os.IsNotExist(err))
+
+	syncer := NewSyncer(remote.conf, nil, remote.ts)
+	other := local.serve(t)
+	other.Folders = []string{"other"}
+	require.ErrorIs(t, syncer.SyncWith(other), ErrFolderNotShared)
+	_, err = os.Stat(filepath.Join(remote.root, "a.txt"))
+	require.True(t, os.IsNotExist(err))
 }
@@ -0,0 +1,212 @@
+package transfer
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/hippo-an/sync-net/pkg/watcher"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	conflictTimeFormat = "20060102-150405"
+	conflictLogName    = "conflicts.log"
+	shortIdLength      = 7
+)
+
+// ConflictEntry is one line of the conflict log in the state directory.
+type ConflictEntry struct {
+	Time   time.Time `json:"time"`
+	Path   string    `json:"path"`
+	Copy   string    `json:"copy"`
+	Device string    `json:"device"`
+}
+
+// conflictCopyName builds "name.sync-conflict-<timestamp>-<device>.ext" for
+// filePath.
+func conflictCopyName(filePath string, at time.Time, device string) string {
+	dir, name := filepath.Split(filePath)
+	ext := filepath.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+
+	return filepath.Join(dir, fmt.Sprintf("%s%s%s-%s%s", stem, watcher.ConflictMarker, at.Format(conflictTimeFormat), shortId(device), ext))
+}
+
+func shortId(device string) string {
+	if len(device) > shortIdLength {
+		return device[:shortIdLength]
+	}
+	return device
+}
+
+// conflictCopies lists the existing conflict copies of filePath, oldest
+// first. Only names conflictCopyName produces for filePath match, not the
+// copies of other files with the same stem.
+func conflictCopies(filePath string) ([]string, error) {
+	dir, name := filepath.Split(filePath)
+	ext := filepath.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	copyName := regexp.MustCompile(`^` + regexp.QuoteMeta(stem+watcher.ConflictMarker) + `\d{8}-\d{6}-[^.]+` + regexp.QuoteMeta(ext) + `$`)
+
+	entries, err := os.ReadDir(filepath.Clean(dir))
+	if err != nil {
+		return nil, err
+	}
+
+	var copies []string
+	for _, e := range entries {
+		n := e.Name()
+		if e.Type().IsRegular() && copyName.MatchString(n) {
+			copies = append(copies, filepath.Join(dir, n))
+		}
+	}
+
+	sort.Strings(copies)
+	return copies, nil
+}
+
+// keepConflictCopy preserves the local content of filePath under a conflict
+// copy name, records it in the conflict log and prunes older copies. With
+// move set the file at relPath is renamed instead of copied.
+func (s *Server) keepConflictCopy(filePath, relPath string, move bool) (string, error) {
+	now := time.Now()
+	copyPath := conflictCopyName(filePath, now, s.idx.DeviceID())
+	// several conflicts within one second get the following timestamps, so
+	// sorting by name still sorts by age
+	for n := 1; ; n++ {
+		if _, err := os.Lstat(copyPath); os.IsNotExist(err) {
+			break
+		}
+		copyPath = conflictCopyName(filePath, now.Add(time.Duration(n)*time.Second), s.idx.DeviceID())
+	}
+
+	log.Println("Keeping conflicting local copy as:", copyPath)
+
+	var err error
+	if move {
+		s.inbound.Expect(relPath)
+		err = os.Rename(filePath, copyPath)
+		s.inbound.Done(relPath)
+	} else {
+		err = copyFile(filePath, copyPath)
+	}
+	if err != nil {
+		log.Println("Error creating conflict copy:", err)
+		return "", err
+	}
+
+	err = s.logConflict(ConflictEntry{
+		Time:   now,
+		Path:   filePath,
+		Copy:   copyPath,
+		Device: s.idx.DeviceID(),
+	})
+	if err != nil {
+		log.Println("Error writing conflict log:", err)
+	}
+
+	err = s.pruneConflictCopies(filePath)
+	if err != nil {
+		log.Println("Error pruning conflict copies:", err)
+	}
+
+	return copyPath, nil
+}
+
+func (s *Server) pruneConflictCopies(filePath string) error {
+	max := s.conf.Transfer.Consistency.MaxConflictCopies
+	if max <= 0 {
+		return nil
+	}
+
+	copies, err := conflictCopies(filePath)
+	if err != nil {
+		return err
+	}
+
+	for len(copies) > max {
+		log.Println("Removing old conflict copy:", copies[0])
+		err = os.Remove(copies[0])
+		if err != nil {
+			return err
+		}
+		copies = copies[1:]
+	}
+
+	return nil
+}
+
+func (s *Server) logConflict(entry ConflictEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(filepath.Join(s.conf.Node.StateDir, conflictLogName), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(append(data, '\n'))
+	return err
+}
+
+// ReadConflictLog returns the recorded conflicts of the node using stateDir.
+func ReadConflictLog(stateDir string) ([]ConflictEntry, error) {
+	data, err := os.ReadFile(filepath.Join(stateDir, conflictLogName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var entries []ConflictEntry
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		if line == "" {
+			continue
+		}
+
+		var e ConflictEntry
+		err := json.Unmarshal([]byte(line), &e)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+
+	return entries, nil
+}
+
+func copyFile(src, dst string) error {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+
+	info, err := srcFile.Stat()
+	if err != nil {
+		return err
+	}
+
+	destFile, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	defer destFile.Close()
+
+	_, err = io.Copy(destFile, srcFile)
+	if err != nil {
+		return err
+	}
+
+	return destFile.Sync()
+}
@@ -0,0 +1,83 @@
+package transfer
+
+import (
+	"github.com/hippo-an/sync-net/pkg/watcher"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestConflictCopyName(t *testing.T) {
+	at := time.Date(2024, 8, 30, 13, 4, 5, 0, time.UTC)
+
+	name := conflictCopyName("/sync/dir/report.final.txt", at, "0123456789abcdef")
+	require.Equal(t, "/sync/dir/report.final.sync-conflict-20240830-130405-0123456.txt", name)
+	require.True(t, watcher.IsConflictCopy(name))
+
+	name = conflictCopyName("/sync/Makefile", at, "dev")
+	require.Equal(t, "/sync/Makefile.sync-conflict-20240830-130405-dev", name)
+	require.False(t, watcher.IsConflictCopy("/sync/Makefile"))
+}
+
+func TestKeepConflictCopyPrunesAndLogs(t *testing.T) {
+	conf, err := getConfig(backupAndCreate)
+	require.NoError(t, err)
+	dir := t.TempDir()
+	conf.Watcher.Path = dir
+	conf.Transfer.Consistency.MaxConflictCopies = 2
+	s := newTestServer(t, conf)
+
+	filePath := filepath.Join(dir, "file.txt")
+	for _, content := range []string{"first", "second", "third"} {
+		require.NoError(t, os.WriteFile(filePath, []byte(content), 0644))
+		_, err := s.keepConflictCopy(filePath, "file.txt", false)
+		require.NoError(t, err)
+	}
+
+	copies, err := conflictCopies(filePath)
+	require.NoError(t, err)
+	require.Len(t, copies, 2)
+
+	data, err := os.ReadFile(copies[0])
+	require.NoError(t, err)
+	require.Equal(t, "second", string(data))
+	data, err = os.ReadFile(copies[1])
+	require.NoError(t, err)
+	require.Equal(t, "third", string(data))
+
+	entries, err := ReadConflictLog(conf.Node.StateDir)
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+	require.Equal(t, filePath, entries[2].Path)
+	require.Equal(t, copies[1], entries[2].Copy)
+	require.Equal(t, s.idx.DeviceID(), entries[2].Device)
+
+	// a second conflict does not destroy the first copy
+	_, err = os.Stat(entries[1].Copy)
+	require.NoError(t, err)
+}
+
+func TestConflictCopiesOfFilesWithTheSameStem(t *testing.T) {
+	dir := t.TempDir()
+	at := time.Date(2024, 8, 30, 13, 4, 5, 0, time.UTC)
+
+	plain := filepath.Join(dir, "a")
+	text := filepath.Join(dir, "a.txt")
+	for _, p := range []string{
+		conflictCopyName(plain, at, "dev"),
+		conflictCopyName(text, at, "dev"),
+		conflictCopyName(filepath.Join(dir, "a.tar.txt"), at, "dev"),
+	} {
+		require.NoError(t, os.WriteFile(p, []byte("copy"), 0644))
+	}
+
+	copies, err := conflictCopies(plain)
+	require.NoError(t, err)
+	require.Equal(t, []string{conflictCopyName(plain, at, "dev")}, copies)
+
+	copies, err = conflictCopies(text)
+	require.NoError(t, err)
+	require.Equal(t, []string{conflictCopyName(text, at, "dev")}, copies)
+}
@@ -0,0 +1,449 @@
+package transfer
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+)
+
+// Delta transfers work like rsync. The receiver splits its current copy of
+// a file into blocks and sends a weak rolling checksum and a strong hash of
+// every block. The sender slides a window over the new content, looks the
+// window up by its rolling checksum and answers with copy instructions for
+// blocks the receiver already has and literal data for everything else.
+
+const (
+	minBlockSize = 2 << 10
+	maxBlockSize = 1 << 20
+
+	// strongSumSize is the number of SHA-256 bytes used to confirm a weak
+	// match. The whole file is verified with the full digest anyway.
+	strongSumSize = 16
+)
+
+var ErrInvalidDelta = errors.New("invalid delta")
+
+type BlockSignature struct {
+	Weak   uint32 `json:"weak"`
+	Strong string `json:"strong"`
+}
+
+// Signatures describe the receiver's copy of a file. The last block may be
+// shorter than BlockSize.
+type Signatures struct {
+	BlockSize int              `json:"blockSize"`
+	Size      int64            `json:"size"`
+	Blocks    []BlockSignature `json:"blocks,omitempty"`
+}
+
+// CopyBlocks tells the receiver to copy Count blocks starting at Index from
+// its current copy.
+type CopyBlocks struct {
+	Index int64 `json:"index"`
+	Count int64 `json:"count"`
+}
+
+// blockSizeFor picks a block size of roughly the square root of size, which
+// balances the size of the signatures against the granularity of matches.
+func blockSizeFor(size int64) int {
+	bs := int(math.Sqrt(float64(size)))
+	bs = (bs + 1023) &^ 1023
+
+	if bs < minBlockSize {
+		return minBlockSize
+	}
+	if bs > maxBlockSize {
+		return maxBlockSize
+	}
+	return bs
+}
+
+// rollingSum is the rsync weak checksum. It can be moved forward by one
+// byte in constant time.
+type rollingSum struct {
+	a, b uint32
+	n    uint32
+}
+
+func newRollingSum(p []byte) rollingSum {
+	r := rollingSum{n: uint32(len(p))}
+	for i, c := range p {
+		r.a += uint32(c)
+		r.b += uint32(len(p)-i) * uint32(c)
+	}
+	return r
+}
+
+func (r *rollingSum) roll(out, in byte) {
+	r.a = r.a - uint32(out) + uint32(in)
+	r.b = r.b - r.n*uint32(out) + r.a
+}
+
+func (r rollingSum) sum() uint32 {
+	return r.a&0xffff | r.b<<16
+}
+
+func strongSum(p []byte) string {
+	sum := sha256.Sum256(p)
+	return hex.EncodeToString(sum[:strongSumSize])
+}
+
+// signBlocks computes the signatures of the size bytes readable from r.
+func signBlocks(r io.Reader, size int64) (*Signatures, error) {
+	sig := &Signatures{
+		BlockSize: blockSizeFor(size),
+	}
+
+	buf := make([]byte, sig.BlockSize)
+	r = io.LimitReader(r, size)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			// counted as read, the file may have shrunk in the meantime
+			sig.Size += int64(n)
+			sig.Blocks = append(sig.Blocks, BlockSignature{
+				Weak:   newRollingSum(buf[:n]).sum(),
+				Strong: strongSum(buf[:n]),
+			})
+		}
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return sig, nil
+}
+
+// blockLen returns the length of block i.
+func (s *Signatures) blockLen(i int64) int64 {
+	return min(int64(s.BlockSize), s.Size-i*int64(s.BlockSize))
+}
+
+// blockIndex looks up the receiver's blocks by weak checksum.
+type blockIndex struct {
+	sig        *Signatures
+	fullBlocks int64
+	lookup     map[uint32][]int64
+}
+
+func newBlockIndex(sig *Signatures) *blockIndex {
+	b := &blockIndex{
+		sig:        sig,
+		fullBlocks: sig.Size / int64(sig.BlockSize),
+		lookup:     make(map[uint32][]int64, len(sig.Blocks)),
+	}
+	for i, block := range sig.Blocks {
+		b.lookup[block.Weak] = append(b.lookup[block.Weak], int64(i))
+	}
+	return b
+}
+
+// find returns the block with the content of window. Full windows only match
+// full blocks, the tail of the content only matches a short last block.
+func (b *blockIndex) find(weak uint32, window []byte, full bool) (int64, bool) {
+	candidates, ok := b.lookup[weak]
+	if !ok {
+		return 0, false
+	}
+
+	strong := ""
+	for _, i := range candidates {
+		if (i < b.fullBlocks) != full || b.sig.blockLen(i) != int64(len(window)) {
+			continue
+		}
+		if strong == "" {
+			strong = strongSum(window)
+		}
+		if b.sig.Blocks[i].Strong == strong {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// deltaWriter emits literal data and copy instructions in order, merging
+// runs of consecutive blocks into a single instruction.
+type deltaWriter struct {
+	w          io.Writer
+	bufferSize int
+	literal    []byte
+	pending    *CopyBlocks
+}
+
+func (d *deltaWriter) writeLiteral(c byte) error {
+	err := d.flushCopy()
+	if err != nil {
+		return err
+	}
+
+	d.literal = append(d.literal, c)
+	if len(d.literal) >= d.bufferSize {
+		return d.flushLiteral()
+	}
+	return nil
+}
+
+func (d *deltaWriter) writeCopy(index int64) error {
+	err := d.flushLiteral()
+	if err != nil {
+		return err
+	}
+
+	if d.pending != nil && d.pending.Index+d.pending.Count == index {
+		d.pending.Count++
+		return nil
+	}
+
+	err = d.flushCopy()
+	if err != nil {
+		return err
+	}
+
+	d.pending = &CopyBlocks{Index: index, Count: 1}
+	return nil
+}
+
+func (d *deltaWriter) writeTail(tail []byte, blocks *blockIndex) error {
+	if len(tail) == 0 {
+		return nil
+	}
+
+	if i, ok := blocks.find(newRollingSum(tail).sum(), tail, false); ok {
+		return d.writeCopy(i)
+	}
+
+	for _, c := range tail {
+		err := d.writeLiteral(c)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *deltaWriter) flushLiteral() error {
+	if len(d.literal) == 0 {
+		return nil
+	}
+
+	err := WriteFrame(d.w, MsgData, d.literal)
+	d.literal = d.literal[:0]
+	return err
+}
+
+func (d *deltaWriter) flushCopy() error {
+	if d.pending == nil {
+		return nil
+	}
+
+	err := writeMessage(d.w, MsgCopy, d.pending)
+	d.pending = nil
+	return err
+}
+
+func (d *deltaWriter) flush() error {
+	err := d.flushLiteral()
+	if err != nil {
+		return err
+	}
+	return d.flushCopy()
+}
+
+// writeDelta encodes the content of r against sig as copy and data frames.
+// The end-of-file frame is left to the caller.
+func writeDelta(w io.Writer, r io.Reader, sig *Signatures, bufferSize int) error {
+	bs := sig.BlockSize
+	if bs <= 0 || bs > maxBlockSize {
+		return fmt.Errorf("%w: block size %d", ErrInvalidDelta, bs)
+	}
+
+	blocks := newBlockIndex(sig)
+	d := &deltaWriter{w: w, bufferSize: bufferSize}
+	br := bufio.NewReaderSize(r, 4*bs)
+
+	var sum rollingSum
+	rolled := false
+	for {
+		window, err := br.Peek(bs)
+		if len(window) < bs {
+			if err != io.EOF {
+				return err
+			}
+
+			// the tail can only match the receiver's last, short block
+			err = d.writeTail(window, blocks)
+			if err != nil {
+				return err
+			}
+			break
+		}
+
+		if !rolled {
+			sum = newRollingSum(window)
+			rolled = true
+		}
+
+		if i, ok := blocks.find(sum.sum(), window, true); ok {
+			err = d.writeCopy(i)
+			if err != nil {
+				return err
+			}
+			_, err = br.Discard(bs)
+			if err != nil {
+				return err
+			}
+			rolled = false
+			continue
+		}
+
+		out := window[0]
+		_, err = br.ReadByte()
+		if err != nil {
+			return err
+		}
+		err = d.writeLiteral(out)
+		if err != nil {
+			return err
+		}
+
+		next, _ := br.Peek(bs)
+		if len(next) == bs {
+			sum.roll(out, next[bs-1])
+		} else {
+			rolled = false
+		}
+	}
+
+	return d.flush()
+}
+
+// applyDelta rebuilds the sender's content from copy and data frames read
+// from r, taking copied blocks from basis, until the end-of-file frame.
+func applyDelta(r io.Reader, basis io.ReaderAt, sig *Signatures, w io.Writer) (int64, error) {
+	var written int64
+	for {
+		f, err := ReadFrame(r)
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return written, err
+		}
+
+		switch f.Type {
+		case MsgData:
+			n, err := w.Write(f.Payload)
+			written += int64(n)
+			if err != nil {
+				return written, err
+			}
+		case MsgCopy:
+			var c CopyBlocks
+			err := json.Unmarshal(f.Payload, &c)
+			if err != nil {
+				return written, err
+			}
+
+			if basis == nil || c.Index < 0 || c.Count <= 0 || c.Index+c.Count > int64(len(sig.Blocks)) {
+				return written, fmt.Errorf("%w: blocks %d+%d of %d", ErrInvalidDelta, c.Index, c.Count, len(sig.Blocks))
+			}
+
+			offset := c.Index * int64(sig.BlockSize)
+			length := min(c.Count*int64(sig.BlockSize), sig.Size-offset)
+			n, err := io.Copy(w, io.NewSectionReader(basis, offset, length))
+			written += n
+			if err != nil {
+				return written, err
+			}
+		case MsgEndOfFile:
+			return written, nil
+		default:
+			return written, decodeFrame(f, MsgData, nil)
+		}
+	}
+}
+
+// receiveContent reads the content announced by header into w. For a delta
+// transfer the signatures of basis, the local copy of the file, are sent
+// first. A missing basis is signed as an empty file.
+func receiveContent(conn io.ReadWriter, header *FileHeader, basis string, w io.Writer) error {
+	if !header.Delta {
+		_, err := receiveData(conn, w)
+		return err
+	}
+
+	var file *os.File
+	var size int64
+	f, err := os.Open(basis)
+	if err == nil {
+		defer f.Close()
+
+		info, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			file, size = f, info.Size()
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	var r io.Reader = strings.NewReader("")
+	if file != nil {
+		r = io.NewSectionReader(file, 0, size)
+	}
+
+	sig, err := signBlocks(r, size)
+	if err != nil {
+		return err
+	}
+
+	err = writeMessage(conn, MsgSignatures, sig)
+	if err != nil {
+		return err
+	}
+
+	var at io.ReaderAt
+	if file != nil {
+		at = file
+	}
+
+	_, err = applyDelta(conn, at, sig, w)
+	return err
+}
+
+// streamDelta waits for the receiver's signatures and sends the first size
+// bytes of fileName as a delta against them, followed by an end-of-file
+// frame.
+func streamDelta(conn io.ReadWriter, fileName string, size int64, bufferSize int) error {
+	var sig Signatures
+	err := readMessage(conn, MsgSignatures, &sig)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	err = writeDelta(conn, io.LimitReader(file, size), &sig, bufferSize)
+	if err != nil {
+		return err
+	}
+
+	return WriteFrame(conn, MsgEndOfFile, nil)
+}
@@ -0,0 +1,154 @@
+package transfer
+
+import (
+	"bytes"
+	"github.com/hippo-an/sync-net/pkg/watcher"
+	"github.com/stretchr/testify/require"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func randomBytes(seed int64, n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+// roundTrip encodes content against basis and decodes it again. It returns
+// the rebuilt content and the number of literal bytes that were sent.
+func roundTrip(t *testing.T, basis, content []byte) ([]byte, int) {
+	t.Helper()
+
+	sig, err := signBlocks(bytes.NewReader(basis), int64(len(basis)))
+	require.NoError(t, err)
+
+	var wire bytes.Buffer
+	require.NoError(t, writeDelta(&wire, bytes.NewReader(content), sig, 32<<10))
+	require.NoError(t, WriteFrame(&wire, MsgEndOfFile, nil))
+
+	literal := 0
+	frames := bytes.NewReader(wire.Bytes())
+	for {
+		f, err := ReadFrame(frames)
+		require.NoError(t, err)
+		if f.Type == MsgEndOfFile {
+			break
+		}
+		if f.Type == MsgData {
+			literal += len(f.Payload)
+		}
+	}
+
+	var out bytes.Buffer
+	n, err := applyDelta(&wire, bytes.NewReader(basis), sig, &out)
+	require.NoError(t, err)
+	require.Equal(t, int64(out.Len()), n)
+	return out.Bytes(), literal
+}
+
+func TestBlockSizeFor(t *testing.T) {
+	require.Equal(t, minBlockSize, blockSizeFor(0))
+	require.Equal(t, minBlockSize, blockSizeFor(1<<20))
+	require.Equal(t, 32<<10, blockSizeFor(1<<30))
+	require.Equal(t, maxBlockSize, blockSizeFor(1<<50))
+}
+
+func TestRollingSum(t *testing.T) {
+	data := randomBytes(1, 4096)
+	const window = 512
+
+	sum := newRollingSum(data[:window])
+	for i := 1; i+window <= len(data); i++ {
+		sum.roll(data[i-1], data[i+window-1])
+		require.Equal(t, newRollingSum(data[i:i+window]).sum(), sum.sum(), "offset %d", i)
+	}
+}
+
+func TestDeltaRoundTrip(t *testing.T) {
+	basis := randomBytes(2, 300<<10)
+	insert := randomBytes(3, 100)
+
+	tests := []struct {
+		name       string
+		basis      []byte
+		content    []byte
+		maxLiteral int
+	}{
+		{"unchanged", basis, basis, 0},
+		{"insert in the middle", basis, append(append(append([]byte{}, basis[:150<<10]...), insert...), basis[150<<10:]...), 4 << 10},
+		{"prepend", basis, append(append([]byte{}, insert...), basis...), 100},
+		{"append", basis, append(append([]byte{}, basis...), insert...), 100},
+		{"truncate inside a block", basis, basis[:len(basis)-1000], 2 << 10},
+		{"overwrite a range", basis, append(append(append([]byte{}, basis[:1000]...), insert...), basis[1100:]...), 4 << 10},
+		{"no basis", nil, basis, len(basis)},
+		{"emptied", basis, nil, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, literal := roundTrip(t, tt.basis, tt.content)
+			require.True(t, bytes.Equal(tt.content, out))
+			require.LessOrEqual(t, literal, tt.maxLiteral)
+		})
+	}
+}
+
+func TestApplyDeltaRejectsInvalidCopies(t *testing.T) {
+	basis := randomBytes(4, 10<<10)
+	sig, err := signBlocks(bytes.NewReader(basis), int64(len(basis)))
+	require.NoError(t, err)
+
+	var wire bytes.Buffer
+	require.NoError(t, writeMessage(&wire, MsgCopy, CopyBlocks{Index: int64(len(sig.Blocks)), Count: 1}))
+
+	_, err = applyDelta(&wire, bytes.NewReader(basis), sig, io.Discard)
+	require.ErrorIs(t, err, ErrInvalidDelta)
+}
+
+func TestModifyIsSentAsDelta(t *testing.T) {
+	conf, err := getConfig(overwrite)
+	require.NoError(t, err)
+	dir := t.TempDir()
+	conf.Watcher.Path = dir
+	s := newTestServer(t, conf)
+
+	original := randomBytes(5, 200<<10)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "file.bin"), original, 0644))
+	local, err := s.idx.Update("file.bin")
+	require.NoError(t, err)
+
+	modified := append([]byte{}, original...)
+	copy(modified[100<<10:], "changed in place")
+	source := filepath.Join(t.TempDir(), "file.bin")
+	require.NoError(t, os.WriteFile(source, modified, 0644))
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go s.handleConnection(server, testPeerID)
+
+	_, err = clientHello(client)
+	require.NoError(t, err)
+	err = writeMessage(client, MsgFileHeader, FileHeader{
+		EventType: watcher.Modify,
+		Path:      "file.bin",
+		Size:      int64(len(modified)),
+		Hash:      digestOf(modified),
+		Vector:    local.Vector.Increment("peer"),
+		Delta:     true,
+	})
+	require.NoError(t, err)
+	require.NoError(t, streamDelta(client, source, int64(len(modified)), conf.Transfer.BufferSize))
+	require.NoError(t, readMessage(client, MsgAck, nil))
+
+	data, err := os.ReadFile(filepath.Join(dir, "file.bin"))
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(modified, data))
+
+	fi, _ := s.idx.Get("file.bin")
+	require.Equal(t, digestOf(modified), fi.Hash)
+	requireNoTempFiles(t, dir)
+}
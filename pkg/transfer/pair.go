@@ -0,0 +1,93 @@
+package transfer
+
+import (
+	"crypto/tls"
+	"github.com/hippo-an/sync-net/pkg/identity"
+	"github.com/hippo-an/sync-net/pkg/trust"
+	"io"
+	"log"
+	"net"
+)
+
+// Pairing is done by hand on both devices. Each side connects to the other,
+// shows the pairing code derived from both device IDs and, once the user
+// confirmed it matches the code on the other device, adds the peer to its
+// allow-list. Until then the transfer server only answers pair requests.
+
+// RequestPairing connects to the transfer server at address and announces
+// that we want to pair. It returns the device ID of the peer, which still has
+// to be confirmed by the user before it is trusted.
+func RequestPairing(address string, id *identity.Identity) (string, error) {
+	conn, err := tls.Dial("tcp", address, id.ClientConfig())
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	peer, err := identity.PeerID(conn)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = clientHello(conn)
+	if err != nil {
+		return "", err
+	}
+
+	err = writeMessage(conn, MsgPairRequest, nil)
+	if err != nil {
+		return "", err
+	}
+
+	err = readMessage(conn, MsgAck, nil)
+	if err != nil {
+		return "", err
+	}
+
+	return peer, nil
+}
+
+// handleUntrusted serves a device that is not on the allow-list. All it may
+// do is ask to pair, which shows the pairing code on this side as well.
+func (s *Server) handleUntrusted(conn net.Conn, peer string) {
+	_, err := serverHello(conn, s.folders())
+	if err != nil {
+		log.Println("Error during hello:", err)
+		return
+	}
+
+	f, err := ReadFrame(conn)
+	if err != nil {
+		if err != io.EOF {
+			log.Println("Error reading message:", err)
+		}
+		return
+	}
+
+	if f.Type != MsgPairRequest {
+		log.Printf("Refused untrusted device %s at %s\n", peer, conn.RemoteAddr())
+		_ = writeError(conn, trust.ErrUntrusted)
+		return
+	}
+
+	log.Printf(
+		"Device %s at %s wants to pair, pairing code %s. Run \"syncnet pair %s\" on this device to accept.\n",
+		peer,
+		conn.RemoteAddr(),
+		trust.PairingCode(s.id.DeviceID, peer),
+		hostOf(conn.RemoteAddr()),
+	)
+
+	err = writeMessage(conn, MsgAck, nil)
+	if err != nil {
+		log.Println("Error sending ack:", err)
+	}
+}
+
+func hostOf(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
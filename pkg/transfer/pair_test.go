@@ -0,0 +1,108 @@
+package transfer
+
+import (
+	"errors"
+	"github.com/hippo-an/sync-net/pkg/trust"
+	"github.com/hippo-an/sync-net/pkg/watcher"
+	"github.com/stretchr/testify/require"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestServerRefusesUntrustedDevices(t *testing.T) {
+	local := newTestNode(t)
+	remote := newTestNode(t)
+	peer := remote.serve(t)
+
+	// we never paired, so we do not talk to the remote
+	_, err := dialPeer(peer, local.ts.id, local.ts.peers)
+	require.ErrorIs(t, err, trust.ErrUntrusted)
+
+	// trusting it on our side is not enough, the remote refuses us
+	require.NoError(t, local.ts.peers.Add(remote.ts.id.DeviceID, ""))
+	conn, err := dialPeer(peer, local.ts.id, local.ts.peers)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	err = writeMessage(conn, MsgFileHeader, FileHeader{EventType: watcher.Create, Path: "file.txt"})
+	require.NoError(t, err)
+	err = readMessage(conn, MsgAck, nil)
+	var remoteErr *RemoteError
+	require.True(t, errors.As(err, &remoteErr))
+	require.Contains(t, remoteErr.Message, trust.ErrUntrusted.Error())
+
+	_, err = os.Stat(filepath.Join(remote.root, "file.txt"))
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestRequestPairing(t *testing.T) {
+	local := newTestNode(t)
+	remote := newTestNode(t)
+	peer := remote.serve(t)
+
+	id, err := RequestPairing(net.JoinHostPort(peer.Ip, peer.Port), local.ts.id)
+	require.NoError(t, err)
+	require.Equal(t, remote.ts.id.DeviceID, id)
+
+	// asking does not make us trusted, the remote user has to confirm too
+	require.False(t, remote.ts.peers.Trusted(local.ts.id.DeviceID))
+	require.False(t, local.ts.peers.Trusted(id))
+
+	local.pair(t, remote)
+	conn, err := dialPeer(peer, local.ts.id, local.ts.peers)
+	require.NoError(t, err)
+	conn.Close()
+}
+
+func TestPairingBothWays(t *testing.T) {
+	a := newTestNode(t)
+	b := newTestNode(t)
+	peerA := a.serve(t)
+	peerB := b.serve(t)
+
+	// A asks B and trusts it once the user confirmed the code
+	id, err := RequestPairing(net.JoinHostPort(peerB.Ip, peerB.Port), a.ts.id)
+	require.NoError(t, err)
+	require.Equal(t, b.ts.id.DeviceID, id)
+	require.NoError(t, a.ts.peers.Add(id, ""))
+
+	// B asks A, which already trusts it
+	id, err = RequestPairing(net.JoinHostPort(peerA.Ip, peerA.Port), b.ts.id)
+	require.NoError(t, err)
+	require.Equal(t, a.ts.id.DeviceID, id)
+	require.NoError(t, b.ts.peers.Add(id, ""))
+
+	conn, err := dialPeer(peerB, a.ts.id, a.ts.peers)
+	require.NoError(t, err)
+	conn.Close()
+	conn, err = dialPeer(peerA, b.ts.id, b.ts.peers)
+	require.NoError(t, err)
+	conn.Close()
+}
+
+func TestServerRefusesConnectionsWithoutDevice(t *testing.T) {
+	local := newTestNode(t)
+
+	// not a TLS connection, so there is no device to check
+	client, server := net.Pipe()
+	defer client.Close()
+	go local.ts.accept(server)
+
+	_, err := clientHello(client)
+	require.Error(t, err)
+
+	// a device that was never paired is only allowed to ask to pair
+	client, server = net.Pipe()
+	defer client.Close()
+	go local.ts.handleConnection(server, "UNPAIRED")
+
+	_, err = clientHello(client)
+	require.NoError(t, err)
+	require.NoError(t, writeMessage(client, MsgIndexRequest, nil))
+	err = readMessage(client, MsgIndex, nil)
+	var remoteErr *RemoteError
+	require.True(t, errors.As(err, &remoteErr))
+	require.Contains(t, remoteErr.Message, trust.ErrUntrusted.Error())
+}
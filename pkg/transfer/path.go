@@ -0,0 +1,137 @@
+package transfer
+
+import (
+	"errors"
+	"github.com/hippo-an/sync-net/pkg/watcher"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	ErrUnsafePath = errors.New("unsafe path")
+	ErrIgnored    = errors.New("path is ignored")
+)
+
+// relativePath converts a path inside root into the slash separated form
+// that is sent over the wire.
+func relativePath(root, fullPath string) (string, error) {
+	rel, err := filepath.Rel(root, fullPath)
+	if err != nil {
+		return "", err
+	}
+
+	rel = filepath.ToSlash(rel)
+	if rel == "." || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", ErrUnsafePath
+	}
+
+	return rel, nil
+}
+
+// resolvePath maps a relative path received from a peer onto root. Absolute
+// paths, ".." segments, paths into the local metadata directory and paths
+// that leave root through a symlink are rejected.
+func resolvePath(root, rel string) (string, error) {
+	if rel == "" || strings.ContainsRune(rel, 0) || strings.Contains(rel, "\\") {
+		return "", ErrUnsafePath
+	}
+
+	if path.IsAbs(rel) || filepath.IsAbs(rel) || filepath.VolumeName(rel) != "" {
+		return "", ErrUnsafePath
+	}
+
+	for _, part := range strings.Split(rel, "/") {
+		if part == ".." || part == watcher.MetaDirName {
+			return "", ErrUnsafePath
+		}
+	}
+
+	cleaned := path.Clean(rel)
+	if cleaned == "." {
+		return "", ErrUnsafePath
+	}
+
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", err
+	}
+
+	fullPath := filepath.Join(realRoot, filepath.FromSlash(cleaned))
+
+	realPath, err := evalExisting(fullPath)
+	if err != nil {
+		return "", err
+	}
+
+	if !within(realRoot, realPath) {
+		return "", ErrUnsafePath
+	}
+
+	return fullPath, nil
+}
+
+// evalExisting resolves symlinks of the longest existing prefix of p and
+// appends the remaining, not yet existing elements. Dangling symlinks are
+// followed to where they point, so a link cannot be used to create files
+// outside of the root.
+func evalExisting(p string) (string, error) {
+	var rest []string
+	current := p
+
+	for {
+		_, err := os.Lstat(current)
+		if err == nil {
+			break
+		}
+
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+
+		parent := filepath.Dir(current)
+		if parent == current {
+			return "", err
+		}
+
+		rest = append(rest, filepath.Base(current))
+		current = parent
+	}
+
+	resolved, err := filepath.EvalSymlinks(current)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+
+		target, err := os.Readlink(current)
+		if err != nil {
+			return "", err
+		}
+
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(current), target)
+		}
+
+		resolved, err = evalExisting(target)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	for i := len(rest) - 1; i >= 0; i-- {
+		resolved = filepath.Join(resolved, rest[i])
+	}
+
+	return resolved, nil
+}
+
+func within(root, p string) bool {
+	rel, err := filepath.Rel(root, p)
+	if err != nil {
+		return false
+	}
+
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
@@ -0,0 +1,110 @@
+package transfer
+
+import (
+	"github.com/hippo-an/sync-net/pkg/watcher"
+	"github.com/stretchr/testify/require"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRelativePath(t *testing.T) {
+	rel, err := relativePath("/opt/sync-net", "/opt/sync-net/a/b.txt")
+	require.NoError(t, err)
+	require.Equal(t, "a/b.txt", rel)
+
+	_, err = relativePath("/opt/sync-net", "/opt/other/b.txt")
+	require.ErrorIs(t, err, ErrUnsafePath)
+
+	_, err = relativePath("/opt/sync-net", "/opt/sync-net")
+	require.ErrorIs(t, err, ErrUnsafePath)
+}
+
+func TestResolvePath(t *testing.T) {
+	root := t.TempDir()
+	realRoot, err := filepath.EvalSymlinks(root)
+	require.NoError(t, err)
+
+	p, err := resolvePath(root, "a/b.txt")
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(realRoot, "a", "b.txt"), p)
+
+	p, err = resolvePath(root, "./a//b.txt")
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(realRoot, "a", "b.txt"), p)
+}
+
+func TestResolvePathRejectsUnsafePaths(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+
+	require.NoError(t, os.Symlink(outside, filepath.Join(root, "escape")))
+	require.NoError(t, os.Symlink(filepath.Join(outside, "target.txt"), filepath.Join(root, "link.txt")))
+
+	for _, rel := range []string{
+		"",
+		".",
+		"/etc/passwd",
+		"../outside.txt",
+		"a/../../outside.txt",
+		"a/../b.txt",
+		"..",
+		"escape/file.txt",
+		"escape/nested/file.txt",
+		"link.txt",
+		"a\\..\\b.txt",
+		"a\x00b",
+		".syncnet/versions/a.txt",
+		"dir/.syncnet",
+	} {
+		_, err := resolvePath(root, rel)
+		require.Error(t, err, "path %q must be rejected", rel)
+	}
+}
+
+func TestHandleConnectionRejectsEscape(t *testing.T) {
+	conf, err := getConfig(overwrite)
+	require.NoError(t, err)
+
+	root := t.TempDir()
+	outside := t.TempDir()
+	conf.Watcher.Path = root
+	s := newTestServer(t, conf)
+
+	victim := filepath.Join(outside, "victim.txt")
+	require.NoError(t, os.WriteFile(victim, []byte("keep me"), 0644))
+
+	rel, err := filepath.Rel(root, victim)
+	require.NoError(t, err)
+
+	for _, header := range []FileHeader{
+		{EventType: watcher.Create, Path: filepath.ToSlash(rel)},
+		{EventType: watcher.Delete, Path: filepath.ToSlash(rel)},
+		{EventType: watcher.Delete, Path: victim},
+	} {
+		client, server := net.Pipe()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			s.handleConnection(server, testPeerID)
+		}()
+
+		_, err := clientHello(client)
+		require.NoError(t, err)
+
+		err = writeMessage(client, MsgFileHeader, header)
+		require.NoError(t, err)
+
+		err = readMessage(client, MsgAck, nil)
+		var remoteErr *RemoteError
+		require.ErrorAs(t, err, &remoteErr)
+
+		client.Close()
+		<-done
+
+		data, err := os.ReadFile(victim)
+		require.NoError(t, err)
+		require.Equal(t, []byte("keep me"), data)
+	}
+}
@@ -0,0 +1,351 @@
+package transfer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/hippo-an/sync-net/pkg/index"
+	"github.com/hippo-an/sync-net/pkg/watcher"
+	"io"
+	"os"
+	"time"
+)
+
+// Every frame on the wire starts with a fixed header:
+//
+//	magic (4) | version (1) | type (1) | payload length (4)
+//
+// followed by the payload. Structured payloads are JSON encoded, data chunks
+// are raw bytes.
+const (
+	ProtocolVersion uint8 = 7
+
+	headerSize     = 10
+	maxPayloadSize = 64 << 20
+)
+
+var magic = [4]byte{'S', 'N', 'E', 'T'}
+
+type MessageType uint8
+
+const (
+	MsgHello MessageType = iota + 1
+	MsgFileHeader
+	MsgData
+	MsgEndOfFile
+	MsgAck
+	MsgError
+	MsgIndexRequest
+	MsgIndex
+	MsgFileRequest
+	MsgSignatures
+	MsgCopy
+	MsgOffset
+	MsgPairRequest
+)
+
+func (t MessageType) String() string {
+	switch t {
+	case MsgHello:
+		return "hello"
+	case MsgFileHeader:
+		return "file-header"
+	case MsgData:
+		return "data"
+	case MsgEndOfFile:
+		return "end-of-file"
+	case MsgAck:
+		return "ack"
+	case MsgError:
+		return "error"
+	case MsgIndexRequest:
+		return "index-request"
+	case MsgIndex:
+		return "index"
+	case MsgFileRequest:
+		return "file-request"
+	case MsgSignatures:
+		return "signatures"
+	case MsgCopy:
+		return "copy"
+	case MsgOffset:
+		return "offset"
+	case MsgPairRequest:
+		return "pair-request"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(t))
+	}
+}
+
+var (
+	ErrBadMagic          = errors.New("bad protocol magic")
+	ErrVersionMismatch   = errors.New("protocol version mismatch")
+	ErrPayloadTooLarge   = errors.New("payload too large")
+	ErrUnexpectedMessage = errors.New("unexpected message")
+)
+
+type Frame struct {
+	Version uint8
+	Type    MessageType
+	Payload []byte
+}
+
+type Hello struct {
+	Version uint8 `json:"version"`
+	// Folders are the IDs of the folders the answering server shares, so
+	// that peers not announced over discovery are known by them as well.
+	Folders []string `json:"folders,omitempty"`
+}
+
+type FileHeader struct {
+	EventType  watcher.EventType `json:"eventType"`
+	Path       string            `json:"path"`
+	Size       int64             `json:"size"`
+	Hash       string            `json:"hash,omitempty"`
+	Vector     index.Vector      `json:"vector,omitempty"`
+	ModTime    time.Time         `json:"modTime"`
+	ModifiedBy string            `json:"modifiedBy,omitempty"`
+	// Dir marks a directory, which is created with Mode and has no content.
+	Dir  bool        `json:"dir,omitempty"`
+	Mode os.FileMode `json:"mode,omitempty"`
+	// Children are the tombstones of everything inside a deleted directory.
+	Children []*index.FileInfo `json:"children,omitempty"`
+	// Delta asks the receiver for the block signatures of its copy before
+	// the content is sent as a delta against them.
+	Delta bool `json:"delta,omitempty"`
+	// Resume asks the receiver for the offset of its partial download
+	// before the content is sent from there on.
+	Resume bool `json:"resume,omitempty"`
+	// From is the old path of a renamed file and FromVector the version of
+	// its removal from there.
+	From       string       `json:"from,omitempty"`
+	FromVector index.Vector `json:"fromVector,omitempty"`
+}
+
+// FileInfo describes the sender's version of the file.
+func (h *FileHeader) FileInfo() *index.FileInfo {
+	return &index.FileInfo{
+		Path:       h.Path,
+		Size:       h.Size,
+		ModTime:    h.ModTime,
+		Mode:       h.Mode,
+		Hash:       h.Hash,
+		Vector:     h.Vector,
+		Deleted:    h.EventType == watcher.Delete,
+		Dir:        h.Dir,
+		ModifiedBy: h.ModifiedBy,
+	}
+}
+
+// FromInfo describes the removal of the old path of a renamed file.
+func (h *FileHeader) FromInfo() *index.FileInfo {
+	return &index.FileInfo{
+		Path:       h.From,
+		ModTime:    h.ModTime,
+		Vector:     h.FromVector,
+		Deleted:    true,
+		ModifiedBy: h.ModifiedBy,
+	}
+}
+
+// FileRequest asks the peer to send its current copy of Path. The answer is
+// a file header followed by the data, exactly like a pushed file.
+type FileRequest struct {
+	Path string `json:"path"`
+}
+
+type ErrorMessage struct {
+	Message string `json:"message"`
+}
+
+// RemoteError is returned when the peer answered with an error message.
+type RemoteError struct {
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return "peer error: " + e.Message
+}
+
+func WriteFrame(w io.Writer, t MessageType, payload []byte) error {
+	if len(payload) > maxPayloadSize {
+		return ErrPayloadTooLarge
+	}
+
+	buf := make([]byte, headerSize+len(payload))
+	copy(buf, magic[:])
+	buf[4] = ProtocolVersion
+	buf[5] = byte(t)
+	binary.BigEndian.PutUint32(buf[6:headerSize], uint32(len(payload)))
+	copy(buf[headerSize:], payload)
+
+	_, err := w.Write(buf)
+	return err
+}
+
+// ReadFrame reads exactly one frame. A frame with a different protocol
+// version is still consumed and returned together with ErrVersionMismatch so
+// the caller can answer cleanly before closing.
+func ReadFrame(r io.Reader) (*Frame, error) {
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(header[:4], magic[:]) {
+		return nil, ErrBadMagic
+	}
+
+	size := binary.BigEndian.Uint32(header[6:headerSize])
+	if size > maxPayloadSize {
+		return nil, ErrPayloadTooLarge
+	}
+
+	f := &Frame{
+		Version: header[4],
+		Type:    MessageType(header[5]),
+		Payload: make([]byte, size),
+	}
+
+	if _, err := io.ReadFull(r, f.Payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	if f.Version != ProtocolVersion {
+		return f, fmt.Errorf("%w: got %d, want %d", ErrVersionMismatch, f.Version, ProtocolVersion)
+	}
+
+	return f, nil
+}
+
+func writeMessage(w io.Writer, t MessageType, v any) error {
+	var payload []byte
+	if v != nil {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		payload = data
+	}
+
+	return WriteFrame(w, t, payload)
+}
+
+func writeError(w io.Writer, err error) error {
+	return writeMessage(w, MsgError, ErrorMessage{Message: err.Error()})
+}
+
+// readMessage reads the next frame, expects it to be of type t and decodes
+// its payload into v. Error messages from the peer are returned as
+// *RemoteError.
+func readMessage(r io.Reader, t MessageType, v any) error {
+	f, err := ReadFrame(r)
+	if err != nil {
+		return err
+	}
+
+	return decodeFrame(f, t, v)
+}
+
+func decodeFrame(f *Frame, t MessageType, v any) error {
+	if f.Type == MsgError && t != MsgError {
+		var m ErrorMessage
+		if err := json.Unmarshal(f.Payload, &m); err != nil {
+			return err
+		}
+		return &RemoteError{Message: m.Message}
+	}
+
+	if f.Type != t {
+		return fmt.Errorf("%w: got %s, want %s", ErrUnexpectedMessage, f.Type, t)
+	}
+
+	if v == nil {
+		return nil
+	}
+
+	return json.Unmarshal(f.Payload, v)
+}
+
+// clientHello sends our hello and waits for the peer's answer.
+func clientHello(rw io.ReadWriter) (*Hello, error) {
+	err := writeMessage(rw, MsgHello, Hello{Version: ProtocolVersion})
+	if err != nil {
+		return nil, err
+	}
+
+	var h Hello
+	if err := readMessage(rw, MsgHello, &h); err != nil {
+		return nil, err
+	}
+
+	if h.Version != ProtocolVersion {
+		return nil, fmt.Errorf("%w: got %d, want %d", ErrVersionMismatch, h.Version, ProtocolVersion)
+	}
+
+	return &h, nil
+}
+
+// serverHello waits for the peer's hello and answers it with the folders
+// we share. On a version mismatch the peer gets an error message before the
+// connection is closed.
+func serverHello(rw io.ReadWriter, folders []string) (*Hello, error) {
+	f, err := ReadFrame(rw)
+	if err != nil {
+		if errors.Is(err, ErrVersionMismatch) {
+			_ = writeError(rw, err)
+		}
+		return nil, err
+	}
+
+	var h Hello
+	if err := decodeFrame(f, MsgHello, &h); err != nil {
+		_ = writeError(rw, err)
+		return nil, err
+	}
+
+	if h.Version != ProtocolVersion {
+		err := fmt.Errorf("%w: got %d, want %d", ErrVersionMismatch, h.Version, ProtocolVersion)
+		_ = writeError(rw, err)
+		return nil, err
+	}
+
+	err = writeMessage(rw, MsgHello, Hello{Version: ProtocolVersion, Folders: folders})
+	if err != nil {
+		return nil, err
+	}
+
+	return &h, nil
+}
+
+// receiveData copies data frames into w until the end-of-file frame.
+func receiveData(r io.Reader, w io.Writer) (int64, error) {
+	var written int64
+	for {
+		f, err := ReadFrame(r)
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return written, err
+		}
+
+		switch f.Type {
+		case MsgData:
+			n, err := w.Write(f.Payload)
+			written += int64(n)
+			if err != nil {
+				return written, err
+			}
+		case MsgEndOfFile:
+			return written, nil
+		default:
+			return written, decodeFrame(f, MsgData, nil)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package transfer
+
+import (
+	"bytes"
+	"github.com/hippo-an/sync-net/pkg/watcher"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"testing"
+	"testing/iotest"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+
+	err := writeMessage(&buf, MsgFileHeader, FileHeader{EventType: watcher.Modify, Path: "a/b.txt", Size: 3})
+	require.NoError(t, err)
+	err = WriteFrame(&buf, MsgData, []byte("abc"))
+	require.NoError(t, err)
+	err = WriteFrame(&buf, MsgEndOfFile, nil)
+	require.NoError(t, err)
+
+	// a reader returning one byte at a time must not produce short frames
+	r := iotest.OneByteReader(&buf)
+
+	var header FileHeader
+	err = readMessage(r, MsgFileHeader, &header)
+	require.NoError(t, err)
+	require.Equal(t, FileHeader{EventType: watcher.Modify, Path: "a/b.txt", Size: 3}, header)
+
+	var data bytes.Buffer
+	n, err := receiveData(r, &data)
+	require.NoError(t, err)
+	require.Equal(t, int64(3), n)
+	require.Equal(t, "abc", data.String())
+
+	_, err = ReadFrame(r)
+	require.ErrorIs(t, err, io.EOF)
+}
+
+func TestReadFrameRejectsGarbage(t *testing.T) {
+	_, err := ReadFrame(bytes.NewReader([]byte("1:/etc/passwd and some more bytes")))
+	require.ErrorIs(t, err, ErrBadMagic)
+
+	var buf bytes.Buffer
+	require.NoError(t, WriteFrame(&buf, MsgData, []byte("abc")))
+	truncated := buf.Bytes()[:buf.Len()-1]
+	_, err = ReadFrame(bytes.NewReader(truncated))
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	header := append(append([]byte{}, magic[:]...), ProtocolVersion, byte(MsgData), 0xff, 0xff, 0xff, 0xff)
+	_, err = ReadFrame(bytes.NewReader(header))
+	require.ErrorIs(t, err, ErrPayloadTooLarge)
+}
+
+func TestReadMessageReturnsRemoteError(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, writeMessage(&buf, MsgError, ErrorMessage{Message: "boom"}))
+
+	err := readMessage(&buf, MsgAck, nil)
+	var remoteErr *RemoteError
+	require.ErrorAs(t, err, &remoteErr)
+	require.Equal(t, "boom", remoteErr.Message)
+}
+
+func TestHelloVersionMismatch(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		defer server.Close()
+		_, err := serverHello(server, nil)
+		done <- err
+	}()
+
+	// an older node sends a frame with a different version byte
+	frame := append(append([]byte{}, magic[:]...), ProtocolVersion+1, byte(MsgHello), 0, 0, 0, 2)
+	frame = append(frame, '{', '}')
+	_, err := client.Write(frame)
+	require.NoError(t, err)
+
+	err = readMessage(client, MsgHello, nil)
+	var remoteErr *RemoteError
+	require.ErrorAs(t, err, &remoteErr)
+	require.Contains(t, remoteErr.Message, "version mismatch")
+
+	require.ErrorIs(t, <-done, ErrVersionMismatch)
+}
@@ -0,0 +1,137 @@
+package transfer
+
+import (
+	"fmt"
+	"github.com/hippo-an/sync-net/pkg/config"
+	"github.com/hippo-an/sync-net/pkg/index"
+	"io"
+)
+
+// Decision is what a ConflictResolver wants done with a concurrent change.
+type Decision int
+
+const (
+	// KeepLocal discards the remote change; our copy supersedes both.
+	KeepLocal Decision = iota
+	// TakeRemote replaces our copy with the remote one.
+	TakeRemote
+	// KeepBoth moves our copy to a conflict copy and takes the remote one.
+	KeepBoth
+	// Merge combines both copies. The resolver must implement Merger.
+	Merge
+)
+
+func (d Decision) String() string {
+	switch d {
+	case KeepLocal:
+		return "keep local"
+	case TakeRemote:
+		return "take remote"
+	case KeepBoth:
+		return "keep both"
+	case Merge:
+		return "merge"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(d))
+	}
+}
+
+// ConflictResolver decides between two versions of a file that were changed
+// concurrently. A deleted side has Deleted set.
+type ConflictResolver interface {
+	Resolve(local, remote *index.FileInfo) Decision
+}
+
+// Merger is implemented by resolvers that return Merge. It writes the
+// combination of both contents to out.
+type Merger interface {
+	Merge(local, remote io.Reader, out io.Writer) error
+}
+
+// ResolverFunc adapts a function to the ConflictResolver interface.
+type ResolverFunc func(local, remote *index.FileInfo) Decision
+
+func (f ResolverFunc) Resolve(local, remote *index.FileInfo) Decision {
+	return f(local, remote)
+}
+
+var (
+	// RemoteWins always takes the remote copy.
+	RemoteWins = ResolverFunc(func(local, remote *index.FileInfo) Decision {
+		return TakeRemote
+	})
+
+	// KeepBothResolver never loses data: our copy becomes a conflict copy.
+	KeepBothResolver = ResolverFunc(func(local, remote *index.FileInfo) Decision {
+		return KeepBoth
+	})
+
+	// NewestWins takes the copy with the latest modification time.
+	NewestWins = ResolverFunc(func(local, remote *index.FileInfo) Decision {
+		if remote.ModTime.After(local.ModTime) {
+			return TakeRemote
+		}
+		return KeepLocal
+	})
+
+	// LargestWins takes the bigger copy. A deletion counts as empty.
+	LargestWins = ResolverFunc(func(local, remote *index.FileInfo) Decision {
+		if size(remote) > size(local) {
+			return TakeRemote
+		}
+		return KeepLocal
+	})
+)
+
+func size(f *index.FileInfo) int64 {
+	if f.Deleted {
+		return -1
+	}
+	return f.Size
+}
+
+// DevicePriority prefers the change made by the device listed first. Changes
+// from unlisted devices, or two equally ranked ones, keep both copies.
+type DevicePriority struct {
+	Devices []string
+}
+
+func (p DevicePriority) Resolve(local, remote *index.FileInfo) Decision {
+	l, r := p.rank(local.ModifiedBy), p.rank(remote.ModifiedBy)
+
+	switch {
+	case l < r:
+		return KeepLocal
+	case r < l:
+		return TakeRemote
+	default:
+		return KeepBoth
+	}
+}
+
+func (p DevicePriority) rank(device string) int {
+	for i, d := range p.Devices {
+		if d == device {
+			return i
+		}
+	}
+	return len(p.Devices)
+}
+
+// resolverFor maps the onConflict config option to a built-in resolver.
+func resolverFor(conf *config.Config) (ConflictResolver, error) {
+	switch conf.Transfer.Consistency.OnConflict {
+	case "overwrite":
+		return RemoteWins, nil
+	case "backupAndCreate", "keepBoth":
+		return KeepBothResolver, nil
+	case "newest":
+		return NewestWins, nil
+	case "largest":
+		return LargestWins, nil
+	case "devicePriority":
+		return DevicePriority{Devices: conf.Transfer.Consistency.DevicePriority}, nil
+	default:
+		return nil, fmt.Errorf("invalid consistency option: %s", conf.Transfer.Consistency.OnConflict)
+	}
+}
@@ -0,0 +1,188 @@
+package transfer
+
+import (
+	"bytes"
+	"github.com/hippo-an/sync-net/pkg/index"
+	"github.com/hippo-an/sync-net/pkg/watcher"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBuiltInResolvers(t *testing.T) {
+	now := time.Now()
+	older := &index.FileInfo{Size: 10, ModTime: now.Add(-time.Minute), ModifiedBy: "a"}
+	newer := &index.FileInfo{Size: 5, ModTime: now, ModifiedBy: "b"}
+	deleted := &index.FileInfo{ModTime: now.Add(time.Minute), Deleted: true, ModifiedBy: "c"}
+
+	tests := []struct {
+		name          string
+		resolver      ConflictResolver
+		local, remote *index.FileInfo
+		want          Decision
+	}{
+		{"remote wins", RemoteWins, newer, older, TakeRemote},
+		{"keep both", KeepBothResolver, newer, older, KeepBoth},
+		{"newest remote", NewestWins, older, newer, TakeRemote},
+		{"newest local", NewestWins, newer, older, KeepLocal},
+		{"newest deletion", NewestWins, newer, deleted, TakeRemote},
+		{"largest remote", LargestWins, newer, older, TakeRemote},
+		{"largest local", LargestWins, older, newer, KeepLocal},
+		{"largest over deletion", LargestWins, newer, deleted, KeepLocal},
+		{"priority local", DevicePriority{Devices: []string{"a", "b"}}, older, newer, KeepLocal},
+		{"priority remote", DevicePriority{Devices: []string{"b", "a"}}, older, newer, TakeRemote},
+		{"priority listed over unlisted", DevicePriority{Devices: []string{"b"}}, older, newer, TakeRemote},
+		{"priority unlisted", DevicePriority{Devices: []string{"x"}}, older, newer, KeepBoth},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, tt.resolver.Resolve(tt.local, tt.remote))
+		})
+	}
+}
+
+func TestResolverFor(t *testing.T) {
+	conf, err := getConfig("devicePriority")
+	require.NoError(t, err)
+	conf.Transfer.Consistency.DevicePriority = []string{"a"}
+
+	r, err := resolverFor(conf)
+	require.NoError(t, err)
+	require.Equal(t, DevicePriority{Devices: []string{"a"}}, r)
+
+	conf.Transfer.Consistency.OnConflict = "coinFlip"
+	_, err = resolverFor(conf)
+	require.Error(t, err)
+}
+
+// concatMerger keeps both contents in a single file.
+type concatMerger struct {
+	ResolverFunc
+}
+
+func (concatMerger) Merge(local, remote io.Reader, out io.Writer) error {
+	_, err := io.Copy(out, local)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, remote)
+	return err
+}
+
+// pushConcurrent writes localContent to file.txt in the server's folder, then
+// pushes remoteContent from a peer that edited the same base version.
+func pushConcurrent(t *testing.T, s *Server, localContent, remoteContent string) (string, index.Vector) {
+	t.Helper()
+
+	filePath := filepath.Join(s.root, "file.txt")
+	require.NoError(t, os.WriteFile(filePath, []byte(localContent), 0644))
+	current, err := s.idx.Update("file.txt")
+	require.NoError(t, err)
+
+	remote := current.Vector.Copy()
+	remote[s.idx.DeviceID()]--
+	remote = remote.Increment("peer")
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go s.handleConnection(server, testPeerID)
+
+	_, err = clientHello(client)
+	require.NoError(t, err)
+	err = writeMessage(client, MsgFileHeader, FileHeader{
+		EventType:  watcher.Modify,
+		Path:       "file.txt",
+		Size:       int64(len(remoteContent)),
+		Hash:       digestOf([]byte(remoteContent)),
+		Vector:     remote,
+		ModTime:    time.Now(),
+		ModifiedBy: "peer",
+	})
+	require.NoError(t, err)
+	sendData(t, client, []byte(remoteContent))
+	require.NoError(t, readMessage(client, MsgAck, nil))
+
+	return filePath, remote
+}
+
+func TestCustomResolverKeepsLocal(t *testing.T) {
+	conf, err := getConfig(overwrite)
+	require.NoError(t, err)
+	conf.Watcher.Path = t.TempDir()
+	conf.Node.StateDir = t.TempDir()
+	id := newTestIdentity(t)
+	idx := openTestIndex(t, conf, id.DeviceID)
+
+	var seen *index.FileInfo
+	s := NewServer(conf, idx, id, newTestTrust(t, conf), WithConflictResolver(ResolverFunc(func(local, remote *index.FileInfo) Decision {
+		seen = remote
+		return KeepLocal
+	})))
+
+	filePath, remote := pushConcurrent(t, s, "local", "remote")
+
+	require.Equal(t, "peer", seen.ModifiedBy)
+	data, err := os.ReadFile(filePath)
+	require.NoError(t, err)
+	require.Equal(t, []byte("local"), data)
+
+	// our version now supersedes both, so the peer will take it on next sync
+	fi, _ := s.idx.Get("file.txt")
+	require.Equal(t, index.After, fi.Vector.Compare(remote))
+	require.Equal(t, s.idx.DeviceID(), fi.ModifiedBy)
+}
+
+func TestMergerCombinesBothCopies(t *testing.T) {
+	conf, err := getConfig(overwrite)
+	require.NoError(t, err)
+	conf.Watcher.Path = t.TempDir()
+	conf.Node.StateDir = t.TempDir()
+	id := newTestIdentity(t)
+	idx := openTestIndex(t, conf, id.DeviceID)
+
+	s := NewServer(conf, idx, id, newTestTrust(t, conf), WithConflictResolver(concatMerger{func(local, remote *index.FileInfo) Decision {
+		return Merge
+	}}))
+
+	filePath, remote := pushConcurrent(t, s, "local\n", "remote\n")
+
+	data, err := os.ReadFile(filePath)
+	require.NoError(t, err)
+	require.True(t, bytes.Equal([]byte("local\nremote\n"), data))
+	requireNoTempFiles(t, s.root)
+
+	copies, err := conflictCopies(filePath)
+	require.NoError(t, err)
+	require.Empty(t, copies)
+
+	fi, _ := s.idx.Get("file.txt")
+	require.Equal(t, index.After, fi.Vector.Compare(remote))
+	require.Equal(t, digestOf(data), fi.Hash)
+}
+
+func TestMergeWithoutMergerKeepsBoth(t *testing.T) {
+	conf, err := getConfig(overwrite)
+	require.NoError(t, err)
+	conf.Watcher.Path = t.TempDir()
+	conf.Node.StateDir = t.TempDir()
+	id := newTestIdentity(t)
+	idx := openTestIndex(t, conf, id.DeviceID)
+
+	s := NewServer(conf, idx, id, newTestTrust(t, conf), WithConflictResolver(ResolverFunc(func(local, remote *index.FileInfo) Decision {
+		return Merge
+	})))
+
+	filePath, _ := pushConcurrent(t, s, "local", "remote")
+
+	data, err := os.ReadFile(filePath)
+	require.NoError(t, err)
+	require.Equal(t, []byte("remote"), data)
+	data, err = os.ReadFile(requireConflictCopy(t, filePath))
+	require.NoError(t, err)
+	require.Equal(t, []byte("local"), data)
+}
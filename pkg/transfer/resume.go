@@ -0,0 +1,175 @@
+package transfer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/hippo-an/sync-net/pkg/watcher"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Resumable transfers stage their data under the partial directory of the
+// synced folder. Each partial download is named after the file path and the
+// hash the sender announced, so an interrupted transfer continues where it
+// stopped as long as the source did not change. Only new and renamed files
+// are sent resumable. Modified files are sent as a delta against the copy
+// the receiver has, which is not resumed: an interrupted delta transfer
+// starts over, but again only sends the blocks that changed.
+
+const partialDirName = "partial"
+
+// partialMaxAge is how long a partial download is kept without being
+// written to. Older ones are removed when the server starts, the transfer
+// they belong to is not coming back.
+const partialMaxAge = 7 * 24 * time.Hour
+
+var ErrInvalidOffset = errors.New("invalid offset")
+
+// Offset is the receiver's answer to a resumable file header: the number of
+// bytes it already has, and therefore where the sender continues.
+type Offset struct {
+	Offset int64 `json:"offset"`
+}
+
+func partialDir(root string) string {
+	return filepath.Join(root, watcher.MetaDirName, partialDirName)
+}
+
+func partialKey(relPath string) string {
+	sum := sha256.Sum256([]byte(relPath))
+	return hex.EncodeToString(sum[:16])
+}
+
+func partialPath(root, relPath, hash string) string {
+	return filepath.Join(partialDir(root), partialKey(relPath)+"-"+hash)
+}
+
+// purgePartials removes partial downloads of relPath other than keep. They
+// were started for content the sender no longer has.
+func purgePartials(root, relPath, keep string) {
+	matches, err := filepath.Glob(filepath.Join(partialDir(root), partialKey(relPath)+"-*"))
+	if err != nil {
+		return
+	}
+
+	for _, m := range matches {
+		if m == keep {
+			continue
+		}
+
+		log.Println("Removing stale partial download:", m)
+		err = os.Remove(m)
+		if err != nil && !os.IsNotExist(err) {
+			log.Println("Error removing partial download:", err)
+		}
+	}
+}
+
+// expirePartials removes the partial downloads under root that were last
+// written to before now minus partialMaxAge.
+func expirePartials(root string, now time.Time) {
+	entries, err := os.ReadDir(partialDir(root))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println("Error reading partial downloads:", err)
+		}
+		return
+	}
+
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || !info.Mode().IsRegular() || now.Sub(info.ModTime()) < partialMaxAge {
+			continue
+		}
+
+		m := filepath.Join(partialDir(root), e.Name())
+		log.Println("Removing expired partial download:", m)
+		err = os.Remove(m)
+		if err != nil && !os.IsNotExist(err) {
+			log.Println("Error removing partial download:", err)
+		}
+	}
+}
+
+// openReceiver prepares the temporary file for the content announced by
+// header. A resumable transfer continues the staged partial download and the
+// sender is told how much of it is already there. Partial downloads of other
+// content of the same path are removed either way.
+func (s *Server) openReceiver(conn io.Writer, filePath string, header *FileHeader) (*atomicFile, error) {
+	var partial string
+	if validHash(header.Hash) {
+		partial = partialPath(s.root, header.Path, header.Hash)
+	}
+	purgePartials(s.root, header.Path, partial)
+
+	if !header.Resume || header.Delta || partial == "" {
+		return createAtomic(filePath)
+	}
+
+	err := os.MkdirAll(partialDir(s.root), 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	file, offset, err := resumeAtomic(filePath, partial, header.Size)
+	if err != nil {
+		return nil, err
+	}
+
+	if offset > 0 {
+		log.Printf("Resuming %s at %d of %d bytes\n", header.Path, offset, header.Size)
+	}
+
+	err = writeMessage(conn, MsgOffset, Offset{Offset: offset})
+	if err != nil {
+		file.Release()
+		return nil, err
+	}
+
+	return file, nil
+}
+
+// validHash reports whether hash is a hex encoded SHA-256 digest and thereby
+// safe to use in a file name.
+func validHash(hash string) bool {
+	b, err := hex.DecodeString(hash)
+	return err == nil && len(b) == sha256.Size && strings.ToLower(hash) == hash
+}
+
+// skipContent consumes content the receiver does not need. A resumable
+// sender is told that everything is there already.
+func skipContent(conn io.ReadWriter, header *FileHeader, basis string) error {
+	if !header.Resume || header.Delta {
+		return receiveContent(conn, header, basis, io.Discard)
+	}
+
+	err := writeMessage(conn, MsgOffset, Offset{Offset: header.Size})
+	if err != nil {
+		return err
+	}
+
+	_, err = receiveData(conn, io.Discard)
+	return err
+}
+
+// streamResumable waits for the receiver's offset and sends the first size
+// bytes of fileName from there on, followed by an end-of-file frame.
+func streamResumable(conn io.ReadWriter, fileName string, size int64, bufferSize int) error {
+	var o Offset
+	err := readMessage(conn, MsgOffset, &o)
+	if err != nil {
+		return err
+	}
+
+	if o.Offset < 0 || o.Offset > size {
+		return fmt.Errorf("%w: %d of %d bytes", ErrInvalidOffset, o.Offset, size)
+	}
+
+	return streamFile(conn, fileName, o.Offset, size, bufferSize)
+}
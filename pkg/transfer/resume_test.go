@@ -0,0 +1,211 @@
+package transfer
+
+import (
+	"bytes"
+	"github.com/hippo-an/sync-net/pkg/watcher"
+	"github.com/stretchr/testify/require"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// resumeConn connects to s and sends a resumable header for content. It
+// returns the connection, the offset the server answered with and a channel
+// that is closed when the server is done with the connection.
+func resumeConn(t *testing.T, s *Server, relPath string, content []byte) (net.Conn, int64, chan struct{}) {
+	t.Helper()
+
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.handleConnection(server, testPeerID)
+	}()
+
+	_, err := clientHello(client)
+	require.NoError(t, err)
+	err = writeMessage(client, MsgFileHeader, FileHeader{
+		EventType: watcher.Create,
+		Path:      relPath,
+		Size:      int64(len(content)),
+		Hash:      digestOf(content),
+		Resume:    true,
+	})
+	require.NoError(t, err)
+
+	var o Offset
+	require.NoError(t, readMessage(client, MsgOffset, &o))
+	return client, o.Offset, done
+}
+
+func TestInterruptedTransferResumes(t *testing.T) {
+	conf, err := getConfig(overwrite)
+	require.NoError(t, err)
+	dir := t.TempDir()
+	conf.Watcher.Path = dir
+	s := newTestServer(t, conf)
+
+	content := randomBytes(6, 100<<10)
+	half := len(content) / 2
+
+	// the connection drops after half of the data
+	conn, offset, done := resumeConn(t, s, "big.bin", content)
+	require.Zero(t, offset)
+	require.NoError(t, WriteFrame(conn, MsgData, content[:half]))
+	conn.Close()
+	<-done
+
+	_, err = os.Stat(filepath.Join(dir, "big.bin"))
+	require.True(t, os.IsNotExist(err))
+	info, err := os.Stat(partialPath(dir, "big.bin", digestOf(content)))
+	require.NoError(t, err)
+	require.Equal(t, int64(half), info.Size())
+
+	// the sender reconnects and continues from the offset
+	source := filepath.Join(t.TempDir(), "big.bin")
+	require.NoError(t, os.WriteFile(source, content, 0644))
+
+	conn, offset, done = resumeConn(t, s, "big.bin", content)
+	defer conn.Close()
+	require.Equal(t, int64(half), offset)
+	require.NoError(t, streamFile(conn, source, offset, int64(len(content)), conf.Transfer.BufferSize))
+	require.NoError(t, readMessage(conn, MsgAck, nil))
+
+	data, err := os.ReadFile(filepath.Join(dir, "big.bin"))
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(content, data))
+
+	partials, err := os.ReadDir(partialDir(dir))
+	require.NoError(t, err)
+	require.Empty(t, partials)
+
+	// an up to date receiver needs nothing at all
+	conn.Close()
+	<-done
+	conn, offset, _ = resumeConn(t, s, "big.bin", content)
+	defer conn.Close()
+	require.Equal(t, int64(len(content)), offset)
+	require.NoError(t, WriteFrame(conn, MsgEndOfFile, nil))
+	require.NoError(t, readMessage(conn, MsgAck, nil))
+}
+
+func TestChangedSourceDiscardsPartial(t *testing.T) {
+	conf, err := getConfig(overwrite)
+	require.NoError(t, err)
+	dir := t.TempDir()
+	conf.Watcher.Path = dir
+	s := newTestServer(t, conf)
+
+	old := randomBytes(7, 10<<10)
+	conn, _, done := resumeConn(t, s, "file.bin", old)
+	require.NoError(t, WriteFrame(conn, MsgData, old[:1000]))
+	conn.Close()
+	<-done
+
+	oldPartial := partialPath(dir, "file.bin", digestOf(old))
+	_, err = os.Stat(oldPartial)
+	require.NoError(t, err)
+
+	changed := randomBytes(8, 10<<10)
+	conn, offset, _ := resumeConn(t, s, "file.bin", changed)
+	defer conn.Close()
+	require.Zero(t, offset)
+
+	_, err = os.Stat(oldPartial)
+	require.True(t, os.IsNotExist(err))
+
+	sendData(t, conn, changed)
+	require.NoError(t, readMessage(conn, MsgAck, nil))
+
+	data, err := os.ReadFile(filepath.Join(dir, "file.bin"))
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(changed, data))
+}
+
+func TestCorruptPartialIsDiscarded(t *testing.T) {
+	conf, err := getConfig(overwrite)
+	require.NoError(t, err)
+	dir := t.TempDir()
+	conf.Watcher.Path = dir
+	s := newTestServer(t, conf)
+
+	content := randomBytes(9, 10<<10)
+	partial := partialPath(dir, "file.bin", digestOf(content))
+	require.NoError(t, os.MkdirAll(partialDir(dir), 0755))
+	require.NoError(t, os.WriteFile(partial, []byte("not what the sender has"), 0600))
+
+	conn, offset, _ := resumeConn(t, s, "file.bin", content)
+	defer conn.Close()
+	sendData(t, conn, content[offset:])
+
+	var remoteErr *RemoteError
+	require.ErrorAs(t, readMessage(conn, MsgAck, nil), &remoteErr)
+	require.Contains(t, remoteErr.Message, ErrHashMismatch.Error())
+
+	_, err = os.Stat(partial)
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestOtherTransferOfThePathDiscardsPartial(t *testing.T) {
+	conf, err := getConfig(overwrite)
+	require.NoError(t, err)
+	dir := t.TempDir()
+	conf.Watcher.Path = dir
+	s := newTestServer(t, conf)
+
+	old := randomBytes(10, 10<<10)
+	conn, _, done := resumeConn(t, s, "file.bin", old)
+	require.NoError(t, WriteFrame(conn, MsgData, old[:1000]))
+	conn.Close()
+	<-done
+
+	oldPartial := partialPath(dir, "file.bin", digestOf(old))
+	_, err = os.Stat(oldPartial)
+	require.NoError(t, err)
+
+	// the path is sent again without resuming
+	client, server := net.Pipe()
+	defer client.Close()
+	go s.handleConnection(server, testPeerID)
+
+	_, err = clientHello(client)
+	require.NoError(t, err)
+	changed := randomBytes(11, 10<<10)
+	err = writeMessage(client, MsgFileHeader, FileHeader{
+		EventType: watcher.Modify,
+		Path:      "file.bin",
+		Size:      int64(len(changed)),
+		Hash:      digestOf(changed),
+	})
+	require.NoError(t, err)
+	sendData(t, client, changed)
+	require.NoError(t, readMessage(client, MsgAck, nil))
+
+	_, err = os.Stat(oldPartial)
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestExpirePartials(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(partialDir(dir), 0755))
+
+	now := time.Now()
+	stale := partialPath(dir, "stale.bin", digestOf([]byte("stale")))
+	recent := partialPath(dir, "recent.bin", digestOf([]byte("recent")))
+	require.NoError(t, os.WriteFile(stale, []byte("sta"), 0600))
+	require.NoError(t, os.WriteFile(recent, []byte("rec"), 0600))
+	lastWrite := now.Add(-partialMaxAge - time.Hour)
+	require.NoError(t, os.Chtimes(stale, lastWrite, lastWrite))
+
+	expirePartials(dir, now)
+
+	_, err := os.Stat(stale)
+	require.True(t, os.IsNotExist(err))
+	_, err = os.Stat(recent)
+	require.NoError(t, err)
+
+	// nothing to expire
+	expirePartials(t.TempDir(), now)
+}
@@ -1,31 +1,99 @@
 package transfer
 
 import (
-	"encoding/binary"
-	"errors"
+	"crypto/tls"
 	"fmt"
 	"github.com/hippo-an/sync-net/pkg/config"
+	"github.com/hippo-an/sync-net/pkg/identity"
+	"github.com/hippo-an/sync-net/pkg/ignore"
+	"github.com/hippo-an/sync-net/pkg/index"
+	"github.com/hippo-an/sync-net/pkg/trust"
+	"github.com/hippo-an/sync-net/pkg/versioning"
 	"github.com/hippo-an/sync-net/pkg/watcher"
 	"io"
 	"log"
 	"net"
 	"os"
-	"strconv"
+	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 )
 
 type Server struct {
-	conf *config.Config
+	conf        *config.Config
+	root        string
+	idx         *index.Index
+	id          *identity.Identity
+	peers       *trust.Store
+	resolver    ConflictResolver
+	resolverErr error
+	versioner   *versioning.Versioner
+	ignores     *ignore.Matcher
+	inbound     *watcher.Inbound
 }
 
-func NewServer(conf *config.Config) *Server {
-	return &Server{
-		conf: conf,
+type ServerOption func(*Server)
+
+// WithConflictResolver replaces the resolver selected by the onConflict
+// config option.
+func WithConflictResolver(r ConflictResolver) ServerOption {
+	return func(s *Server) {
+		s.resolver = r
+		s.resolverErr = nil
+	}
+}
+
+// WithVersioner archives the old content of files that are replaced or
+// deleted by a peer instead of discarding it.
+func WithVersioner(v *versioning.Versioner) ServerOption {
+	return func(s *Server) {
+		s.versioner = v
+	}
+}
+
+// WithIgnore refuses files matching the ignore patterns from peers and
+// leaves them out of the index we share.
+func WithIgnore(m *ignore.Matcher) ServerOption {
+	return func(s *Server) {
+		s.ignores = m
+	}
+}
+
+// WithInbound registers every change applied to the synced folder with the
+// watcher's registry of inbound writes, so that it is not sent back to peers
+// as a local change.
+func WithInbound(r *watcher.Inbound) ServerOption {
+	return func(s *Server) {
+		s.inbound = r
 	}
 }
 
+func NewServer(conf *config.Config, idx *index.Index, id *identity.Identity, peers *trust.Store, opts ...ServerOption) *Server {
+	s := &Server{
+		conf:  conf,
+		root:  conf.Watcher.Path,
+		idx:   idx,
+		id:    id,
+		peers: peers,
+	}
+
+	s.resolver, s.resolverErr = resolverFor(conf)
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
+}
+
+// ListenAndConnect accepts TLS connections from peers, which have to
+// authenticate with their device certificate. Devices that are not on the
+// allow-list may only ask to pair.
 func (s *Server) ListenAndConnect(port int) {
-	conn, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	expirePartials(s.root, time.Now())
+
+	conn, err := tls.Listen("tcp", fmt.Sprintf(":%d", port), s.id.ServerConfig())
 	if err != nil {
 		log.Fatal("Error starting server:", err)
 	}
@@ -37,263 +105,732 @@ func (s *Server) ListenAndConnect(port int) {
 			continue
 		}
 
-		go s.handleConnection(conn)
-
+		go s.accept(conn)
 	}
 }
 
-func (s *Server) handleConnection(conn net.Conn) {
-	defer conn.Close()
+// accept serves a connection once the device at the other end is known.
+// Connections that do not present a device certificate are closed.
+func (s *Server) accept(conn net.Conn) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		log.Printf("Refused connection from %s: %s\n", conn.RemoteAddr(), identity.ErrNoPeerCertificate)
+		conn.Close()
+		return
+	}
 
-	sizeBytes := make([]byte, 8)
-	_, err := conn.Read(sizeBytes)
+	peer, err := identity.PeerID(tlsConn)
 	if err != nil {
-		log.Println("Error reading size:", err)
+		log.Println("Error during TLS handshake:", err)
+		conn.Close()
 		return
 	}
 
-	size := binary.BigEndian.Uint64(sizeBytes)
+	s.handleConnection(conn, peer)
+}
 
-	buffer := make([]byte, size)
-	n, err := conn.Read(buffer)
-	if err != nil {
-		log.Println("Error reading message:", err)
+// handleConnection serves the device peer. Devices that are not on the
+// allow-list may only ask to pair.
+func (s *Server) handleConnection(conn net.Conn, peer string) {
+	defer conn.Close()
+
+	if !s.peers.Trusted(peer) {
+		s.handleUntrusted(conn, peer)
 		return
 	}
+	log.Printf("Connection from device %s at %s\n", peer, conn.RemoteAddr())
 
-	eventInfo := string(buffer[:n])
-	eventType, filePath, err := parseEventInfo(eventInfo)
+	_, err := serverHello(conn, s.folders())
 	if err != nil {
-		log.Println("Error parsing event info:", err)
+		log.Println("Error during hello:", err)
 		return
 	}
 
-	switch eventType {
-	case watcher.Create:
-		err := s.handleCreateEvent(conn, filePath)
-		if err != nil {
-			log.Println("Error handling create event:", err)
-		}
-	case watcher.Modify:
-		err := s.handleModifyEvent(conn, filePath)
+	for {
+		f, err := ReadFrame(conn)
 		if err != nil {
-			log.Println("Error handling modify event:", err)
+			if err != io.EOF {
+				log.Println("Error reading message:", err)
+			}
+			return
 		}
-	case watcher.Delete:
-		err := s.handleDeleteEvent(filePath)
-		if err != nil {
-			log.Println("Error handling delete event:", err)
+
+		switch f.Type {
+		case MsgIndexRequest:
+			err = writeMessage(conn, MsgIndex, s.sharedIndex())
+			if err != nil {
+				log.Println("Error sending index:", err)
+				return
+			}
+		case MsgFileRequest:
+			var req FileRequest
+			err = decodeFrame(f, MsgFileRequest, &req)
+			if err == nil {
+				err = s.sendFile(conn, req.Path)
+			}
+			if err != nil {
+				log.Println("Error answering file request:", err)
+				_ = writeError(conn, err)
+				return
+			}
+		case MsgPairRequest:
+			// the other side confirming the pairing we already accepted
+			err = writeMessage(conn, MsgAck, nil)
+			if err != nil {
+				log.Println("Error sending ack:", err)
+				return
+			}
+		default:
+			var header FileHeader
+			err = decodeFrame(f, MsgFileHeader, &header)
+			if err != nil {
+				log.Println("Error decoding file header:", err)
+				_ = writeError(conn, err)
+				return
+			}
+
+			err = s.handleFile(conn, &header)
+			if err != nil {
+				_ = writeError(conn, err)
+				return
+			}
+
+			err = writeMessage(conn, MsgAck, nil)
+			if err != nil {
+				log.Println("Error sending ack:", err)
+				return
+			}
 		}
-	default:
-		log.Printf("Unknown event type: %d", eventType)
 	}
+}
 
+// sharedIndex is our index without the entries we ignore.
+func (s *Server) sharedIndex() []*index.FileInfo {
+	files := s.idx.List()
+	shared := files[:0]
+	for _, f := range files {
+		if !s.ignores.Match(f.Path, f.Dir) {
+			shared = append(shared, f)
+		}
+	}
+	return shared
 }
 
-func parseEventInfo(info string) (watcher.EventType, string, error) {
-	parts := strings.SplitN(info, ":", 2)
-	if len(parts) != 2 {
-		return 0, "", errors.New("invalid event info")
+// sendFile answers a file request with our current copy of relPath, or with
+// a delete header if we no longer have it.
+func (s *Server) sendFile(conn io.ReadWriter, relPath string) error {
+	filePath, err := resolvePath(s.root, relPath)
+	if err != nil {
+		log.Printf("Rejected path %q: %s\n", relPath, err)
+		return err
+	}
+
+	if s.ignores.Match(relPath, false) {
+		log.Printf("Rejected path %q: %s\n", relPath, ErrIgnored)
+		return ErrIgnored
+	}
+
+	fi, err := s.idx.Update(relPath)
+	if err != nil {
+		return err
+	}
+
+	if fi == nil || fi.Deleted {
+		header := FileHeader{EventType: watcher.Delete, Path: relPath}
+		if fi != nil {
+			header.Vector = fi.Vector
+			header.ModTime = fi.ModTime
+			header.ModifiedBy = fi.ModifiedBy
+			header.Dir = fi.Dir
+		}
+		return writeMessage(conn, MsgFileHeader, header)
+	}
+
+	if fi.Dir {
+		return writeMessage(conn, MsgFileHeader, FileHeader{
+			EventType:  watcher.Create,
+			Path:       relPath,
+			Dir:        true,
+			Mode:       fi.Mode,
+			Vector:     fi.Vector,
+			ModTime:    fi.ModTime,
+			ModifiedBy: fi.ModifiedBy,
+		})
 	}
 
-	eventType, err := strconv.Atoi(parts[0])
+	err = writeMessage(conn, MsgFileHeader, FileHeader{
+		EventType:  watcher.Create,
+		Path:       relPath,
+		Size:       fi.Size,
+		Hash:       fi.Hash,
+		Vector:     fi.Vector,
+		ModTime:    fi.ModTime,
+		ModifiedBy: fi.ModifiedBy,
+		Resume:     true,
+	})
 	if err != nil {
-		return 0, "", errors.New("invalid event type")
+		return err
 	}
 
-	return watcher.EventType(eventType), parts[1], nil
+	return streamResumable(conn, filePath, fi.Size, s.conf.Transfer.BufferSize)
 }
 
-func (s *Server) handleCreateEvent(conn net.Conn, filePath string) error {
-	log.Println("Received file create event for:", filePath)
+type relation int
+
+const (
+	fastForward relation = iota
+	upToDate
+	outdated
+	concurrent
+)
+
+func (r relation) String() string {
+	switch r {
+	case fastForward:
+		return "fast-forward"
+	case upToDate:
+		return "up to date"
+	case outdated:
+		return "outdated"
+	default:
+		return "concurrent"
+	}
+}
+
+// relate compares an incoming change with what we have locally. Only a
+// change made concurrently with ours is a conflict; everything that
+// descends from our version is applied as is.
+func relate(local *index.FileInfo, header *FileHeader) relation {
+	if local == nil {
+		return fastForward
+	}
+
+	remoteDeleted := header.EventType == watcher.Delete
+	if local.Deleted == remoteDeleted && (remoteDeleted || local.Hash == header.Hash) {
+		return upToDate
+	}
+
+	switch local.Vector.Compare(header.Vector) {
+	case index.Before:
+		return fastForward
+	case index.After:
+		return outdated
+	default:
+		if local.Deleted {
+			// a concurrent edit wins over our deletion, there is nothing to lose
+			return fastForward
+		}
+		return concurrent
+	}
+}
 
-	file, err := os.Create(filePath)
+func (s *Server) handleFile(conn io.ReadWriter, header *FileHeader) error {
+	filePath, err := resolvePath(s.root, header.Path)
 	if err != nil {
-		log.Println("Error creating file:", err)
+		log.Printf("Rejected path %q: %s\n", header.Path, err)
 		return err
 	}
-	defer file.Close()
 
-	buf := make([]byte, s.conf.Transfer.BufferSize)
-	for {
-		n, err := conn.Read(buf)
-		if err != nil {
-			if err != io.EOF {
-				log.Println("Error reading from connection:", err)
+	if s.ignores.Match(header.Path, header.Dir) {
+		log.Printf("Rejected path %q: %s\n", header.Path, ErrIgnored)
+		return ErrIgnored
+	}
+
+	if header.EventType == watcher.Rename {
+		return s.handleRename(conn, filePath, header)
+	}
+
+	if header.Dir && header.EventType == watcher.Delete {
+		return s.handleDirDelete(header)
+	}
+
+	// pick up local changes the watcher has not reported yet
+	local, err := s.idx.Update(header.Path)
+	if err != nil {
+		log.Printf("Error indexing %s: %s\n", header.Path, err)
+		return err
+	}
+
+	rel := relate(local, header)
+	switch rel {
+	case upToDate, outdated:
+		log.Printf("Skipping %s, local copy is %s\n", header.Path, rel)
+		if header.EventType != watcher.Delete && !header.Dir {
+			err := skipContent(conn, header, filePath)
+			if err != nil {
 				return err
 			}
-			return nil
 		}
 
-		_, err = file.Write(buf[:n])
+		if rel == upToDate {
+			_, err = s.idx.Merge(header.Path, header.FileInfo())
+		}
+		return err
+	case concurrent:
+		// directories have no content that could conflict
+		if !header.Dir {
+			return s.handleConflict(conn, filePath, local, header)
+		}
+	}
+
+	exists := local != nil && !local.Deleted
+	switch header.EventType {
+	case watcher.Create, watcher.Modify:
+		if header.Dir {
+			err = s.makeDir(filePath, header)
+		} else if exists {
+			err = s.handleModifyEvent(conn, filePath, header)
+		} else {
+			err = s.handleCreateEvent(conn, filePath, header)
+		}
 		if err != nil {
-			log.Println("Error writing to file:", err)
+			log.Println("Error handling file event:", err)
 			return err
 		}
+	case watcher.Delete:
+		if exists {
+			err = s.handleDeleteEvent(filePath, header)
+			if err != nil {
+				log.Println("Error handling delete event:", err)
+				return err
+			}
+		}
+	default:
+		log.Printf("Unknown event type: %d", header.EventType)
+		return fmt.Errorf("unknown event type: %d", header.EventType)
 	}
+
+	_, err = s.idx.Merge(header.Path, header.FileInfo())
+	if err != nil {
+		log.Printf("Error indexing %s: %s\n", header.Path, err)
+	}
+
+	return nil
 }
 
-func (s *Server) handleModifyEvent(conn net.Conn, filePath string) error {
+func (s *Server) handleCreateEvent(conn io.ReadWriter, filePath string, header *FileHeader) error {
+	log.Println("Received file create event for:", filePath)
+
+	return s.receiveFile(conn, filePath, header)
+}
+
+func (s *Server) handleModifyEvent(conn io.ReadWriter, filePath string, header *FileHeader) error {
 	log.Println("Received file modify event for:", filePath)
 
-	err := s.checkConsistency(
-		func() error {
-			if _, err := os.Stat(filePath); err == nil {
-				backupPath := filePath + ".backup"
-				log.Println("Backing up existing file to:", backupPath)
-
-				srcFile, err := os.Open(filePath)
-				if err != nil {
-					log.Println("Error opening source file for backup:", err)
-					return err
-				}
-				defer srcFile.Close()
-
-				destFile, err := os.Create(backupPath)
-				if err != nil {
-					log.Println("Error creating backup file:", err)
-					return err
-				}
-				defer destFile.Close()
-
-				if _, err := io.Copy(destFile, srcFile); err != nil {
-					log.Println("Error copying file contents to backup:", err)
-					return err
-				}
-
-				log.Println("Backup completed successfully")
-
-				file, err := os.Create(filePath)
-				if err != nil {
-					log.Println("Error creating file:", err)
-					return err
-				}
-
-				defer file.Close()
-			}
+	return s.receiveFile(conn, filePath, header)
+}
 
-			return nil
-		},
-		func() error {
-			log.Println("Overwriting existing file if it exists:", filePath)
-			return nil
-		},
-	)
+// handleConflict applies a change that was made concurrently with a local
+// one, as decided by the server's ConflictResolver.
+func (s *Server) handleConflict(conn io.ReadWriter, filePath string, local *index.FileInfo, header *FileHeader) error {
+	remote := header.FileInfo()
+	deleted := header.EventType == watcher.Delete
 
-	if err != nil {
-		return err
+	if s.resolver == nil {
+		log.Println("Invalid consistency option:", s.conf.Transfer.Consistency.OnConflict)
+		return s.resolverErr
 	}
 
-	file, err := os.OpenFile(filePath, os.O_WRONLY|os.O_TRUNC, 0644)
-	if err != nil {
-		log.Println("Error opening file:", err)
-		return err
+	decision := s.resolver.Resolve(local, remote)
+	merger, ok := s.resolver.(Merger)
+	if decision == Merge && (!ok || deleted) {
+		decision = KeepBoth
 	}
-	defer file.Close()
 
-	buf := make([]byte, s.conf.Transfer.BufferSize)
-	for {
-		n, err := conn.Read(buf)
-		if err != nil {
-			if err != io.EOF {
-				log.Println("Error reading from connection:", err)
+	log.Printf("Concurrent change of %s, resolved with %s\n", header.Path, decision)
+
+	var err error
+	switch decision {
+	case KeepLocal:
+		if !deleted {
+			err = skipContent(conn, header, filePath)
+			if err != nil {
 				return err
 			}
-			break
 		}
 
-		if n == 0 {
-			log.Println("No more data to read. Ending loop.")
-			break
+		_, err = s.idx.Supersede(header.Path, remote)
+		return err
+	case Merge:
+		err = s.mergeFile(conn, filePath, header, merger)
+		if err != nil {
+			log.Println("Error merging file:", err)
+			return err
 		}
 
-		if n > 0 {
-			_, err = file.Write(buf[:n])
-			if err != nil {
-				log.Println("Error writing to file:", err)
-				return err
-			}
+		_, err = s.idx.Supersede(header.Path, remote)
+		return err
+	case KeepBoth:
+		_, err = s.keepConflictCopy(filePath, header.Path, deleted)
+		if err == nil && !deleted {
+			err = s.receiveFile(conn, filePath, header)
+		}
+	case TakeRemote:
+		if deleted {
+			err = s.removeFile(filePath, header.Path)
+		} else {
+			err = s.receiveFile(conn, filePath, header)
 		}
+	default:
+		err = fmt.Errorf("unknown conflict decision: %s", decision)
+	}
+
+	if err != nil {
+		log.Println("Error resolving conflict:", err)
+		return err
+	}
+
+	_, err = s.idx.Merge(header.Path, remote)
+	return err
+}
+
+// mergeFile receives the remote copy into a temporary file and replaces
+// filePath with what merger makes of both copies.
+func (s *Server) mergeFile(conn io.ReadWriter, filePath string, header *FileHeader, merger Merger) error {
+	remote, err := s.openReceiver(conn, filePath, header)
+	if err != nil {
+		return err
+	}
+
+	err = receiveContent(conn, header, filePath, remote)
+	if err != nil {
+		remote.Release()
+		return err
+	}
+	defer remote.Abort()
+
+	err = remote.Verify(header.Size, header.Hash)
+	if err != nil {
+		return err
+	}
+
+	_, err = remote.file.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	local, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer local.Close()
+
+	out, err := createAtomic(filePath)
+	if err != nil {
+		return err
+	}
+
+	err = merger.Merge(local, remote.file, out)
+	if err != nil {
+		out.Abort()
+		return err
+	}
+
+	s.inbound.Expect(header.Path)
+	defer s.inbound.Done(header.Path)
+
+	err = s.archive(header.Path)
+	if err != nil {
+		out.Abort()
+		return err
+	}
+
+	return out.Replace()
+}
+
+// receiveFile streams the incoming data into a temporary file and replaces
+// filePath with it once the transfer is complete.
+func (s *Server) receiveFile(conn io.ReadWriter, filePath string, header *FileHeader) error {
+	err := os.MkdirAll(filepath.Dir(filePath), 0755)
+	if err != nil {
+		log.Println("Error creating parent directory:", err)
+		return err
+	}
+
+	file, err := s.openReceiver(conn, filePath, header)
+	if err != nil {
+		log.Println("Error creating temporary file:", err)
+		return err
+	}
+
+	err = receiveContent(conn, header, filePath, file)
+	if err != nil {
+		log.Println("Error receiving file data:", err)
+		file.Release()
+		return err
+	}
+
+	err = file.Verify(header.Size, header.Hash)
+	if err != nil {
+		log.Println("Error verifying file:", err)
+		file.Abort()
+		return err
+	}
+
+	s.inbound.Expect(header.Path)
+	defer s.inbound.Done(header.Path)
+
+	err = s.archive(header.Path)
+	if err != nil {
+		file.Abort()
+		return err
+	}
+
+	err = file.Replace()
+	if err != nil {
+		log.Println("Error committing file:", err)
+		return err
 	}
 
 	return nil
 }
 
-func (s *Server) handleDeleteEvent(filePath string) error {
+func (s *Server) handleDeleteEvent(filePath string, header *FileHeader) error {
 	log.Println("Received file delete event for:", filePath)
 
-	err := s.checkConsistency(
-		func() error {
-			if _, err := os.Stat(filePath); err == nil {
-				backupPath := filePath + ".backup"
-				log.Println("Backing up existing file to:", backupPath)
-
-				srcFile, err := os.Open(filePath)
-				if err != nil {
-					log.Println("Error opening source file for backup:", err)
-					return err
-				}
-				defer srcFile.Close()
-
-				destFile, err := os.Create(backupPath)
-				if err != nil {
-					log.Println("Error creating backup file:", err)
-					return err
-				}
-				defer destFile.Close()
-
-				if _, err := io.Copy(destFile, srcFile); err != nil {
-					log.Println("Error copying file contents to backup:", err)
-					return err
-				}
-
-				log.Println("Backup completed successfully")
-
-				file, err := os.Create(filePath)
-				if err != nil {
-					log.Println("Error creating file:", err)
-					return err
-				}
-
-				defer file.Close()
-			}
+	return s.removeFile(filePath, header.Path)
+}
 
-			return nil
-		},
-		func() error {
-			log.Println("Overwriting existing file if it exists:", filePath)
-			return nil
-		},
-	)
+// handleRename moves our copy of the old path to the new one without any
+// data being sent, if it has the content that was renamed and nothing is in
+// the way. Otherwise the rename is applied as the removal of the old path and
+// the creation of the new one, with the content sent as usual.
+func (s *Server) handleRename(conn io.ReadWriter, filePath string, header *FileHeader) error {
+	fromPath, err := resolvePath(s.root, header.From)
+	if err != nil {
+		log.Printf("Rejected path %q: %s\n", header.From, err)
+		return err
+	}
+
+	var from *index.FileInfo
+	if !s.ignores.Match(header.From, false) {
+		from, err = s.idx.Update(header.From)
+		if err != nil {
+			log.Printf("Error indexing %s: %s\n", header.From, err)
+			return err
+		}
+	}
 
+	local, err := s.idx.Update(header.Path)
 	if err != nil {
+		log.Printf("Error indexing %s: %s\n", header.Path, err)
 		return err
 	}
 
-	err = os.Remove(filePath)
+	if from == nil || from.Deleted || from.Hash != header.Hash || (local != nil && !local.Deleted) {
+		return s.applyRenameAsCopy(conn, from, header)
+	}
+
+	log.Printf("Received rename of %s to %s\n", fromPath, filePath)
+
+	err = os.MkdirAll(filepath.Dir(filePath), 0755)
+	if err != nil {
+		log.Println("Error creating parent directory:", err)
+		return err
+	}
+
+	s.inbound.Expect(header.From)
+	s.inbound.Expect(header.Path)
+	err = os.Rename(fromPath, filePath)
+	s.inbound.Done(header.From)
+	s.inbound.Done(header.Path)
+	if err != nil {
+		log.Println("Error renaming file:", err)
+		return err
+	}
+
+	// tell the sender we already have all of the content
+	err = skipContent(conn, header, filePath)
 	if err != nil {
-		log.Println("Error deleting file:", err)
 		return err
 	}
 
+	_, err = s.idx.Merge(header.From, header.FromInfo())
+	if err != nil {
+		log.Printf("Error indexing %s: %s\n", header.From, err)
+	}
+
+	_, err = s.idx.Merge(header.Path, header.FileInfo())
+	if err != nil {
+		log.Printf("Error indexing %s: %s\n", header.Path, err)
+	}
+
 	return nil
 }
 
-func (s *Server) checkConsistency(backupAndCreate, overwrite func() error) error {
-	switch s.conf.Transfer.Consistency.OnConflict {
-	case "backupAndCreate":
-		err := backupAndCreate()
+// applyRenameAsCopy applies a rename that cannot be done locally as the
+// removal of the old path and the creation of the new one.
+func (s *Server) applyRenameAsCopy(conn io.ReadWriter, from *index.FileInfo, header *FileHeader) error {
+	if from != nil {
+		err := s.handleFile(nil, &FileHeader{
+			EventType:  watcher.Delete,
+			Path:       header.From,
+			Vector:     header.FromVector,
+			ModTime:    header.ModTime,
+			ModifiedBy: header.ModifiedBy,
+		})
 		if err != nil {
 			return err
 		}
-	case "overwrite":
-		err := overwrite()
+	}
+
+	create := *header
+	create.EventType = watcher.Create
+	create.From = ""
+	create.FromVector = nil
+	return s.handleFile(conn, &create)
+}
+
+// makeDir creates a directory received from a peer with its mode, or
+// updates the mode of the one we have.
+func (s *Server) makeDir(filePath string, header *FileHeader) error {
+	log.Println("Received directory event for:", filePath)
+
+	perm := header.Mode.Perm()
+	if perm == 0 {
+		perm = 0755
+	}
+
+	s.inbound.Expect(header.Path)
+	defer s.inbound.Done(header.Path)
+
+	err := os.MkdirAll(filePath, perm)
+	if err != nil {
+		return err
+	}
+
+	return os.Chmod(filePath, perm)
+}
+
+// handleDirDelete removes a directory deleted by a peer along with its
+// content, as far as that is in sync with what the peer deleted. Files
+// changed or added locally since are kept, and so are the directories that
+// still hold them.
+func (s *Server) handleDirDelete(header *FileHeader) error {
+	log.Println("Received directory delete event for:", header.Path)
+
+	prefix := header.Path + "/"
+	tombstones := []*index.FileInfo{header.FileInfo()}
+	for _, c := range header.Children {
+		if strings.HasPrefix(c.Path, prefix) && c.Deleted {
+			tombstones = append(tombstones, c)
+		}
+	}
+
+	// content first, then the directories holding it
+	sort.Slice(tombstones, func(a, b int) bool {
+		return tombstones[a].Path > tombstones[b].Path
+	})
+
+	for _, t := range tombstones {
+		if s.ignores.Match(t.Path, t.Dir) {
+			continue
+		}
+
+		err := s.removeInSync(t)
+		if err != nil {
+			log.Printf("Error deleting %s: %s\n", t.Path, err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// removeInSync removes the path of the tombstone t if our copy is one the
+// peer had seen when deleting it. A directory is removed once it is empty.
+func (s *Server) removeInSync(t *index.FileInfo) error {
+	filePath, err := resolvePath(s.root, t.Path)
+	if err != nil {
+		return err
+	}
+
+	local, err := s.idx.Update(t.Path)
+	if err != nil {
+		return err
+	}
+
+	if local == nil {
+		return nil
+	}
+
+	switch {
+	case local.Deleted:
+	case local.Dir:
+		entries, err := os.ReadDir(filePath)
+		if err != nil {
+			return err
+		}
+
+		if len(entries) > 0 {
+			log.Printf("Keeping %s, it still holds local changes\n", t.Path)
+			_, err = s.idx.Supersede(t.Path, t)
+			return err
+		}
+
+		s.inbound.Expect(t.Path)
+		err = os.Remove(filePath)
+		s.inbound.Done(t.Path)
 		if err != nil {
 			return err
 		}
 	default:
-		log.Println("Invalid consistency option:", s.conf.Transfer.Consistency)
-		return fmt.Errorf("invalid consistency option: %s", s.conf.Transfer.Consistency)
+		rel := local.Vector.Compare(t.Vector)
+		if rel != index.Before && rel != index.Equal {
+			log.Printf("Keeping %s, it was changed locally\n", t.Path)
+			return nil
+		}
+
+		err = s.removeFile(filePath, t.Path)
+		if err != nil {
+			return err
+		}
 	}
+
+	_, err = s.idx.Merge(t.Path, t)
+	return err
+}
+
+// removeFile deletes filePath, or moves it into the version history when
+// versioning is enabled.
+func (s *Server) removeFile(filePath, relPath string) error {
+	s.inbound.Expect(relPath)
+	defer s.inbound.Done(relPath)
+
+	var err error
+	if s.versioning() {
+		err = s.versioner.Archive(relPath)
+	} else {
+		err = os.Remove(filePath)
+	}
+	if err != nil {
+		log.Println("Error deleting file:", err)
+		return err
+	}
+
 	return nil
 }
+
+// archive adds the current content of relPath to the version history before
+// it is replaced. The file stays in place until the new content is renamed
+// over it. It does nothing when versioning is disabled.
+func (s *Server) archive(relPath string) error {
+	if !s.versioning() {
+		return nil
+	}
+
+	err := s.versioner.Keep(relPath)
+	if err != nil {
+		log.Println("Error archiving old version:", err)
+	}
+	return err
+}
+
+func (s *Server) versioning() bool {
+	return s.versioner != nil && s.versioner.Enabled()
+}
+
+// folders returns the IDs of the folders we share.
+func (s *Server) folders() []string {
+	return []string{s.conf.Watcher.FolderID}
+}
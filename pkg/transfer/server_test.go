@@ -1,10 +1,18 @@
 package transfer
 
 import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
 	"github.com/hippo-an/sync-net/pkg/config"
+	"github.com/hippo-an/sync-net/pkg/discovery"
+	"github.com/hippo-an/sync-net/pkg/identity"
+	"github.com/hippo-an/sync-net/pkg/index"
+	"github.com/hippo-an/sync-net/pkg/trust"
+	"github.com/hippo-an/sync-net/pkg/versioning"
 	"github.com/hippo-an/sync-net/pkg/watcher"
-	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"io"
 	"net"
 	"os"
 	"path/filepath"
@@ -15,6 +23,8 @@ import (
 const (
 	backupAndCreate = "backupAndCreate"
 	overwrite       = "overwrite"
+	// testPeerID is the trusted device in-memory connections are served as.
+	testPeerID = "TESTPEER"
 )
 
 func getConfig(onConflict string) (*config.Config, error) {
@@ -25,13 +35,77 @@ func getConfig(onConflict string) (*config.Config, error) {
 	return conf, err
 }
 
+// newTestServer creates a server with an index and an allow-list kept in a
+// temporary state directory.
+func newTestServer(t *testing.T, conf *config.Config) *Server {
+	t.Helper()
+
+	conf.Node.StateDir = t.TempDir()
+	id := newTestIdentity(t)
+	idx := openTestIndex(t, conf, id.DeviceID)
+
+	return NewServer(conf, idx, id, newTestTrust(t, conf))
+}
+
+// openTestIndex opens an index that is saved before the test's temporary
+// directories are removed.
+func openTestIndex(t *testing.T, conf *config.Config, device string) *index.Index {
+	t.Helper()
+
+	idx, err := index.Open(conf, device, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, idx.Flush()) })
+	return idx
+}
+
+// newTestTrust opens an allow-list that only holds testPeerID.
+func newTestTrust(t *testing.T, conf *config.Config) *trust.Store {
+	t.Helper()
+
+	peers, err := trust.Open(conf)
+	require.NoError(t, err)
+	require.NoError(t, peers.Add(testPeerID, ""))
+	return peers
+}
+
+func newTestIdentity(t *testing.T) *identity.Identity {
+	t.Helper()
+
+	id, err := identity.New()
+	require.NoError(t, err)
+	return id
+}
+
+func requireConflictCopy(t *testing.T, filePath string) string {
+	t.Helper()
+
+	copies, err := conflictCopies(filePath)
+	require.NoError(t, err)
+	require.Len(t, copies, 1)
+	return copies[0]
+}
+
+func digestOf(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+func sendData(t *testing.T, w io.Writer, content []byte) {
+	t.Helper()
+
+	err := WriteFrame(w, MsgData, content)
+	require.NoError(t, err)
+	err = WriteFrame(w, MsgEndOfFile, nil)
+	require.NoError(t, err)
+}
+
 func TestHandleCreateEventWithOverwrite(t *testing.T) {
 	conf, err := getConfig(overwrite)
 
 	if err != nil {
 		require.NoError(t, err)
 	}
-	s := NewServer(conf)
+	s := newTestServer(t, conf)
 	tempDir, err := os.MkdirTemp("", "server-test")
 	require.NoError(t, err)
 	defer os.RemoveAll(tempDir)
@@ -52,7 +126,7 @@ func TestHandleCreateEventWithOverwrite(t *testing.T) {
 		require.NoError(t, err)
 		defer conn.Close()
 
-		err = s.handleCreateEvent(conn, testFilePath)
+		err = s.handleCreateEvent(conn, testFilePath, &FileHeader{Size: int64(len(testContent)), Hash: digestOf(testContent)})
 		require.NoError(t, err)
 
 		data, err := os.ReadFile(testFilePath)
@@ -63,8 +137,7 @@ func TestHandleCreateEventWithOverwrite(t *testing.T) {
 	conn, err := net.Dial("tcp", listener.Addr().String())
 	require.NoError(t, err)
 
-	_, err = conn.Write(testContent)
-	require.NoError(t, err)
+	sendData(t, conn, testContent)
 	conn.Close()
 	wg.Wait()
 }
@@ -76,7 +149,7 @@ func TestHandleCreateEventWithBackup(t *testing.T) {
 		require.NoError(t, err)
 	}
 
-	s := NewServer(conf)
+	s := newTestServer(t, conf)
 	tempDir, err := os.MkdirTemp("", "server-test")
 	require.NoError(t, err)
 	defer os.RemoveAll(tempDir)
@@ -97,7 +170,7 @@ func TestHandleCreateEventWithBackup(t *testing.T) {
 		require.NoError(t, err)
 		defer conn.Close()
 
-		err = s.handleCreateEvent(conn, testFilePath)
+		err = s.handleCreateEvent(conn, testFilePath, &FileHeader{Size: int64(len(testContent)), Hash: digestOf(testContent)})
 		require.NoError(t, err)
 
 		data, err := os.ReadFile(testFilePath)
@@ -108,8 +181,7 @@ func TestHandleCreateEventWithBackup(t *testing.T) {
 	conn, err := net.Dial("tcp", listener.Addr().String())
 	require.NoError(t, err)
 
-	_, err = conn.Write(testContent)
-	require.NoError(t, err)
+	sendData(t, conn, testContent)
 	conn.Close()
 	wg.Wait()
 }
@@ -120,15 +192,16 @@ func TestHandleModifyEventWithOverwrite(t *testing.T) {
 	if err != nil {
 		require.NoError(t, err)
 	}
-	s := NewServer(conf)
-	tempDir, err := os.MkdirTemp("", "server-test")
-	require.NoError(t, err)
-	defer os.RemoveAll(tempDir)
+	tempDir := t.TempDir()
+	conf.Watcher.Path = tempDir
+	s := newTestServer(t, conf)
 
 	testFilePath := filepath.Join(tempDir, "TestHandleModifyEvent.txt")
 	testContent := []byte("This is a test file")
 	err = os.WriteFile(testFilePath, testContent, 0644)
 	require.NoError(t, err)
+	local, err := s.idx.Update("TestHandleModifyEvent.txt")
+	require.NoError(t, err)
 
 	listener, err := net.Listen("tcp", ":0")
 	require.NoError(t, err)
@@ -143,7 +216,7 @@ func TestHandleModifyEventWithOverwrite(t *testing.T) {
 		require.NoError(t, err)
 		defer conn.Close()
 
-		err = s.handleModifyEvent(conn, testFilePath)
+		err = s.handleConflict(conn, testFilePath, local, &FileHeader{EventType: watcher.Modify, Path: "TestHandleModifyEvent.txt", Size: int64(len("Modified content")), Hash: digestOf([]byte("Modified content"))})
 		require.NoError(t, err)
 
 		data, err := os.ReadFile(testFilePath)
@@ -154,8 +227,7 @@ func TestHandleModifyEventWithOverwrite(t *testing.T) {
 	conn, err := net.Dial("tcp", listener.Addr().String())
 	require.NoError(t, err)
 
-	_, err = conn.Write([]byte("Modified content"))
-	require.NoError(t, err)
+	sendData(t, conn, []byte("Modified content"))
 	conn.Close()
 	wg.Wait()
 }
@@ -166,10 +238,9 @@ func TestHandleModifyEventWithBackup(t *testing.T) {
 	if err != nil {
 		require.NoError(t, err)
 	}
-	s := NewServer(conf)
-	tempDir, err := os.MkdirTemp("", "server-test")
-	require.NoError(t, err)
-	defer os.RemoveAll(tempDir)
+	tempDir := t.TempDir()
+	conf.Watcher.Path = tempDir
+	s := newTestServer(t, conf)
 
 	originalText := "This is a test file"
 	modifiedText := "Modified content"
@@ -177,6 +248,8 @@ func TestHandleModifyEventWithBackup(t *testing.T) {
 	testContent := []byte(originalText)
 	err = os.WriteFile(testFilePath, testContent, 0644)
 	require.NoError(t, err)
+	local, err := s.idx.Update("TestHandleModifyEvent.txt")
+	require.NoError(t, err)
 
 	listener, err := net.Listen("tcp", ":0")
 	require.NoError(t, err)
@@ -191,14 +264,14 @@ func TestHandleModifyEventWithBackup(t *testing.T) {
 		require.NoError(t, err)
 		defer conn.Close()
 
-		err = s.handleModifyEvent(conn, testFilePath)
+		err = s.handleConflict(conn, testFilePath, local, &FileHeader{EventType: watcher.Modify, Path: "TestHandleModifyEvent.txt", Size: int64(len(modifiedText)), Hash: digestOf([]byte(modifiedText))})
 		require.NoError(t, err)
 
 		data, err := os.ReadFile(testFilePath)
 		require.NoError(t, err)
 		require.Equal(t, []byte(modifiedText), data)
 
-		data, err = os.ReadFile(testFilePath + ".backup")
+		data, err = os.ReadFile(requireConflictCopy(t, testFilePath))
 		require.NoError(t, err)
 		require.Equal(t, []byte(originalText), data)
 	}(&wg)
@@ -206,8 +279,7 @@ func TestHandleModifyEventWithBackup(t *testing.T) {
 	conn, err := net.Dial("tcp", listener.Addr().String())
 	require.NoError(t, err)
 
-	_, err = conn.Write([]byte(modifiedText))
-	require.NoError(t, err)
+	sendData(t, conn, []byte(modifiedText))
 	conn.Close()
 	wg.Wait()
 }
@@ -218,17 +290,18 @@ func TestHandleDeleteEventWithOverwrite(t *testing.T) {
 	if err != nil {
 		require.NoError(t, err)
 	}
-	s := NewServer(conf)
-	tempDir, err := os.MkdirTemp("", "server-test")
-	require.NoError(t, err)
-	defer os.RemoveAll(tempDir)
+	tempDir := t.TempDir()
+	conf.Watcher.Path = tempDir
+	s := newTestServer(t, conf)
 
 	testFilePath := filepath.Join(tempDir, "TestHandleDeleteEvent.txt")
 	testContent := []byte("This is a test file")
 	err = os.WriteFile(testFilePath, testContent, 0644)
 	require.NoError(t, err)
+	local, err := s.idx.Update("TestHandleDeleteEvent.txt")
+	require.NoError(t, err)
 
-	err = s.handleDeleteEvent(testFilePath)
+	err = s.handleConflict(nil, testFilePath, local, &FileHeader{EventType: watcher.Delete, Path: "TestHandleDeleteEvent.txt"})
 	require.NoError(t, err)
 
 	_, err = os.Stat(testFilePath)
@@ -241,35 +314,221 @@ func TestHandleDeleteEventWithBackup(t *testing.T) {
 	if err != nil {
 		require.NoError(t, err)
 	}
-	s := NewServer(conf)
-	tempDir, err := os.MkdirTemp("", "server-test")
-	require.NoError(t, err)
-	defer os.RemoveAll(tempDir)
+	tempDir := t.TempDir()
+	conf.Watcher.Path = tempDir
+	s := newTestServer(t, conf)
 
 	testFilePath := filepath.Join(tempDir, "TestHandleDeleteEvent.txt")
 	originalText := "This is a test file"
 	testContent := []byte(originalText)
 	err = os.WriteFile(testFilePath, testContent, 0644)
 	require.NoError(t, err)
+	local, err := s.idx.Update("TestHandleDeleteEvent.txt")
+	require.NoError(t, err)
 
-	err = s.handleDeleteEvent(testFilePath)
+	err = s.handleConflict(nil, testFilePath, local, &FileHeader{EventType: watcher.Delete, Path: "TestHandleDeleteEvent.txt"})
 	require.NoError(t, err)
 
 	_, err = os.Stat(testFilePath)
 	require.True(t, os.IsNotExist(err))
 
-	_, err = os.Stat(testFilePath + ".backup")
-	require.False(t, os.IsNotExist(err))
+	data, err := os.ReadFile(requireConflictCopy(t, testFilePath))
+	require.NoError(t, err)
+	require.Equal(t, testContent, data)
 }
 
-func TestParseEventInfo(t *testing.T) {
-	eventType, filePath, err := parseEventInfo("1:/test/file.txt")
-	require.Equal(t, watcher.EventType(1), eventType)
-	require.Equal(t, "/test/file.txt", filePath)
-	assert.NoError(t, err)
+func TestCorruptedTransferIsReportedToSender(t *testing.T) {
+	conf, err := getConfig(overwrite)
+	require.NoError(t, err)
+	dir := t.TempDir()
+	conf.Watcher.Path = dir
+	s := newTestServer(t, conf)
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go s.handleConnection(server, testPeerID)
+
+	_, err = clientHello(client)
+	require.NoError(t, err)
+
+	content := []byte("what the sender hashed")
+	err = writeMessage(client, MsgFileHeader, FileHeader{
+		EventType: watcher.Create,
+		Path:      "file.txt",
+		Size:      int64(len(content)),
+		Hash:      digestOf(content),
+	})
+	require.NoError(t, err)
+
+	sendData(t, client, []byte("what arrived on the wire"[:len(content)]))
 
-	eventType, filePath, err = parseEventInfo("invalid")
-	require.Equal(t, watcher.EventType(0), eventType)
-	require.Equal(t, "", filePath)
+	err = readMessage(client, MsgAck, nil)
+	var remoteErr *RemoteError
+	require.ErrorAs(t, err, &remoteErr)
+	require.Contains(t, remoteErr.Message, ErrHashMismatch.Error())
+
+	_, err = os.Stat(filepath.Join(dir, "file.txt"))
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestConflictPolicyOnlyAppliesToConcurrentEdits(t *testing.T) {
+	conf, err := getConfig(backupAndCreate)
+	require.NoError(t, err)
+	dir := t.TempDir()
+	conf.Watcher.Path = dir
+	s := newTestServer(t, conf)
+
+	testFilePath := filepath.Join(dir, "file.txt")
+	require.NoError(t, os.WriteFile(testFilePath, []byte("v1"), 0644))
+	local, err := s.idx.Update("file.txt")
+	require.NoError(t, err)
+
+	push := func(content string, vector index.Vector) error {
+		client, server := net.Pipe()
+		defer client.Close()
+		go s.handleConnection(server, testPeerID)
+
+		_, err := clientHello(client)
+		require.NoError(t, err)
+		err = writeMessage(client, MsgFileHeader, FileHeader{
+			EventType: watcher.Modify,
+			Path:      "file.txt",
+			Size:      int64(len(content)),
+			Hash:      digestOf([]byte(content)),
+			Vector:    vector,
+		})
+		require.NoError(t, err)
+		sendData(t, client, []byte(content))
+		return readMessage(client, MsgAck, nil)
+	}
+
+	// the peer edited on top of our version: fast-forward, no conflict copy
+	require.NoError(t, push("v2", local.Vector.Increment("peer")))
+	data, err := os.ReadFile(testFilePath)
+	require.NoError(t, err)
+	require.Equal(t, []byte("v2"), data)
+	copies, err := conflictCopies(testFilePath)
+	require.NoError(t, err)
+	require.Empty(t, copies)
+
+	// an old version is ignored
+	require.NoError(t, push("v1", local.Vector))
+	data, err = os.ReadFile(testFilePath)
+	require.NoError(t, err)
+	require.Equal(t, []byte("v2"), data)
+
+	// both sides edited: the configured policy kicks in
+	require.NoError(t, os.WriteFile(testFilePath, []byte("v3 local"), 0644))
+	current, err := s.idx.Update("file.txt")
+	require.NoError(t, err)
+	remote := current.Vector.Copy()
+	remote[s.idx.DeviceID()]--
+	remote = remote.Increment("peer")
+	require.Equal(t, index.Concurrent, current.Vector.Compare(remote))
+
+	require.NoError(t, push("v3 remote", remote))
+	data, err = os.ReadFile(testFilePath)
+	require.NoError(t, err)
+	require.Equal(t, []byte("v3 remote"), data)
+	data, err = os.ReadFile(requireConflictCopy(t, testFilePath))
+	require.NoError(t, err)
+	require.Equal(t, []byte("v3 local"), data)
+
+	merged, _ := s.idx.Get("file.txt")
+	require.Equal(t, index.After, merged.Vector.Compare(remote))
+}
+
+func TestVersioningKeepsReplacedAndDeletedContent(t *testing.T) {
+	conf, err := getConfig(overwrite)
+	require.NoError(t, err)
+	dir := t.TempDir()
+	conf.Watcher.Path = dir
+	conf.Node.StateDir = t.TempDir()
+	conf.Versioning.Type = "simple"
+	conf.Versioning.Keep = 5
+	id := newTestIdentity(t)
+	idx := openTestIndex(t, conf, id.DeviceID)
+	v, err := versioning.New(conf)
+	require.NoError(t, err)
+	s := NewServer(conf, idx, id, newTestTrust(t, conf), WithVersioner(v))
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "file.txt"), []byte("v1"), 0644))
+	local, err := s.idx.Update("file.txt")
+	require.NoError(t, err)
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go s.handleConnection(server, testPeerID)
+
+	_, err = clientHello(client)
+	require.NoError(t, err)
+	vector := local.Vector.Increment("peer")
+	err = writeMessage(client, MsgFileHeader, FileHeader{
+		EventType: watcher.Modify,
+		Path:      "file.txt",
+		Size:      2,
+		Hash:      digestOf([]byte("v2")),
+		Vector:    vector,
+	})
+	require.NoError(t, err)
+	sendData(t, client, []byte("v2"))
+	require.NoError(t, readMessage(client, MsgAck, nil))
+
+	err = writeMessage(client, MsgFileHeader, FileHeader{
+		EventType: watcher.Delete,
+		Path:      "file.txt",
+		Vector:    vector.Increment("peer"),
+	})
+	require.NoError(t, err)
+	require.NoError(t, readMessage(client, MsgAck, nil))
+
+	_, err = os.Stat(filepath.Join(dir, "file.txt"))
+	require.True(t, os.IsNotExist(err))
+
+	versions, err := v.List("file.txt")
+	require.NoError(t, err)
+	require.Len(t, versions, 2)
+	require.Equal(t, int64(2), versions[0].Size)
+
+	require.NoError(t, v.Restore("file.txt", versions[0].Time))
+	data, err := os.ReadFile(filepath.Join(dir, "file.txt"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("v1"), data)
+	requireNoTempFiles(t, dir)
+}
+
+func TestServerRequiresTLS(t *testing.T) {
+	conf, err := getConfig(overwrite)
+	require.NoError(t, err)
+	conf.Watcher.Path = t.TempDir()
+	s := newTestServer(t, conf)
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", s.id.ServerConfig())
+	require.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.accept(conn)
+		}
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = clientHello(conn)
 	require.Error(t, err)
+
+	_, port, err := net.SplitHostPort(listener.Addr().String())
+	require.NoError(t, err)
+	id := newTestIdentity(t)
+	peers := newTestTrust(t, conf)
+	require.NoError(t, peers.Add(s.id.DeviceID, ""))
+	require.NoError(t, s.peers.Add(id.DeviceID, ""))
+	secure, err := dialPeer(&discovery.ServerInfo{Id: s.id.DeviceID, Ip: "127.0.0.1", Port: port}, id, peers)
+	require.NoError(t, err)
+	secure.Close()
 }
@@ -0,0 +1,123 @@
+package transfer
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/hippo-an/sync-net/pkg/config"
+	"github.com/hippo-an/sync-net/pkg/discovery"
+	"github.com/hippo-an/sync-net/pkg/identity"
+	"log"
+	"net"
+	"time"
+)
+
+const probeTimeout = 10 * time.Second
+
+var ErrUnexpectedDevice = errors.New("unexpected device")
+
+// StaticPeers probes the peers listed in the staticPeers config directly,
+// for networks where broadcasts do not reach them. Reachable peers are
+// merged into the same registry as broadcast-discovered ones, and go offline
+// there like them once they stop answering.
+type StaticPeers struct {
+	conf *config.Config
+	s    *discovery.Server
+	id   *identity.Identity
+}
+
+func NewStaticPeers(conf *config.Config, s *discovery.Server, id *identity.Identity) *StaticPeers {
+	return &StaticPeers{
+		conf: conf,
+		s:    s,
+		id:   id,
+	}
+}
+
+// Run probes every static peer once per broadcast interval.
+func (p *StaticPeers) Run() {
+	if len(p.conf.Discovery.StaticPeers) == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(p.conf.Discovery.BroadcastInterval)
+	defer ticker.Stop()
+
+	for {
+		p.probeAll()
+		<-ticker.C
+	}
+}
+
+func (p *StaticPeers) probeAll() {
+	for _, sp := range p.conf.Discovery.StaticPeers {
+		err := p.probe(sp)
+		if err != nil {
+			log.Printf("Failed to probe static peer %s: %s\n", sp.Address, err)
+		}
+	}
+}
+
+// probe connects to the static peer and records it in the registry. A peer
+// that is already known keeps what it announced about itself.
+func (p *StaticPeers) probe(sp config.StaticPeer) error {
+	si, err := probePeer(sp, p.id)
+	if err != nil {
+		return err
+	}
+
+	if si.Id == p.id.DeviceID {
+		return nil
+	}
+
+	if o, ok := p.s.Peers.Get(si.Id); ok && o.Online {
+		si = o
+	}
+	si.UpdatedAt = time.Now()
+
+	p.s.Peers.Upsert(si)
+	return nil
+}
+
+// probePeer opens a TLS connection to a static peer and exchanges hellos to
+// learn its device ID and protocol version.
+func probePeer(sp config.StaticPeer, id *identity.Identity) (*discovery.ServerInfo, error) {
+	dialer := &net.Dialer{Timeout: probeTimeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", sp.Address, id.ClientConfig())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	err = conn.SetDeadline(time.Now().Add(probeTimeout))
+	if err != nil {
+		return nil, err
+	}
+
+	peer, err := identity.PeerID(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	if sp.DeviceID != "" && sp.DeviceID != peer {
+		return nil, fmt.Errorf("%w: %s is %s, expected %s", ErrUnexpectedDevice, sp.Address, peer, sp.DeviceID)
+	}
+
+	h, err := clientHello(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	host, port, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return nil, err
+	}
+
+	return &discovery.ServerInfo{
+		Id:      peer,
+		Ip:      host,
+		Port:    port,
+		Version: h.Version,
+		Folders: h.Folders,
+	}, nil
+}
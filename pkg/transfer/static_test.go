@@ -0,0 +1,51 @@
+package transfer
+
+import (
+	"github.com/hippo-an/sync-net/pkg/config"
+	"github.com/hippo-an/sync-net/pkg/discovery"
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+)
+
+func TestStaticPeersAreProbed(t *testing.T) {
+	local := newTestNode(t)
+	remote := newTestNode(t)
+	peer := remote.serve(t)
+	address := net.JoinHostPort(peer.Ip, peer.Port)
+
+	s := discoveryOf()
+	events := s.Peers.Subscribe()
+	p := NewStaticPeers(local.conf, s, local.ts.id)
+
+	// probing works before pairing, it only learns who is there
+	require.NoError(t, p.probe(config.StaticPeer{Address: address}))
+	e := <-events
+	require.Equal(t, discovery.PeerJoined, e.Type)
+	require.Equal(t, remote.ts.id.DeviceID, e.Peer.Id)
+	require.Equal(t, "127.0.0.1", e.Peer.Ip)
+	require.Equal(t, peer.Port, e.Peer.Port)
+	require.Equal(t, ProtocolVersion, e.Peer.Version)
+	require.Equal(t, []string{remote.conf.Watcher.FolderID}, e.Peer.Folders)
+
+	// a known peer keeps what it announced
+	s.Peers.Upsert(&discovery.ServerInfo{Id: remote.ts.id.DeviceID, Name: "remote", Ip: "127.0.0.1", Port: peer.Port})
+	require.Equal(t, discovery.PeerChanged, (<-events).Type)
+	require.NoError(t, p.probe(config.StaticPeer{Address: address, DeviceID: remote.ts.id.DeviceID}))
+	si, ok := s.Peers.Get(remote.ts.id.DeviceID)
+	require.True(t, ok)
+	require.Equal(t, "remote", si.Name)
+}
+
+func TestStaticPeerMustBeExpectedDevice(t *testing.T) {
+	local := newTestNode(t)
+	remote := newTestNode(t)
+	peer := remote.serve(t)
+
+	s := discoveryOf()
+	p := NewStaticPeers(local.conf, s, local.ts.id)
+
+	err := p.probe(config.StaticPeer{Address: net.JoinHostPort(peer.Ip, peer.Port), DeviceID: local.ts.id.DeviceID})
+	require.ErrorIs(t, err, ErrUnexpectedDevice)
+	require.Empty(t, s.Peers.List())
+}
@@ -0,0 +1,262 @@
+package transfer
+
+import (
+	"errors"
+	"fmt"
+	"github.com/hippo-an/sync-net/pkg/config"
+	"github.com/hippo-an/sync-net/pkg/discovery"
+	"github.com/hippo-an/sync-net/pkg/index"
+	"github.com/hippo-an/sync-net/pkg/watcher"
+	"io"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Syncer brings the local folder up to date with a peer when it is
+// discovered. Both nodes run one, so each side only pulls what it is
+// missing and the transfer server of the other side serves the data.
+type Syncer struct {
+	conf *config.Config
+	s    *discovery.Server
+	ts   *Server
+	idx  *index.Index
+	// events is subscribed to when the syncer is created, so that peers
+	// found while discovery starts up are not missed.
+	events <-chan discovery.PeerEvent
+
+	mu sync.Mutex
+	// unsynced holds the online peers a sync failed with, for instance
+	// because they were not paired yet or did not share our folder when
+	// they came online.
+	unsynced map[string]bool
+}
+
+var ErrFolderNotShared = errors.New("folder not shared")
+
+type syncAction int
+
+const (
+	skip syncAction = iota
+	pull
+	deleteLocal
+)
+
+func NewSyncer(conf *config.Config, s *discovery.Server, ts *Server) *Syncer {
+	sy := &Syncer{
+		conf: conf,
+		s:    s,
+		ts:   ts,
+		idx:  ts.idx,
+
+		unsynced: map[string]bool{},
+	}
+
+	if s != nil {
+		sy.events = s.Peers.Subscribe()
+	}
+
+	return sy
+}
+
+// Run syncs with every peer that comes online. A sync that failed is tried
+// again when the peer changes and once per broadcast interval, so that a
+// peer paired while it was online gets its initial sync as well.
+func (sy *Syncer) Run() {
+	ticker := time.NewTicker(sy.conf.Discovery.BroadcastInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case event, ok := <-sy.events:
+			if !ok {
+				return
+			}
+
+			switch event.Type {
+			case discovery.PeerJoined:
+				go sy.syncPeer(event.Peer)
+			case discovery.PeerChanged:
+				if sy.takeUnsynced(event.Peer.Id) {
+					go sy.syncPeer(event.Peer)
+				}
+			case discovery.PeerLeft:
+				sy.takeUnsynced(event.Peer.Id)
+			}
+		case <-ticker.C:
+			sy.retry()
+		}
+	}
+}
+
+// syncPeer syncs with p and remembers it for another attempt if that
+// failed.
+func (sy *Syncer) syncPeer(p *discovery.ServerInfo) {
+	err := sy.SyncWith(p)
+	if err == nil {
+		return
+	}
+
+	log.Printf("Failed to sync with server %+v: %s\n", p, err)
+	sy.mu.Lock()
+	sy.unsynced[p.Id] = true
+	sy.mu.Unlock()
+}
+
+// retry syncs again with the online peers a sync failed with, as soon as
+// they are trusted. Peers that do not share our folder are synced with once
+// they announce it.
+func (sy *Syncer) retry() {
+	sy.mu.Lock()
+	ids := make([]string, 0, len(sy.unsynced))
+	for id := range sy.unsynced {
+		ids = append(ids, id)
+	}
+	sy.mu.Unlock()
+
+	for _, id := range ids {
+		p, ok := sy.s.Peers.Get(id)
+		if !ok || !p.Online {
+			sy.takeUnsynced(id)
+			continue
+		}
+
+		if !p.Shares(sy.conf.Watcher.FolderID) {
+			continue
+		}
+
+		if sy.ts.peers.Trusted(id) && sy.takeUnsynced(id) {
+			go sy.syncPeer(p)
+		}
+	}
+}
+
+// takeUnsynced reports whether a sync with the peer id failed and is not
+// being retried yet, and forgets about it.
+func (sy *Syncer) takeUnsynced(id string) bool {
+	sy.mu.Lock()
+	defer sy.mu.Unlock()
+
+	ok := sy.unsynced[id]
+	delete(sy.unsynced, id)
+	return ok
+}
+
+// SyncWith fetches the peer's index, pulls every file that is missing or
+// stale locally and applies the peer's tombstones. Directories are created
+// before their content and deleted after it. Peers that do not share our
+// folder are refused with ErrFolderNotShared.
+func (sy *Syncer) SyncWith(peer *discovery.ServerInfo) error {
+	if !peer.Shares(sy.conf.Watcher.FolderID) {
+		return fmt.Errorf("%w: %s shares %q", ErrFolderNotShared, peer.Id, peer.Folders)
+	}
+
+	conn, err := dialPeer(peer, sy.ts.id, sy.ts.peers)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	err = writeMessage(conn, MsgIndexRequest, nil)
+	if err != nil {
+		return err
+	}
+
+	var remote []*index.FileInfo
+	err = readMessage(conn, MsgIndex, &remote)
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(remote, func(a, b int) bool {
+		return remote[a].Path < remote[b].Path
+	})
+
+	pulled, deleted := 0, 0
+	var deletions []*index.FileInfo
+	for _, r := range remote {
+		if sy.ts.ignores.Match(r.Path, r.Dir) {
+			continue
+		}
+
+		local, _ := sy.idx.Get(r.Path)
+
+		switch compare(local, r) {
+		case pull:
+			err = sy.pull(conn, r.Path)
+			if err != nil {
+				return err
+			}
+			pulled++
+		case deleteLocal:
+			deletions = append(deletions, r)
+		}
+	}
+
+	for i := len(deletions) - 1; i >= 0; i-- {
+		r := deletions[i]
+		err = sy.ts.handleFile(nil, &FileHeader{
+			EventType:  watcher.Delete,
+			Path:       r.Path,
+			Vector:     r.Vector,
+			ModTime:    r.ModTime,
+			ModifiedBy: r.ModifiedBy,
+			Dir:        r.Dir,
+		})
+		if err != nil {
+			log.Printf("Failed to apply deletion of %s: %s\n", r.Path, err)
+			continue
+		}
+		deleted++
+	}
+
+	log.Printf("Synced with server %s: %d pulled, %d deleted\n", peer.Ip, pulled, deleted)
+	return sy.idx.Flush()
+}
+
+func (sy *Syncer) pull(conn io.ReadWriter, relPath string) error {
+	err := writeMessage(conn, MsgFileRequest, FileRequest{Path: relPath})
+	if err != nil {
+		return err
+	}
+
+	var header FileHeader
+	err = readMessage(conn, MsgFileHeader, &header)
+	if err != nil {
+		return err
+	}
+
+	if header.Path != relPath {
+		return ErrUnexpectedMessage
+	}
+
+	return sy.ts.handleFile(conn, &header)
+}
+
+// compare decides what to do with a remote entry given what we have
+// locally. Anything the remote has seen that we have not is fetched; the
+// transfer server then tells fast-forwards and conflicts apart.
+func compare(local, remote *index.FileInfo) syncAction {
+	if local == nil {
+		if remote.Deleted {
+			return skip
+		}
+		return pull
+	}
+
+	switch local.Vector.Compare(remote.Vector) {
+	case index.Before, index.Concurrent:
+	case index.Equal:
+		if local.Deleted == remote.Deleted && local.Hash == remote.Hash {
+			return skip
+		}
+	default:
+		return skip
+	}
+
+	if remote.Deleted {
+		return deleteLocal
+	}
+	return pull
+}
@@ -0,0 +1,304 @@
+package transfer
+
+import (
+	"crypto/tls"
+	"errors"
+	"github.com/hippo-an/sync-net/pkg/config"
+	"github.com/hippo-an/sync-net/pkg/discovery"
+	"github.com/hippo-an/sync-net/pkg/ignore"
+	"github.com/hippo-an/sync-net/pkg/index"
+	"github.com/hippo-an/sync-net/pkg/watcher"
+	"github.com/stretchr/testify/require"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testNode struct {
+	conf *config.Config
+	root string
+	idx  *index.Index
+	ts   *Server
+}
+
+func newTestNode(t *testing.T) *testNode {
+	t.Helper()
+
+	return newTestNodeAt(t, t.TempDir())
+}
+
+// newTestNodeAt creates a node syncing the existing directory root.
+func newTestNodeAt(t *testing.T, root string) *testNode {
+	t.Helper()
+
+	conf, err := getConfig(overwrite)
+	require.NoError(t, err)
+	conf.Watcher.Path = root
+	ts := newTestServer(t, conf)
+
+	return &testNode{
+		conf: conf,
+		root: conf.Watcher.Path,
+		idx:  ts.idx,
+		ts:   ts,
+	}
+}
+
+func (n *testNode) write(t *testing.T, name, content string) {
+	t.Helper()
+
+	p := filepath.Join(n.root, filepath.FromSlash(name))
+	require.NoError(t, os.MkdirAll(filepath.Dir(p), 0755))
+	require.NoError(t, os.WriteFile(p, []byte(content), 0644))
+	_, err := n.idx.Update(name)
+	require.NoError(t, err)
+}
+
+func (n *testNode) mkdir(t *testing.T, name string, perm os.FileMode) {
+	t.Helper()
+
+	p := filepath.Join(n.root, filepath.FromSlash(name))
+	require.NoError(t, os.MkdirAll(p, perm))
+	require.NoError(t, os.Chmod(p, perm))
+	_, err := n.idx.Update(name)
+	require.NoError(t, err)
+}
+
+func (n *testNode) remove(t *testing.T, name string) {
+	t.Helper()
+
+	require.NoError(t, os.Remove(filepath.Join(n.root, filepath.FromSlash(name))))
+	_, err := n.idx.MarkDeleted(name)
+	require.NoError(t, err)
+}
+
+func (n *testNode) read(t *testing.T, name string) string {
+	t.Helper()
+
+	data, err := os.ReadFile(filepath.Join(n.root, filepath.FromSlash(name)))
+	require.NoError(t, err)
+	return string(data)
+}
+
+// pair adds both nodes to each other's allow-list.
+func (n *testNode) pair(t *testing.T, other *testNode) {
+	t.Helper()
+
+	require.NoError(t, n.ts.peers.Add(other.ts.id.DeviceID, ""))
+	require.NoError(t, other.ts.peers.Add(n.ts.id.DeviceID, ""))
+}
+
+// serve runs the node's transfer server and returns it as a peer.
+func (n *testNode) serve(t *testing.T) *discovery.ServerInfo {
+	t.Helper()
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", n.ts.id.ServerConfig())
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go n.ts.accept(conn)
+		}
+	}()
+
+	_, port, err := net.SplitHostPort(listener.Addr().String())
+	require.NoError(t, err)
+
+	return &discovery.ServerInfo{Id: n.ts.id.DeviceID, Ip: "127.0.0.1", Port: port, Folders: n.ts.folders()}
+}
+
+func TestSyncWithPullsMissingAndStaleFiles(t *testing.T) {
+	local := newTestNode(t)
+	remote := newTestNode(t)
+	local.pair(t, remote)
+	peer := remote.serve(t)
+	syncer := NewSyncer(local.conf, nil, local.ts)
+
+	// shared history
+	remote.write(t, "stale.txt", "v1")
+	remote.write(t, "kept.txt", "v1")
+	remote.write(t, "gone.txt", "v1")
+	remote.write(t, "both.txt", "v1")
+	require.NoError(t, syncer.SyncWith(peer))
+	require.Equal(t, "v1", local.read(t, "stale.txt"))
+
+	remote.write(t, "dir/new.txt", "only on the remote")
+	remote.write(t, "stale.txt", "changed on the remote")
+	remote.remove(t, "gone.txt")
+	local.write(t, "kept.txt", "changed locally")
+	remote.write(t, "both.txt", "changed on the remote")
+	local.write(t, "both.txt", "changed locally")
+
+	require.NoError(t, syncer.SyncWith(peer))
+
+	require.Equal(t, "only on the remote", local.read(t, "dir/new.txt"))
+	require.Equal(t, "changed on the remote", local.read(t, "stale.txt"))
+	require.Equal(t, "changed locally", local.read(t, "kept.txt"))
+	// concurrent edit, resolved with the configured overwrite policy
+	require.Equal(t, "changed on the remote", local.read(t, "both.txt"))
+
+	_, err := os.Stat(filepath.Join(local.root, "gone.txt"))
+	require.True(t, os.IsNotExist(err))
+
+	f, ok := local.idx.Get("gone.txt")
+	require.True(t, ok)
+	require.True(t, f.Deleted)
+
+	for _, name := range []string{"dir/new.txt", "stale.txt", "gone.txt"} {
+		l, _ := local.idx.Get(name)
+		r, _ := remote.idx.Get(name)
+		require.Equal(t, index.Equal, l.Vector.Compare(r.Vector), name)
+	}
+
+	l, _ := local.idx.Get("both.txt")
+	r, _ := remote.idx.Get("both.txt")
+	require.Equal(t, index.After, l.Vector.Compare(r.Vector))
+}
+
+func TestSyncWithIsIdempotent(t *testing.T) {
+	local := newTestNode(t)
+	remote := newTestNode(t)
+	local.pair(t, remote)
+
+	remote.write(t, "a.txt", "a")
+
+	peer := remote.serve(t)
+	syncer := NewSyncer(local.conf, nil, local.ts)
+	require.NoError(t, syncer.SyncWith(peer))
+
+	before, ok := local.idx.Get("a.txt")
+	require.True(t, ok)
+
+	require.NoError(t, syncer.SyncWith(peer))
+
+	after, ok := local.idx.Get("a.txt")
+	require.True(t, ok)
+	require.Equal(t, before.Version, after.Version)
+	require.Equal(t, before.Vector, after.Vector)
+}
+
+func TestIgnoredFilesAreNotSynced(t *testing.T) {
+	local := newTestNode(t)
+	remote := newTestNode(t)
+	local.pair(t, remote)
+	local.ts.ignores = ignore.New("*.log")
+	remote.ts.ignores = ignore.New("secret.txt")
+	peer := remote.serve(t)
+
+	remote.write(t, "a.txt", "shared")
+	remote.write(t, "app.log", "ignored by us")
+	remote.write(t, "secret.txt", "ignored by the remote")
+	require.NoError(t, NewSyncer(local.conf, nil, local.ts).SyncWith(peer))
+
+	require.Equal(t, "shared", local.read(t, "a.txt"))
+	for _, name := range []string{"app.log", "secret.txt"} {
+		_, err := os.Stat(filepath.Join(local.root, name))
+		require.True(t, os.IsNotExist(err), name)
+	}
+
+	// the remote refuses ignored files pushed to it as well
+	conn, err := dialPeer(local.serve(t), remote.ts.id, remote.ts.peers)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	err = writeMessage(conn, MsgFileHeader, FileHeader{EventType: watcher.Create, Path: "logs/app.log", Size: 4, Hash: digestOf([]byte("data"))})
+	require.NoError(t, err)
+	err = readMessage(conn, MsgAck, nil)
+	var remoteErr *RemoteError
+	require.True(t, errors.As(err, &remoteErr))
+	require.Contains(t, remoteErr.Message, ErrIgnored.Error())
+
+	_, err = os.Stat(filepath.Join(local.root, "logs", "app.log"))
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestSyncWithCreatesAndDeletesDirectories(t *testing.T) {
+	local := newTestNode(t)
+	remote := newTestNode(t)
+	local.pair(t, remote)
+	peer := remote.serve(t)
+	syncer := NewSyncer(local.conf, nil, local.ts)
+
+	remote.mkdir(t, "empty", 0700)
+	remote.mkdir(t, "dir", 0750)
+	remote.write(t, "dir/a.txt", "a")
+	require.NoError(t, syncer.SyncWith(peer))
+
+	info, err := os.Stat(filepath.Join(local.root, "empty"))
+	require.NoError(t, err)
+	require.True(t, info.IsDir())
+	require.Equal(t, os.FileMode(0700), info.Mode().Perm())
+	info, err = os.Stat(filepath.Join(local.root, "dir"))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0750), info.Mode().Perm())
+	require.Equal(t, "a", local.read(t, "dir/a.txt"))
+
+	require.NoError(t, os.RemoveAll(filepath.Join(remote.root, "dir")))
+	require.NoError(t, os.Remove(filepath.Join(remote.root, "empty")))
+	_, err = remote.idx.MarkDeleted("dir")
+	require.NoError(t, err)
+	_, err = remote.idx.MarkDeleted("empty")
+	require.NoError(t, err)
+	require.NoError(t, syncer.SyncWith(peer))
+
+	for _, name := range []string{"dir", "empty"} {
+		_, err = os.Stat(filepath.Join(local.root, name))
+		require.True(t, os.IsNotExist(err), name)
+		f, ok := local.idx.Get(name)
+		require.True(t, ok, name)
+		require.True(t, f.Deleted, name)
+	}
+}
+
+func TestSyncerSyncsWithPeersFoundBeforeRun(t *testing.T) {
+	local := newTestNode(t)
+	remote := newTestNode(t)
+	local.pair(t, remote)
+	remote.write(t, "existing.txt", "found early")
+
+	peer := remote.serve(t)
+	ds := discoveryOf()
+	syncer := NewSyncer(local.conf, ds, local.ts)
+
+	// e.g. a static peer probed while the node starts up
+	ds.Peers.Upsert(peer)
+	go syncer.Run()
+
+	require.Eventually(t, func() bool {
+		data, err := os.ReadFile(filepath.Join(local.root, "existing.txt"))
+		return err == nil && string(data) == "found early"
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestSyncerSyncsOncePaired(t *testing.T) {
+	local := newTestNode(t)
+	remote := newTestNode(t)
+	remote.write(t, "existing.txt", "there before pairing")
+
+	peer := remote.serve(t)
+	local.conf.Discovery.BroadcastInterval = 20 * time.Millisecond
+	ds := discoveryOf()
+	syncer := NewSyncer(local.conf, ds, local.ts)
+	go syncer.Run()
+
+	// seen online before the devices were paired, so the sync fails
+	ds.Peers.Upsert(peer)
+	require.Eventually(t, func() bool {
+		syncer.mu.Lock()
+		defer syncer.mu.Unlock()
+		return syncer.unsynced[peer.Id]
+	}, 2*time.Second, 10*time.Millisecond)
+
+	local.pair(t, remote)
+	require.Eventually(t, func() bool {
+		data, err := os.ReadFile(filepath.Join(local.root, "existing.txt"))
+		return err == nil && string(data) == "there before pairing"
+	}, 2*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,220 @@
+package trust
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/hippo-an/sync-net/pkg/config"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const trustFileName = "trusted.json"
+
+var (
+	ErrUntrusted = errors.New("device is not trusted")
+	ErrNotPaired = errors.New("device is not paired")
+)
+
+// Device is a peer the user paired with. Only trusted devices may connect to
+// the transfer server or receive our changes.
+type Device struct {
+	ID       string    `json:"id"`
+	Address  string    `json:"address,omitempty"`
+	PairedAt time.Time `json:"pairedAt"`
+}
+
+// Store is the allow-list of trusted devices, kept in the node's state
+// directory. The pair command and the daemon run as separate processes, so
+// the list is reloaded whenever the file changed on disk.
+type Store struct {
+	mu      sync.Mutex
+	file    string
+	modTime time.Time
+	devices map[string]*Device
+}
+
+// Open loads the allow-list from the state directory. A node that has not
+// paired with anyone yet trusts nobody.
+func Open(conf *config.Config) (*Store, error) {
+	err := os.MkdirAll(conf.Node.StateDir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Store{
+		file:    filepath.Join(conf.Node.StateDir, trustFileName),
+		devices: map[string]*Device{},
+	}
+
+	err = s.reload()
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Trusted reports whether the device with the given ID was paired.
+func (s *Store) Trusted(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.reload()
+	if err != nil {
+		return false
+	}
+
+	_, ok := s.devices[id]
+	return ok
+}
+
+// Add trusts the device with the given ID. Pairing a device again updates
+// the address it was last paired at.
+func (s *Store) Add(id, address string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.reload()
+	if err != nil {
+		return err
+	}
+
+	s.devices[id] = &Device{
+		ID:       id,
+		Address:  address,
+		PairedAt: time.Now(),
+	}
+
+	return s.save()
+}
+
+// Remove revokes the trust in the device with the given ID.
+func (s *Store) Remove(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.reload()
+	if err != nil {
+		return err
+	}
+
+	if _, ok := s.devices[id]; !ok {
+		return fmt.Errorf("%w: %s", ErrNotPaired, id)
+	}
+
+	delete(s.devices, id)
+	return s.save()
+}
+
+// List returns the trusted devices ordered by ID.
+func (s *Store) List() []*Device {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_ = s.reload()
+
+	devices := make([]*Device, 0, len(s.devices))
+	for _, d := range s.devices {
+		c := *d
+		devices = append(devices, &c)
+	}
+
+	sort.Slice(devices, func(a, b int) bool {
+		return devices[a].ID < devices[b].ID
+	})
+
+	return devices
+}
+
+// reload reads the allow-list again if the file changed since it was last
+// read.
+func (s *Store) reload() error {
+	info, err := os.Stat(s.file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			s.devices = map[string]*Device{}
+			s.modTime = time.Time{}
+			return nil
+		}
+		return err
+	}
+
+	if info.ModTime().Equal(s.modTime) {
+		return nil
+	}
+
+	data, err := os.ReadFile(s.file)
+	if err != nil {
+		return err
+	}
+
+	var devices []*Device
+	err = json.Unmarshal(data, &devices)
+	if err != nil {
+		return err
+	}
+
+	s.devices = make(map[string]*Device, len(devices))
+	for _, d := range devices {
+		s.devices[d.ID] = d
+	}
+	s.modTime = info.ModTime()
+
+	return nil
+}
+
+// save writes the allow-list through a temporary file so a crash never
+// leaves a truncated list behind.
+func (s *Store) save() error {
+	devices := make([]*Device, 0, len(s.devices))
+	for _, d := range s.devices {
+		devices = append(devices, d)
+	}
+
+	sort.Slice(devices, func(a, b int) bool {
+		return devices[a].ID < devices[b].ID
+	})
+
+	data, err := json.MarshalIndent(devices, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := s.file + ".tmp"
+	err = os.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmp, s.file)
+	if err != nil {
+		return err
+	}
+
+	// remember what we wrote so the next call does not read it back
+	info, err := os.Stat(s.file)
+	if err != nil {
+		return err
+	}
+	s.modTime = info.ModTime()
+
+	return nil
+}
+
+// PairingCode derives the short code both sides of a pairing show. It only
+// depends on the two device IDs, so the users can compare the codes to make
+// sure each device talks to the other and not to someone in between.
+func PairingCode(a, b string) string {
+	if b < a {
+		a, b = b, a
+	}
+
+	sum := sha256.Sum256([]byte(a + ":" + b))
+	return fmt.Sprintf("%06d", binary.BigEndian.Uint32(sum[:4])%1000000)
+}
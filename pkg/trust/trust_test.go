@@ -0,0 +1,71 @@
+package trust
+
+import (
+	"github.com/hippo-an/sync-net/pkg/config"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func createConf(t *testing.T) *config.Config {
+	t.Helper()
+	conf, err := config.NewConfig()
+	require.NoError(t, err)
+	conf.Node.StateDir = filepath.Join(t.TempDir(), "state")
+
+	return conf
+}
+
+func TestStorePersistsDevices(t *testing.T) {
+	conf := createConf(t)
+
+	s, err := Open(conf)
+	require.NoError(t, err)
+	require.False(t, s.Trusted("A"))
+	require.Empty(t, s.List())
+
+	require.NoError(t, s.Add("A", "10.0.0.2:9000"))
+	require.True(t, s.Trusted("A"))
+
+	info, err := os.Stat(filepath.Join(conf.Node.StateDir, trustFileName))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	again, err := Open(conf)
+	require.NoError(t, err)
+	require.True(t, again.Trusted("A"))
+	devices := again.List()
+	require.Len(t, devices, 1)
+	require.Equal(t, "10.0.0.2:9000", devices[0].Address)
+
+	require.NoError(t, again.Remove("A"))
+	require.False(t, again.Trusted("A"))
+	require.ErrorIs(t, again.Remove("A"), ErrNotPaired)
+}
+
+func TestStoreSeesChangesOfOtherProcesses(t *testing.T) {
+	conf := createConf(t)
+
+	daemon, err := Open(conf)
+	require.NoError(t, err)
+	require.False(t, daemon.Trusted("A"))
+
+	cli, err := Open(conf)
+	require.NoError(t, err)
+	require.NoError(t, cli.Add("A", ""))
+
+	// make the change visible even on file systems with coarse timestamps
+	later := time.Now().Add(time.Second)
+	require.NoError(t, os.Chtimes(filepath.Join(conf.Node.StateDir, trustFileName), later, later))
+
+	require.True(t, daemon.Trusted("A"))
+}
+
+func TestPairingCode(t *testing.T) {
+	code := PairingCode("A", "B")
+	require.Len(t, code, 6)
+	require.Equal(t, code, PairingCode("B", "A"))
+	require.NotEqual(t, code, PairingCode("A", "C"))
+}
@@ -0,0 +1,117 @@
+package versioning
+
+import (
+	"fmt"
+	"github.com/hippo-an/sync-net/pkg/config"
+	"time"
+)
+
+// Policy decides which archived versions of a file are no longer kept.
+type Policy interface {
+	// Expired returns the versions to remove. versions belong to a single
+	// file and are sorted oldest first.
+	Expired(versions []Version, now time.Time) []Version
+}
+
+// Simple keeps the Keep most recent versions of every file. Zero keeps all.
+type Simple struct {
+	Keep int
+}
+
+func (p Simple) Expired(versions []Version, now time.Time) []Version {
+	if p.Keep <= 0 || len(versions) <= p.Keep {
+		return nil
+	}
+	return versions[:len(versions)-p.Keep]
+}
+
+// TrashCan keeps every version until it is older than CleanoutAfter. Zero
+// keeps versions forever.
+type TrashCan struct {
+	CleanoutAfter time.Duration
+}
+
+func (p TrashCan) Expired(versions []Version, now time.Time) []Version {
+	if p.CleanoutAfter <= 0 {
+		return nil
+	}
+
+	var expired []Version
+	for _, v := range versions {
+		if now.Sub(v.Time) > p.CleanoutAfter {
+			expired = append(expired, v)
+		}
+	}
+	return expired
+}
+
+// staggeredIntervals thin out older versions: within the first hour one
+// version per 30 seconds is kept, within the first day one per hour, within
+// the first 30 days one per day and after that one per week.
+var staggeredIntervals = []struct {
+	upTo, every time.Duration
+}{
+	{time.Hour, 30 * time.Second},
+	{24 * time.Hour, time.Hour},
+	{30 * 24 * time.Hour, 24 * time.Hour},
+}
+
+const staggeredLastInterval = 7 * 24 * time.Hour
+
+// Staggered keeps fewer versions the older they get and drops versions
+// older than MaxAge. Zero MaxAge keeps the weekly versions forever.
+type Staggered struct {
+	MaxAge time.Duration
+}
+
+func (p Staggered) Expired(versions []Version, now time.Time) []Version {
+	var expired []Version
+	var kept time.Time
+
+	for i := len(versions) - 1; i >= 0; i-- {
+		v := versions[i]
+		age := now.Sub(v.Time)
+
+		if p.MaxAge > 0 && age > p.MaxAge {
+			expired = append(expired, v)
+			continue
+		}
+
+		if !kept.IsZero() && kept.Sub(v.Time) < interval(age) {
+			expired = append(expired, v)
+			continue
+		}
+
+		kept = v.Time
+	}
+
+	return expired
+}
+
+func interval(age time.Duration) time.Duration {
+	for _, i := range staggeredIntervals {
+		if age <= i.upTo {
+			return i.every
+		}
+	}
+	return staggeredLastInterval
+}
+
+// PolicyFor maps the versioning config to a policy. An empty type disables
+// versioning and returns a nil policy.
+func PolicyFor(conf *config.Config) (Policy, error) {
+	c := conf.Versioning
+
+	switch c.Type {
+	case "", "none":
+		return nil, nil
+	case "simple":
+		return Simple{Keep: c.Keep}, nil
+	case "staggered":
+		return Staggered{MaxAge: c.MaxAge}, nil
+	case "trashcan":
+		return TrashCan{CleanoutAfter: c.CleanoutAfter}, nil
+	default:
+		return nil, fmt.Errorf("invalid versioning type: %s", c.Type)
+	}
+}
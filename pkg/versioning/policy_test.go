@@ -0,0 +1,51 @@
+package versioning
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+// versionsAt builds versions of one file archived the given durations ago,
+// oldest first.
+func versionsAt(now time.Time, ages ...time.Duration) []Version {
+	var versions []Version
+	for _, age := range ages {
+		versions = append(versions, Version{Path: "a.txt", Time: now.Add(-age)})
+	}
+	return versions
+}
+
+func TestSimpleKeepsNewest(t *testing.T) {
+	now := time.Now()
+	versions := versionsAt(now, 4*time.Hour, 3*time.Hour, 2*time.Hour, time.Hour)
+
+	require.Equal(t, versions[:2], Simple{Keep: 2}.Expired(versions, now))
+	require.Empty(t, Simple{Keep: 4}.Expired(versions, now))
+	require.Empty(t, Simple{}.Expired(versions, now))
+}
+
+func TestTrashCanExpiresOldVersions(t *testing.T) {
+	now := time.Now()
+	versions := versionsAt(now, 48*time.Hour, 25*time.Hour, time.Hour)
+
+	require.Equal(t, versions[:2], TrashCan{CleanoutAfter: 24 * time.Hour}.Expired(versions, now))
+	require.Empty(t, TrashCan{}.Expired(versions, now))
+}
+
+func TestStaggeredThinsOutOlderVersions(t *testing.T) {
+	now := time.Now()
+	day := 24 * time.Hour
+	versions := versionsAt(now,
+		400*day,                  // beyond max age
+		20*day, 20*day-time.Hour, // same day: the older one goes
+		3*time.Hour, 3*time.Hour-time.Minute, // same hour
+		10*time.Minute, 9*time.Minute, 9*time.Minute-10*time.Second, // within 30s
+	)
+
+	expired := Staggered{MaxAge: 365 * day}.Expired(versions, now)
+	require.ElementsMatch(t, []Version{versions[0], versions[1], versions[3], versions[6]}, expired)
+
+	expired = Staggered{}.Expired(versions, now)
+	require.NotContains(t, expired, versions[0])
+}
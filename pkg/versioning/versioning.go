@@ -0,0 +1,409 @@
+package versioning
+
+import (
+	"errors"
+	"fmt"
+	"github.com/hippo-an/sync-net/pkg/config"
+	"github.com/hippo-an/sync-net/pkg/watcher"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	versionsDirName = "versions"
+	timeFormat      = "20060102-150405"
+)
+
+var (
+	ErrVersionNotFound = errors.New("version not found")
+	ErrInvalidPath     = errors.New("invalid path")
+)
+
+// versionName matches "name~<timestamp>.ext" and captures the stem, the
+// timestamp and the extension.
+var versionName = regexp.MustCompile(`^(.*)~(\d{8}-\d{6})(\.[^.]*)?$`)
+
+// Version is an archived copy of a file that was replaced or deleted.
+type Version struct {
+	// Path is the slash separated path of the original file in the folder.
+	Path string    `json:"path"`
+	Time time.Time `json:"time"`
+	Size int64     `json:"size"`
+	file string
+}
+
+// Versioner keeps old content of files under the hidden versions tree of the
+// synced folder instead of discarding it.
+type Versioner struct {
+	root   string
+	dir    string
+	policy Policy
+	conf   *config.Config
+	mu     sync.Mutex
+}
+
+func New(conf *config.Config) (*Versioner, error) {
+	policy, err := PolicyFor(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Versioner{
+		root:   conf.Watcher.Path,
+		dir:    filepath.Join(conf.Watcher.Path, watcher.MetaDirName, versionsDirName),
+		policy: policy,
+		conf:   conf,
+	}, nil
+}
+
+// Enabled reports whether a retention policy is configured. Listing and
+// restoring works either way.
+func (v *Versioner) Enabled() bool {
+	return v.policy != nil
+}
+
+// Archive moves the file at the relative path relPath into the versions tree
+// and applies the retention policy to its versions. A missing file is not
+// an error.
+func (v *Versioner) Archive(relPath string) error {
+	return v.store(relPath, false)
+}
+
+// Keep adds the current content of the file at relPath to its versions like
+// Archive, but leaves the file in place, so that it can be replaced
+// atomically afterwards. The version is a hard link to the file, or a copy
+// where links are not supported.
+func (v *Versioner) Keep(relPath string) error {
+	return v.store(relPath, true)
+}
+
+func (v *Versioner) store(relPath string, keep bool) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	archived, err := v.archive(relPath, time.Now(), keep)
+	if err != nil || !archived {
+		return err
+	}
+
+	return v.prune(relPath, time.Now())
+}
+
+func (v *Versioner) archive(relPath string, at time.Time, keep bool) (bool, error) {
+	source, err := v.original(relPath)
+	if err != nil {
+		return false, err
+	}
+
+	info, err := os.Lstat(source)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	if !info.Mode().IsRegular() {
+		return false, nil
+	}
+
+	target := v.versionPath(relPath, at)
+	// several versions within one second get the following timestamps, so
+	// sorting by name still sorts by age
+	for n := 1; ; n++ {
+		if _, err := os.Lstat(target); os.IsNotExist(err) {
+			break
+		}
+		target = v.versionPath(relPath, at.Add(time.Duration(n)*time.Second))
+	}
+
+	err = os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return false, err
+	}
+
+	log.Println("Archiving old version of", relPath, "as:", target)
+	if keep {
+		err = linkOrCopy(source, target)
+	} else {
+		err = os.Rename(source, target)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// linkOrCopy makes target a hard link to source, or a copy of it if the
+// file system does not support links.
+func linkOrCopy(source, target string) error {
+	err := os.Link(source, target)
+	if err == nil {
+		return nil
+	}
+
+	src, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	dst, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(dst, src)
+	if err == nil {
+		err = dst.Sync()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(target)
+		return err
+	}
+
+	return os.Chtimes(target, info.ModTime(), info.ModTime())
+}
+
+// List returns the archived versions of relPath, oldest first.
+func (v *Versioner) List(relPath string) ([]Version, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	return v.list(relPath)
+}
+
+func (v *Versioner) list(relPath string) ([]Version, error) {
+	_, err := v.original(relPath)
+	if err != nil {
+		return nil, err
+	}
+
+	dir, name := path.Split(relPath)
+	entries, err := os.ReadDir(filepath.Join(v.dir, filepath.FromSlash(dir)))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var versions []Version
+	for _, e := range entries {
+		original, at, ok := parseVersionName(e.Name())
+		if !ok || original != name || !e.Type().IsRegular() {
+			continue
+		}
+
+		info, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+
+		versions = append(versions, Version{
+			Path: relPath,
+			Time: at,
+			Size: info.Size(),
+			file: filepath.Join(v.dir, filepath.FromSlash(dir), e.Name()),
+		})
+	}
+
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].Time.Before(versions[j].Time)
+	})
+	return versions, nil
+}
+
+// Restore puts the version of relPath archived at the given time back in
+// place. The current content, if any, is kept as a version first so nothing
+// is lost, and is then replaced in one rename.
+func (v *Versioner) Restore(relPath string, at time.Time) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	versions, err := v.list(relPath)
+	if err != nil {
+		return err
+	}
+
+	var version *Version
+	for i := range versions {
+		if versions[i].Time.Equal(at) {
+			version = &versions[i]
+		}
+	}
+	if version == nil {
+		return ErrVersionNotFound
+	}
+
+	target, err := v.original(relPath)
+	if err != nil {
+		return err
+	}
+
+	_, err = v.archive(relPath, time.Now(), true)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return err
+	}
+
+	log.Println("Restoring", relPath, "from version:", version.Time.Format(timeFormat))
+	return os.Rename(version.file, target)
+}
+
+// Clean applies the retention policy to the versions of every file.
+func (v *Versioner) Clean() error {
+	if v.policy == nil {
+		return nil
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	files := map[string]bool{}
+	err := filepath.WalkDir(v.dir, func(fullPath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && fullPath == v.dir {
+				return filepath.SkipDir
+			}
+			return err
+		}
+
+		if d.IsDir() {
+			return nil
+		}
+
+		original, _, ok := parseVersionName(d.Name())
+		if !ok {
+			return nil
+		}
+
+		rel, err := filepath.Rel(v.dir, filepath.Join(filepath.Dir(fullPath), original))
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(rel)] = true
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for relPath := range files {
+		err = v.prune(relPath, now)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Run cleans the versions tree every cleanInterval, so time based policies
+// expire versions of files that do not change anymore.
+func (v *Versioner) Run() {
+	interval := v.conf.Versioning.CleanInterval
+	if v.policy == nil || interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			err := v.Clean()
+			if err != nil {
+				log.Println("Error cleaning file versions:", err)
+			}
+		}
+	}
+}
+
+func (v *Versioner) prune(relPath string, now time.Time) error {
+	if v.policy == nil {
+		return nil
+	}
+
+	versions, err := v.list(relPath)
+	if err != nil {
+		return err
+	}
+
+	for _, version := range v.policy.Expired(versions, now) {
+		log.Println("Removing expired version:", version.file)
+		err = os.Remove(version.file)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// original maps relPath onto the folder root. Paths outside of the folder or
+// inside the metadata directory are rejected.
+func (v *Versioner) original(relPath string) (string, error) {
+	cleaned := path.Clean(relPath)
+	if relPath == "" || cleaned == "." || path.IsAbs(cleaned) || cleaned == ".." ||
+		strings.HasPrefix(cleaned, "../") || watcher.IsMetaPath(cleaned) {
+		return "", fmt.Errorf("%w: %s", ErrInvalidPath, relPath)
+	}
+
+	return filepath.Join(v.root, filepath.FromSlash(cleaned)), nil
+}
+
+func (v *Versioner) versionPath(relPath string, at time.Time) string {
+	dir, name := path.Split(relPath)
+	ext := path.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+
+	return filepath.Join(v.dir, filepath.FromSlash(dir), fmt.Sprintf("%s~%s%s", stem, at.Format(timeFormat), ext))
+}
+
+func parseVersionName(name string) (string, time.Time, bool) {
+	m := versionName.FindStringSubmatch(name)
+	if m == nil {
+		return "", time.Time{}, false
+	}
+
+	at, err := time.ParseInLocation(timeFormat, m[2], time.Local)
+	if err != nil {
+		return "", time.Time{}, false
+	}
+
+	return m[1] + m[3], at, true
+}
+
+// ParseTime parses a version time in the form printed by FormatTime.
+func ParseTime(s string) (time.Time, error) {
+	return time.ParseInLocation(timeFormat, s, time.Local)
+}
+
+func FormatTime(t time.Time) string {
+	return t.Format(timeFormat)
+}
@@ -0,0 +1,193 @@
+package versioning
+
+import (
+	"github.com/hippo-an/sync-net/pkg/config"
+	"github.com/hippo-an/sync-net/pkg/watcher"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func createVersioner(t *testing.T, versioningType string) *Versioner {
+	t.Helper()
+	conf, err := config.NewConfig()
+	require.NoError(t, err)
+	conf.Watcher.Path = t.TempDir()
+	conf.Versioning.Type = versioningType
+	conf.Versioning.Keep = 2
+
+	v, err := New(conf)
+	require.NoError(t, err)
+	return v
+}
+
+func write(t *testing.T, v *Versioner, relPath, content string) {
+	t.Helper()
+	fullPath := filepath.Join(v.root, filepath.FromSlash(relPath))
+	require.NoError(t, os.MkdirAll(filepath.Dir(fullPath), 0755))
+	require.NoError(t, os.WriteFile(fullPath, []byte(content), 0644))
+}
+
+func TestArchiveMovesFileIntoVersions(t *testing.T) {
+	v := createVersioner(t, "simple")
+
+	write(t, v, "dir/a.txt", "v1")
+	require.NoError(t, v.Archive("dir/a.txt"))
+
+	_, err := os.Stat(filepath.Join(v.root, "dir", "a.txt"))
+	require.True(t, os.IsNotExist(err))
+
+	versions, err := v.List("dir/a.txt")
+	require.NoError(t, err)
+	require.Len(t, versions, 1)
+	require.Equal(t, "dir/a.txt", versions[0].Path)
+	require.Equal(t, int64(2), versions[0].Size)
+	require.WithinDuration(t, time.Now(), versions[0].Time, 2*time.Second)
+	require.Equal(t, filepath.Join(v.root, watcher.MetaDirName, "versions", "dir"), filepath.Dir(versions[0].file))
+
+	// nothing to archive
+	require.NoError(t, v.Archive("dir/missing.txt"))
+}
+
+func TestKeepLeavesFileInPlace(t *testing.T) {
+	v := createVersioner(t, "simple")
+
+	write(t, v, "a.txt", "v1")
+	require.NoError(t, v.Keep("a.txt"))
+
+	data, err := os.ReadFile(filepath.Join(v.root, "a.txt"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("v1"), data)
+
+	// replacing the file does not touch the version
+	write(t, v, "a.txt.tmp", "v2")
+	require.NoError(t, os.Rename(filepath.Join(v.root, "a.txt.tmp"), filepath.Join(v.root, "a.txt")))
+
+	versions, err := v.List("a.txt")
+	require.NoError(t, err)
+	require.Len(t, versions, 1)
+	data, err = os.ReadFile(versions[0].file)
+	require.NoError(t, err)
+	require.Equal(t, []byte("v1"), data)
+}
+
+func TestArchiveAppliesPolicy(t *testing.T) {
+	v := createVersioner(t, "simple")
+
+	for _, content := range []string{"v1", "v2", "v3"} {
+		write(t, v, "a.txt", content)
+		require.NoError(t, v.Archive("a.txt"))
+	}
+	write(t, v, "a.tar.txt", "other file")
+	require.NoError(t, v.Archive("a.tar.txt"))
+
+	versions, err := v.List("a.txt")
+	require.NoError(t, err)
+	require.Len(t, versions, 2)
+
+	data, err := os.ReadFile(versions[0].file)
+	require.NoError(t, err)
+	require.Equal(t, []byte("v2"), data)
+
+	versions, err = v.List("a.tar.txt")
+	require.NoError(t, err)
+	require.Len(t, versions, 1)
+}
+
+func TestRestoreKeepsCurrentContent(t *testing.T) {
+	v := createVersioner(t, "simple")
+
+	write(t, v, "a.txt", "old")
+	require.NoError(t, v.Archive("a.txt"))
+	write(t, v, "a.txt", "current")
+
+	versions, err := v.List("a.txt")
+	require.NoError(t, err)
+	require.Len(t, versions, 1)
+
+	require.NoError(t, v.Restore("a.txt", versions[0].Time))
+
+	data, err := os.ReadFile(filepath.Join(v.root, "a.txt"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("old"), data)
+
+	versions, err = v.List("a.txt")
+	require.NoError(t, err)
+	require.Len(t, versions, 1)
+	data, err = os.ReadFile(versions[0].file)
+	require.NoError(t, err)
+	require.Equal(t, []byte("current"), data)
+
+	require.ErrorIs(t, v.Restore("a.txt", time.Unix(0, 0)), ErrVersionNotFound)
+}
+
+func TestRestoreDeletedFile(t *testing.T) {
+	v := createVersioner(t, "")
+	require.False(t, v.Enabled())
+
+	write(t, v, "dir/a.txt", "deleted")
+	_, err := v.archive("dir/a.txt", time.Now(), false)
+	require.NoError(t, err)
+	require.NoError(t, os.RemoveAll(filepath.Join(v.root, "dir")))
+
+	versions, err := v.List("dir/a.txt")
+	require.NoError(t, err)
+	require.Len(t, versions, 1)
+	require.NoError(t, v.Restore("dir/a.txt", versions[0].Time))
+
+	data, err := os.ReadFile(filepath.Join(v.root, "dir", "a.txt"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("deleted"), data)
+}
+
+func TestCleanExpiresVersions(t *testing.T) {
+	v := createVersioner(t, "trashcan")
+	v.policy = TrashCan{CleanoutAfter: time.Hour}
+
+	write(t, v, "dir/a.txt", "expired")
+	_, err := v.archive("dir/a.txt", time.Now().Add(-2*time.Hour), false)
+	require.NoError(t, err)
+	write(t, v, "dir/a.txt", "recent")
+	_, err = v.archive("dir/a.txt", time.Now(), false)
+	require.NoError(t, err)
+
+	require.NoError(t, v.Clean())
+
+	versions, err := v.List("dir/a.txt")
+	require.NoError(t, err)
+	require.Len(t, versions, 1)
+	data, err := os.ReadFile(versions[0].file)
+	require.NoError(t, err)
+	require.Equal(t, []byte("recent"), data)
+}
+
+func TestRejectsPathsOutsideFolder(t *testing.T) {
+	v := createVersioner(t, "simple")
+
+	for _, relPath := range []string{"", ".", "../a.txt", "/etc/passwd", watcher.MetaDirName + "/versions/a.txt"} {
+		require.ErrorIs(t, v.Archive(relPath), ErrInvalidPath, relPath)
+		_, err := v.List(relPath)
+		require.ErrorIs(t, err, ErrInvalidPath, relPath)
+	}
+}
+
+func TestPolicyFor(t *testing.T) {
+	conf, err := config.NewConfig()
+	require.NoError(t, err)
+
+	conf.Versioning.Type = "staggered"
+	policy, err := PolicyFor(conf)
+	require.NoError(t, err)
+	require.Equal(t, Staggered{MaxAge: conf.Versioning.MaxAge}, policy)
+
+	conf.Versioning.Type = "none"
+	policy, err = PolicyFor(conf)
+	require.NoError(t, err)
+	require.Nil(t, policy)
+
+	conf.Versioning.Type = "forever"
+	_, err = PolicyFor(conf)
+	require.Error(t, err)
+}
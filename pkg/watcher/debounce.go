@@ -0,0 +1,217 @@
+package watcher
+
+import (
+	"os"
+	"sort"
+	"time"
+)
+
+// minFlushInterval bounds how often pending changes are checked when the
+// quiet period is very short.
+const minFlushInterval = 10 * time.Millisecond
+
+// pending is a change to a path that has not settled yet.
+type pending struct {
+	fullPath    string
+	oldFullPath string
+	eventType   EventType
+	size        int64
+	modTime     time.Time
+	touched     time.Time
+	// id is the identity of a removed file, if it was known.
+	id    fileID
+	known bool
+}
+
+// coalesce folds the next event for a path into the change already pending
+// for it. It reports false if the two cancel out.
+func coalesce(pendingType, next EventType) (EventType, bool) {
+	switch pendingType {
+	case Rename:
+		return Rename, true
+	case Create:
+		if next == Delete {
+			// the path never existed as far as peers are concerned
+			return 0, false
+		}
+		return Create, true
+	case Delete:
+		if next == Delete {
+			return Delete, true
+		}
+		// the path was replaced
+		return Modify, true
+	default:
+		if next == Delete {
+			return Delete, true
+		}
+		return Modify, true
+	}
+}
+
+// record adds an event to the changes pending for its path. info is the
+// state of the path when the event was seen, nil for deletes.
+func (w *Watcher) record(eventType EventType, fullPath string, info os.FileInfo, now time.Time) {
+	var id fileID
+	var known bool
+	if eventType == Delete {
+		id, known = w.forget(fullPath)
+	} else if info != nil {
+		w.remember(fullPath, info)
+	}
+
+	p, ok := w.pending[fullPath]
+	if eventType == Delete && !known && !ok {
+		// nothing we reported, e.g. a directory seen moving away twice: by
+		// its parent and by its own watch
+		return
+	}
+
+	if ok && p.eventType == Rename && eventType == Delete {
+		// renamed and removed again, for peers only the old path is gone
+		delete(w.pending, fullPath)
+		w.recordRemoval(p.oldFullPath, p.id, now)
+		return
+	}
+
+	if !ok && eventType == Create && info != nil {
+		if from := w.renamedFrom(fullPath, info); from != nil {
+			delete(w.pending, from.fullPath)
+			w.pending[fullPath] = &pending{
+				fullPath:    fullPath,
+				oldFullPath: from.fullPath,
+				eventType:   Rename,
+				size:        info.Size(),
+				modTime:     info.ModTime(),
+				touched:     now,
+				id:          idOf(info),
+				known:       true,
+			}
+			return
+		}
+	}
+
+	if ok {
+		t, keep := coalesce(p.eventType, eventType)
+		if !keep {
+			delete(w.pending, fullPath)
+			return
+		}
+		eventType = t
+	} else {
+		p = &pending{fullPath: fullPath}
+		w.pending[fullPath] = p
+	}
+
+	p.eventType = eventType
+	p.touched = now
+	if eventType == Delete {
+		p.id, p.known = id, known
+	}
+	if info != nil {
+		p.size = info.Size()
+		p.modTime = info.ModTime()
+	}
+}
+
+// recordRemoval records that fullPath, whose file was renamed away in the
+// meantime, is gone. A file created at fullPath since then replaces it.
+func (w *Watcher) recordRemoval(fullPath string, id fileID, now time.Time) {
+	p, ok := w.pending[fullPath]
+	if ok {
+		if p.eventType == Create {
+			p.eventType = Modify
+		}
+		return
+	}
+
+	w.pending[fullPath] = &pending{
+		fullPath:  fullPath,
+		eventType: Delete,
+		touched:   now,
+		id:        id,
+		known:     true,
+	}
+}
+
+// flush reports the pending changes that have been quiet for the quiet
+// period, oldest first. A file whose size or modification time changed
+// since it was last seen is still being written and is held back.
+func (w *Watcher) flush(now time.Time) {
+	var settled []*pending
+	for fullPath, p := range w.pending {
+		if now.Sub(p.touched) < w.quietPeriod {
+			continue
+		}
+
+		// a peer's change is being applied, it is judged once that is done
+		if w.Inbound.writing(p.fullPath) || (p.eventType == Rename && w.Inbound.writing(p.oldFullPath)) {
+			p.touched = now
+			continue
+		}
+
+		if p.eventType != Delete {
+			info, err := os.Stat(fullPath)
+			switch {
+			case os.IsNotExist(err):
+				if p.eventType == Create {
+					delete(w.pending, fullPath)
+					continue
+				}
+				// it went away before it settled
+				if p.eventType == Rename {
+					p.fullPath = p.oldFullPath
+				}
+				p.eventType = Delete
+			case err != nil:
+				delete(w.pending, fullPath)
+				w.ErrorChan <- err
+				continue
+			case info.Size() != p.size || !info.ModTime().Equal(p.modTime):
+				p.size = info.Size()
+				p.modTime = info.ModTime()
+				p.touched = now
+				continue
+			}
+		}
+
+		delete(w.pending, fullPath)
+		settled = append(settled, p)
+	}
+
+	// parents before their content if both changed at the same time
+	sort.Slice(settled, func(a, b int) bool {
+		if !settled[a].touched.Equal(settled[b].touched) {
+			return settled[a].touched.Before(settled[b].touched)
+		}
+		return settled[a].fullPath < settled[b].fullPath
+	})
+
+	for _, p := range settled {
+		if w.causedByPeer(p) {
+			continue
+		}
+
+		e, err := getEvent(p.eventType, p.fullPath)
+		if err != nil {
+			w.ErrorChan <- err
+			continue
+		}
+		e.OldFullPath = p.oldFullPath
+		w.SendToChan(e)
+	}
+}
+
+// causedByPeer reports whether the change p is what applying a change from
+// a peer left behind. A rename has to be explained at both of its ends.
+func (w *Watcher) causedByPeer(p *pending) bool {
+	applied := w.Inbound.applied(p.fullPath)
+	if p.eventType == Rename {
+		return w.Inbound.applied(p.oldFullPath) && applied
+	}
+	return applied
+}
+
+func (w *Watcher) flushInterval() time.Duration {
+	return max(w.quietPeriod/2, minFlushInterval)
+}
@@ -0,0 +1,136 @@
+package watcher
+
+import (
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func requireNoEvent(t *testing.T, w *Watcher, wait time.Duration) {
+	t.Helper()
+
+	select {
+	case e := <-w.CreateEventChan:
+		t.Fatalf("unexpected create event for %s", e.FullPath)
+	case e := <-w.ModifyEventChan:
+		t.Fatalf("unexpected modify event for %s", e.FullPath)
+	case e := <-w.DeleteEventChan:
+		t.Fatalf("unexpected delete event for %s", e.FullPath)
+	case e := <-w.RenameEventChan:
+		t.Fatalf("unexpected rename event for %s", e.FullPath)
+	case <-time.After(wait):
+	}
+}
+
+func TestCoalesce(t *testing.T) {
+	tests := []struct {
+		pending, next, want EventType
+		keep                bool
+	}{
+		{Create, Modify, Create, true},
+		{Create, Create, Create, true},
+		{Create, Delete, 0, false},
+		{Modify, Modify, Modify, true},
+		{Modify, Delete, Delete, true},
+		{Delete, Create, Modify, true},
+		{Delete, Delete, Delete, true},
+	}
+
+	for _, tt := range tests {
+		got, keep := coalesce(tt.pending, tt.next)
+		require.Equal(t, tt.keep, keep, "%d then %d", tt.pending, tt.next)
+		if keep {
+			require.Equal(t, tt.want, got, "%d then %d", tt.pending, tt.next)
+		}
+	}
+}
+
+func TestSaveIsReportedOnce(t *testing.T) {
+	conf := createConf(t)
+
+	w, err := NewWatcher(conf, nil)
+	require.NoError(t, err)
+	defer w.TearDown()
+
+	go StartWatch(w)
+
+	testFile := filepath.Join(conf.Watcher.Path, testFileName)
+	f, err := os.Create(testFile)
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		_, err = f.WriteString("data")
+		require.NoError(t, err)
+	}
+	require.NoError(t, f.Close())
+
+	select {
+	case e := <-w.CreateEventChan:
+		require.Equal(t, testFile, e.FullPath)
+		require.Equal(t, int64(20), e.Size)
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for event")
+	}
+	requireNoEvent(t, w, 4*conf.Watcher.QuietPeriod)
+
+	// a file that comes and goes within the quiet period is not reported
+	shortLived := filepath.Join(conf.Watcher.Path, "short-lived.txt")
+	require.NoError(t, os.WriteFile(shortLived, []byte("data"), 0644))
+	require.NoError(t, os.Remove(shortLived))
+	requireNoEvent(t, w, 4*conf.Watcher.QuietPeriod)
+
+	// an editor saving through a temporary file only reports the result
+	replacement := filepath.Join(conf.Watcher.Path, "replacement.tmp")
+	require.NoError(t, os.WriteFile(replacement, []byte("new"), 0644))
+	require.NoError(t, os.Rename(replacement, testFile))
+	require.NoError(t, os.Chmod(testFile, 0600))
+
+	select {
+	case e := <-w.CreateEventChan:
+		require.Equal(t, testFile, e.FullPath)
+		require.Equal(t, int64(3), e.Size)
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for event")
+	}
+	requireNoEvent(t, w, 4*conf.Watcher.QuietPeriod)
+}
+
+func TestGrowingFileIsHeldBack(t *testing.T) {
+	root := t.TempDir()
+	w := &Watcher{
+		BasePath:        root,
+		CreateEventChan: make(chan *Event, 1),
+		ModifyEventChan: make(chan *Event, 1),
+		DeleteEventChan: make(chan *Event, 1),
+		ErrorChan:       make(chan error, 1),
+		quietPeriod:     time.Second,
+		pending:         map[string]*pending{},
+		files:           map[string]fileID{},
+	}
+
+	testFile := filepath.Join(root, testFileName)
+	require.NoError(t, os.WriteFile(testFile, []byte("data"), 0644))
+	info, err := os.Stat(testFile)
+	require.NoError(t, err)
+
+	now := time.Now()
+	w.record(Create, testFile, info, now)
+
+	w.flush(now.Add(500 * time.Millisecond))
+	require.Empty(t, w.CreateEventChan)
+
+	// written to without us seeing an event, e.g. on a network mount
+	require.NoError(t, os.WriteFile(testFile, []byte("more data"), 0644))
+	w.flush(now.Add(time.Second))
+	require.Empty(t, w.CreateEventChan)
+
+	w.flush(now.Add(1500 * time.Millisecond))
+	require.Empty(t, w.CreateEventChan)
+
+	w.flush(now.Add(2 * time.Second))
+	require.Len(t, w.CreateEventChan, 1)
+	e := <-w.CreateEventChan
+	require.Equal(t, int64(9), e.Size)
+	require.Empty(t, w.pending)
+}
@@ -0,0 +1,164 @@
+package watcher
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// inboundGrace is how long an inbound write is remembered beyond the quiet
+// period. Expectations the watcher never sees an event for, for instance
+// because the write failed, are dropped after that.
+const inboundGrace = time.Minute
+
+// inboundWrite is an inbound write to a path. Until it is done the path is
+// still being written, afterwards removed and id describe the state it left
+// the path in.
+type inboundWrite struct {
+	done    bool
+	removed bool
+	id      fileID
+	expires time.Time
+}
+
+// Inbound is a registry of the writes made to the watched folder to apply
+// changes received from peers, shared by the transfer server and the
+// watcher. Events that only show such a write are not reported, so that the
+// change is not sent back to peers as a local one. Writes are registered by
+// their slash separated path relative to the watched folder, which does not
+// depend on how the folder was reached. A nil Inbound expects nothing.
+type Inbound struct {
+	mu     sync.Mutex
+	root   string
+	ttl    time.Duration
+	writes map[string]inboundWrite
+}
+
+func newInbound(root string, quietPeriod time.Duration) *Inbound {
+	return &Inbound{
+		root:   root,
+		ttl:    quietPeriod + inboundGrace,
+		writes: map[string]inboundWrite{},
+	}
+}
+
+// Expect registers that relPath is about to be written, created as a
+// directory, renamed or removed to apply a change from a peer. Events for it
+// are held back until Done is called.
+func (r *Inbound) Expect(relPath string) {
+	r.expect(relPath, inboundWrite{})
+}
+
+// Done registers that the write to relPath announced with Expect is over,
+// whether it succeeded or not. What is found at relPath then is what the
+// watcher will expect.
+func (r *Inbound) Done(relPath string) {
+	if r == nil {
+		return
+	}
+
+	info, err := os.Lstat(filepath.Join(r.root, filepath.FromSlash(relPath)))
+	switch {
+	case os.IsNotExist(err):
+		r.expect(relPath, inboundWrite{done: true, removed: true})
+	case err == nil:
+		r.expect(relPath, inboundWrite{done: true, id: idOf(info)})
+	default:
+		r.forget(relPath)
+	}
+}
+
+func (r *Inbound) expect(relPath string, write inboundWrite) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	for p, w := range r.writes {
+		if now.After(w.expires) {
+			delete(r.writes, p)
+		}
+	}
+
+	write.expires = now.Add(r.ttl)
+	r.writes[relPath] = write
+}
+
+func (r *Inbound) forget(relPath string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.writes, relPath)
+}
+
+// key returns the path fullPath is registered under.
+func (r *Inbound) key(fullPath string) (string, bool) {
+	rel, err := filepath.Rel(r.root, fullPath)
+	if err != nil {
+		return "", false
+	}
+	return filepath.ToSlash(rel), true
+}
+
+// writing reports whether an inbound write to fullPath is in progress.
+func (r *Inbound) writing(fullPath string) bool {
+	if r == nil {
+		return false
+	}
+
+	key, ok := r.key(fullPath)
+	if !ok {
+		return false
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	write, ok := r.writes[key]
+	return ok && !write.done && time.Now().Before(write.expires)
+}
+
+// applied reports whether fullPath is still in the state an inbound write
+// left it in. The expectation is used up either way: once the path changed
+// after the write, the change is a local one.
+func (r *Inbound) applied(fullPath string) bool {
+	if r == nil {
+		return false
+	}
+
+	key, ok := r.key(fullPath)
+	if !ok {
+		return false
+	}
+
+	r.mu.Lock()
+	write, ok := r.writes[key]
+	delete(r.writes, key)
+	r.mu.Unlock()
+
+	if !ok || !write.done || time.Now().After(write.expires) {
+		return false
+	}
+
+	info, err := os.Lstat(fullPath)
+	if write.removed {
+		return os.IsNotExist(err)
+	}
+
+	return err == nil && write.id.unchanged(idOf(info))
+}
+
+// unchanged reports whether o is the very file or directory identified by
+// id, not modified since. The modification time of a directory follows its
+// content, so directories are compared by their inode alone.
+func (id fileID) unchanged(o fileID) bool {
+	if id.dir || o.dir {
+		return id.dir == o.dir && id.inode == o.inode
+	}
+
+	return id.inode == o.inode && id.size == o.size && id.modTime.Equal(o.modTime)
+}
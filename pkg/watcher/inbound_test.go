@@ -0,0 +1,94 @@
+package watcher
+
+import (
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestInboundWritesAreNotReported(t *testing.T) {
+	conf := createConf(t)
+	w, err := NewWatcher(conf, nil)
+	require.NoError(t, err)
+	defer w.TearDown()
+
+	go StartWatch(w)
+
+	wait := 4 * conf.Watcher.QuietPeriod
+	dir := filepath.Join(conf.Watcher.Path, "dir")
+	w.Inbound.Expect("dir")
+	require.NoError(t, os.Mkdir(dir, 0755))
+	w.Inbound.Done("dir")
+	requireNoEvent(t, w, wait)
+
+	file := filepath.Join(dir, testFileName)
+	w.Inbound.Expect("dir/" + testFileName)
+	require.NoError(t, os.WriteFile(file, []byte("from a peer"), 0644))
+	w.Inbound.Done("dir/" + testFileName)
+	requireNoEvent(t, w, wait)
+
+	moved := filepath.Join(conf.Watcher.Path, "moved.txt")
+	w.Inbound.Expect("dir/" + testFileName)
+	w.Inbound.Expect("moved.txt")
+	require.NoError(t, os.Rename(file, moved))
+	w.Inbound.Done("dir/" + testFileName)
+	w.Inbound.Done("moved.txt")
+	requireNoEvent(t, w, wait)
+
+	w.Inbound.Expect("moved.txt")
+	require.NoError(t, os.Remove(moved))
+	w.Inbound.Done("moved.txt")
+	requireNoEvent(t, w, wait)
+}
+
+func TestInboundWritesInProgressAreHeldBack(t *testing.T) {
+	conf := createConf(t)
+	w, err := NewWatcher(conf, nil)
+	require.NoError(t, err)
+	defer w.TearDown()
+
+	go StartWatch(w)
+
+	// the write takes longer than the quiet period
+	file := filepath.Join(conf.Watcher.Path, testFileName)
+	w.Inbound.Expect(testFileName)
+	require.NoError(t, os.WriteFile(file, []byte("from a peer"), 0644))
+	requireNoEvent(t, w, 4*conf.Watcher.QuietPeriod)
+	w.Inbound.Done(testFileName)
+	requireNoEvent(t, w, 4*conf.Watcher.QuietPeriod)
+}
+
+func TestLocalChangesAfterInboundWritesAreReported(t *testing.T) {
+	conf := createConf(t)
+	w, err := NewWatcher(conf, nil)
+	require.NoError(t, err)
+	defer w.TearDown()
+
+	go StartWatch(w)
+
+	// changed locally before the watcher saw the peer's write settle
+	file := filepath.Join(conf.Watcher.Path, testFileName)
+	w.Inbound.Expect(testFileName)
+	require.NoError(t, os.WriteFile(file, []byte("from a peer"), 0644))
+	w.Inbound.Done(testFileName)
+	require.NoError(t, os.WriteFile(file, []byte("edited locally"), 0644))
+
+	select {
+	case e := <-w.CreateEventChan:
+		require.Equal(t, file, e.FullPath)
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for event")
+	}
+
+	// the expectation was used up
+	require.NoError(t, os.WriteFile(file, []byte("from a peer"), 0644))
+
+	select {
+	case e := <-w.ModifyEventChan:
+		require.Equal(t, file, e.FullPath)
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for event")
+	}
+}
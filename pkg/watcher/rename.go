@@ -0,0 +1,89 @@
+package watcher
+
+import (
+	"os"
+	"strings"
+	"time"
+)
+
+// A rename shows up as the removal of the old path followed by the creation
+// of the new one. Both are paired while the removal is still pending, when
+// the new file looks like the one that went away: it has the same inode, or,
+// if it was moved in from another file system, the same size and
+// modification time. Directories are only paired by their inode. Receivers
+// of a Rename event confirm that the content hash still matches before
+// treating it as one.
+
+// fileID identifies a regular file or a directory across renames.
+type fileID struct {
+	inode   uint64
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func idOf(info os.FileInfo) fileID {
+	return fileID{
+		inode:   inodeOf(info),
+		size:    info.Size(),
+		modTime: info.ModTime(),
+		dir:     info.IsDir(),
+	}
+}
+
+// matches reports whether a file identified by id is likely the file that
+// was identified by o before it was renamed.
+func (id fileID) matches(o fileID) bool {
+	if id.dir != o.dir {
+		return false
+	}
+	if id.inode != 0 && id.inode == o.inode {
+		return true
+	}
+	return !id.dir && id.size == o.size && id.modTime.Equal(o.modTime)
+}
+
+// remember records the identity of a regular file or directory.
+func (w *Watcher) remember(fullPath string, info os.FileInfo) {
+	if info.Mode().IsRegular() || info.IsDir() {
+		w.files[fullPath] = idOf(info)
+	}
+}
+
+// forget drops what is known about fullPath and, if it was a directory,
+// everything below it. It returns the identity of the file at fullPath.
+func (w *Watcher) forget(fullPath string) (fileID, bool) {
+	id, ok := w.files[fullPath]
+	delete(w.files, fullPath)
+	if ok && !id.dir {
+		return id, true
+	}
+
+	prefix := fullPath + string(os.PathSeparator)
+	for p := range w.files {
+		if strings.HasPrefix(p, prefix) {
+			delete(w.files, p)
+		}
+	}
+	return id, ok
+}
+
+// renamedFrom returns the pending removal the new file at fullPath is the
+// other half of, the most recent one if several match.
+func (w *Watcher) renamedFrom(fullPath string, info os.FileInfo) *pending {
+	if !info.Mode().IsRegular() && !info.IsDir() {
+		return nil
+	}
+
+	id := idOf(info)
+	var from *pending
+	for _, p := range w.pending {
+		if p.eventType != Delete || !p.known || p.fullPath == fullPath || !p.id.matches(id) {
+			continue
+		}
+		if from == nil || p.touched.After(from.touched) {
+			from = p
+		}
+	}
+	return from
+}
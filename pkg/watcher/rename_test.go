@@ -0,0 +1,167 @@
+package watcher
+
+import (
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRenameIsPaired(t *testing.T) {
+	conf := createConf(t)
+
+	oldPath := filepath.Join(conf.Watcher.Path, testFileName)
+	require.NoError(t, os.WriteFile(oldPath, []byte("data"), 0644))
+	sub := filepath.Join(conf.Watcher.Path, "sub")
+	require.NoError(t, os.Mkdir(sub, 0755))
+
+	w, err := NewWatcher(conf, nil)
+	require.NoError(t, err)
+	defer w.TearDown()
+
+	go StartWatch(w)
+
+	newPath := filepath.Join(sub, "moved.txt")
+	require.NoError(t, os.Rename(oldPath, newPath))
+
+	select {
+	case e := <-w.RenameEventChan:
+		require.Equal(t, Rename, e.EventType)
+		require.Equal(t, File, e.FileType)
+		require.Equal(t, newPath, e.FullPath)
+		require.Equal(t, oldPath, e.OldFullPath)
+		require.Equal(t, "moved.txt", e.Name)
+		require.Equal(t, int64(4), e.Size)
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for event")
+	}
+	requireNoEvent(t, w, 4*conf.Watcher.QuietPeriod)
+
+	// renamed again, the file is known under its new name
+	renamed := filepath.Join(conf.Watcher.Path, "renamed.txt")
+	require.NoError(t, os.Rename(newPath, renamed))
+
+	select {
+	case e := <-w.RenameEventChan:
+		require.Equal(t, renamed, e.FullPath)
+		require.Equal(t, newPath, e.OldFullPath)
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for event")
+	}
+}
+
+func TestRenameCoalescing(t *testing.T) {
+	root := t.TempDir()
+	w := &Watcher{
+		BasePath:        root,
+		ErrorChan:       make(chan error, 1),
+		DeleteEventChan: make(chan *Event, 1),
+		quietPeriod:     time.Second,
+		pending:         map[string]*pending{},
+		files:           map[string]fileID{},
+	}
+
+	a := filepath.Join(root, "a.txt")
+	b := filepath.Join(root, "b.txt")
+	c := filepath.Join(root, "c.txt")
+	require.NoError(t, os.WriteFile(a, []byte("data"), 0644))
+	info, err := os.Stat(a)
+	require.NoError(t, err)
+	w.remember(a, info)
+	require.NoError(t, os.Rename(a, b))
+
+	now := time.Now()
+	w.record(Delete, a, nil, now)
+	w.record(Create, b, info, now)
+	require.Len(t, w.pending, 1)
+	require.Equal(t, Rename, w.pending[b].eventType)
+	require.Equal(t, a, w.pending[b].oldFullPath)
+
+	// renamed once more, still a single rename from the original path
+	require.NoError(t, os.Rename(b, c))
+	w.record(Delete, b, nil, now)
+	w.record(Create, c, info, now)
+	require.Len(t, w.pending, 1)
+	require.Equal(t, Rename, w.pending[c].eventType)
+	require.Equal(t, a, w.pending[c].oldFullPath)
+
+	// and removed, peers only have to drop the original path
+	require.NoError(t, os.Remove(c))
+	w.record(Delete, c, nil, now)
+	require.Len(t, w.pending, 1)
+	require.Equal(t, Delete, w.pending[a].eventType)
+
+	w.flush(now.Add(time.Second))
+	e := <-w.DeleteEventChan
+	require.Equal(t, a, e.FullPath)
+	require.Empty(t, w.pending)
+	require.Empty(t, w.files)
+}
+
+func TestDirectoryRenameIsPaired(t *testing.T) {
+	conf := createConf(t)
+
+	oldDir := filepath.Join(conf.Watcher.Path, "old")
+	require.NoError(t, os.MkdirAll(filepath.Join(oldDir, "sub"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(oldDir, "sub", testFileName), []byte("data"), 0644))
+
+	w, err := NewWatcher(conf, nil)
+	require.NoError(t, err)
+	defer w.TearDown()
+
+	go StartWatch(w)
+
+	newDir := filepath.Join(conf.Watcher.Path, "new")
+	require.NoError(t, os.Rename(oldDir, newDir))
+
+	select {
+	case e := <-w.RenameEventChan:
+		require.Equal(t, Directory, e.FileType)
+		require.Equal(t, newDir, e.FullPath)
+		require.Equal(t, oldDir, e.OldFullPath)
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for event")
+	}
+	requireNoEvent(t, w, 4*conf.Watcher.QuietPeriod)
+
+	// the content is watched under its new path
+	newFile := filepath.Join(newDir, "sub", testFileName)
+	require.NoError(t, os.WriteFile(newFile, []byte("changed"), 0644))
+	select {
+	case e := <-w.ModifyEventChan:
+		require.Equal(t, newFile, e.FullPath)
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for event")
+	}
+}
+
+func TestDirectoryMovedInIsReportedWithContent(t *testing.T) {
+	conf := createConf(t)
+
+	w, err := NewWatcher(conf, nil)
+	require.NoError(t, err)
+	defer w.TearDown()
+
+	go StartWatch(w)
+
+	outside := filepath.Join(t.TempDir(), "dir")
+	require.NoError(t, os.MkdirAll(filepath.Join(outside, "empty"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(outside, testFileName), []byte("data"), 0644))
+
+	dir := filepath.Join(conf.Watcher.Path, "dir")
+	require.NoError(t, os.Rename(outside, dir))
+
+	var created []string
+	for len(created) < 3 {
+		select {
+		case e := <-w.CreateEventChan:
+			created = append(created, e.FullPath)
+		case <-time.After(2 * time.Second):
+			t.Fatal("timeout waiting for event")
+		}
+	}
+
+	require.Equal(t, []string{dir, filepath.Join(dir, "empty"), filepath.Join(dir, testFileName)}, created)
+	requireNoEvent(t, w, 4*conf.Watcher.QuietPeriod)
+}
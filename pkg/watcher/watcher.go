@@ -3,6 +3,7 @@ package watcher
 import (
 	"github.com/fsnotify/fsnotify"
 	"github.com/hippo-an/sync-net/pkg/config"
+	"github.com/hippo-an/sync-net/pkg/ignore"
 	"log"
 	"os"
 	"path/filepath"
@@ -17,10 +18,48 @@ type Watcher struct {
 	CreateEventChan chan *Event
 	ModifyEventChan chan *Event
 	DeleteEventChan chan *Event
+	RenameEventChan chan *Event
 	ErrorChan       chan error
-	DoneChan        chan struct{}
-	StopChan        chan struct{}
-	wg              sync.WaitGroup
+	// Inbound holds the writes the transfer server makes to apply changes
+	// from peers. They are not reported as events.
+	Inbound     *Inbound
+	DoneChan    chan struct{}
+	StopChan    chan struct{}
+	wg          sync.WaitGroup
+	ignores     *ignore.Matcher
+	quietPeriod time.Duration
+	pending     map[string]*pending
+	files       map[string]fileID
+}
+
+// TempFilePrefix marks temporary files written while receiving data from
+// peers. They are never reported as events.
+const TempFilePrefix = ".syncnet-tmp-"
+
+// ConflictMarker is part of the name of every conflict copy. Conflict copies
+// are local artifacts and are not propagated to peers.
+const ConflictMarker = ".sync-conflict-"
+
+// MetaDirName is the hidden directory in the synced folder that holds local
+// bookkeeping such as old file versions. Its content is never synced.
+const MetaDirName = ".syncnet"
+
+func IsTempFile(name string) bool {
+	return strings.HasPrefix(filepath.Base(name), TempFilePrefix)
+}
+
+func IsConflictCopy(name string) bool {
+	return strings.Contains(filepath.Base(name), ConflictMarker)
+}
+
+// IsMetaPath reports whether name is or lies within a MetaDirName directory.
+func IsMetaPath(name string) bool {
+	for _, part := range strings.Split(filepath.ToSlash(name), "/") {
+		if part == MetaDirName {
+			return true
+		}
+	}
+	return false
 }
 
 type FileType int
@@ -37,16 +76,20 @@ const (
 	Create EventType = iota
 	Modify
 	Delete
+	// Rename moves a file to FullPath from OldFullPath without changing it.
+	Rename
 )
 
 type Event struct {
-	Name       string
-	Path       string
-	FullPath   string
-	Size       int64
-	FileType   FileType
-	EventType  EventType
-	ModifiedAt time.Time
+	Name     string
+	Path     string
+	FullPath string
+	// OldFullPath is where a renamed file was before.
+	OldFullPath string
+	Size        int64
+	FileType    FileType
+	EventType   EventType
+	ModifiedAt  time.Time
 }
 
 func (w *Watcher) TearDown() error {
@@ -55,19 +98,50 @@ func (w *Watcher) TearDown() error {
 	return err
 }
 
+// AddAll watches path and every directory below it, except for ignored
+// ones.
 func (w *Watcher) AddAll(path string) error {
 	return filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
 		if info.IsDir() {
+			if info.Name() == MetaDirName || w.isIgnored(path, true) {
+				return filepath.SkipDir
+			}
+			w.remember(path, info)
 			return w.Add(path)
 		}
+		if !IsTempFile(path) && !IsConflictCopy(path) && !w.isIgnored(path, false) {
+			w.remember(path, info)
+		}
 		return nil
 	})
 }
 
-func NewWatcher(conf *config.Config) (*Watcher, error) {
+// isIgnored reports whether fullPath matches the ignore patterns.
+func (w *Watcher) isIgnored(fullPath string, isDir bool) bool {
+	rel, err := filepath.Rel(w.BasePath, fullPath)
+	if err != nil {
+		return false
+	}
+
+	return w.ignores.Match(filepath.ToSlash(rel), isDir)
+}
+
+// reloadIgnores picks up a changed ignore file. Directories that are no
+// longer ignored get their watches.
+func (w *Watcher) reloadIgnores() error {
+	changed, err := w.ignores.Reload()
+	if err != nil || !changed {
+		return err
+	}
+
+	log.Println("Reloaded ignore patterns")
+	return w.AddAll(w.BasePath)
+}
+
+func NewWatcher(conf *config.Config, ignores *ignore.Matcher) (*Watcher, error) {
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
 		return nil, err
@@ -79,9 +153,15 @@ func NewWatcher(conf *config.Config) (*Watcher, error) {
 		CreateEventChan: make(chan *Event),
 		ModifyEventChan: make(chan *Event),
 		DeleteEventChan: make(chan *Event),
+		RenameEventChan: make(chan *Event),
 		ErrorChan:       make(chan error),
+		Inbound:         newInbound(conf.Watcher.Path, conf.Watcher.QuietPeriod),
 		DoneChan:        make(chan struct{}),
 		StopChan:        make(chan struct{}),
+		ignores:         ignores,
+		quietPeriod:     conf.Watcher.QuietPeriod,
+		pending:         map[string]*pending{},
+		files:           map[string]fileID{},
 	}
 
 	err = w.AddAll(conf.Watcher.Path)
@@ -92,11 +172,17 @@ func NewWatcher(conf *config.Config) (*Watcher, error) {
 	return w, nil
 }
 
+// StartWatch runs the event loop. Changes are reported once a path has been
+// quiet for the configured quiet period, with the events seen in between
+// coalesced into one.
 func StartWatch(w *Watcher) {
 	defer func() {
 		w.DoneChan <- struct{}{}
 	}()
 
+	ticker := time.NewTicker(w.flushInterval())
+	defer ticker.Stop()
+
 	for {
 		select {
 		case event, ok := <-w.Watcher.Events:
@@ -115,6 +201,8 @@ func StartWatch(w *Watcher) {
 			}
 
 			w.ErrorChan <- err
+		case now := <-ticker.C:
+			w.flush(now)
 		case <-w.StopChan:
 			log.Println("received stop signal from outside of event loop")
 			return
@@ -123,37 +211,112 @@ func StartWatch(w *Watcher) {
 }
 
 func (w *Watcher) handleEvent(event fsnotify.Event) error {
+	if IsTempFile(event.Name) || IsConflictCopy(event.Name) || IsMetaPath(event.Name) {
+		return nil
+	}
+
+	if w.ignores != nil && event.Name == filepath.Join(w.BasePath, ignore.FileName) {
+		return w.reloadIgnores()
+	}
 
 	var eventType EventType
 	if event.Op&fsnotify.Create == fsnotify.Create {
 		eventType = Create
 	} else if event.Op&fsnotify.Write == fsnotify.Write {
 		eventType = Modify
-	} else if event.Op&fsnotify.Remove == fsnotify.Remove {
+	} else if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+		// a path renamed away is gone, the new name gets a create and both
+		// are paired into a rename later on
 		eventType = Delete
 	} else {
 		return nil
 	}
 
 	fullPath := event.Name
-	e, err := getEvent(eventType, fullPath)
+	if event.Op&fsnotify.Rename != 0 {
+		// a moved directory reports the move once more through its own
+		// watch, by then under the new path it was added with
+		if info, err := os.Lstat(fullPath); err == nil {
+			if info.IsDir() {
+				return w.AddAll(fullPath)
+			}
+			return nil
+		}
+	}
+
+	if eventType == Delete {
+		// whether it was a directory is not known anymore
+		if !w.isIgnored(fullPath, false) && !w.isIgnored(fullPath, true) {
+			w.record(Delete, fullPath, nil, time.Now())
+		}
+		return nil
+	}
+
+	info, err := os.Stat(fullPath)
+	if os.IsNotExist(err) {
+		// already gone again, recorded so that its removal cancels it out
+		if !w.isIgnored(fullPath, false) {
+			w.record(eventType, fullPath, nil, time.Now())
+		}
+		return nil
+	}
 	if err != nil {
 		return err
 	}
 
-	w.addToWatcher(e)
-	w.SendToChan(e)
+	if w.isIgnored(fullPath, info.IsDir()) {
+		return nil
+	}
+
+	now := time.Now()
+	if info.IsDir() && eventType == Create {
+		return w.addDir(fullPath, info, now)
+	}
 
+	w.record(eventType, fullPath, info, now)
 	return nil
 }
 
-func (w *Watcher) addToWatcher(e *Event) {
-	if e.FileType == Directory && e.EventType == Create {
-		err := w.AddAll(e.FullPath)
+// addDir watches a new directory right away so that nothing created in it
+// during the quiet period is missed. Whatever it already holds, for instance
+// when it was copied in, is reported as created along with it unless the
+// directory was just renamed.
+func (w *Watcher) addDir(fullPath string, info os.FileInfo, now time.Time) error {
+	err := w.AddAll(fullPath)
+	if err != nil {
+		return err
+	}
+
+	w.record(Create, fullPath, info, now)
+	if p, ok := w.pending[fullPath]; ok && p.eventType == Rename {
+		return nil
+	}
+
+	return filepath.Walk(fullPath, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
-			w.ErrorChan <- err
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
 		}
-	}
+
+		if path == fullPath {
+			return nil
+		}
+
+		if info.IsDir() && (info.Name() == MetaDirName || w.isIgnored(path, true)) {
+			return filepath.SkipDir
+		}
+
+		if IsTempFile(path) || IsConflictCopy(path) || w.isIgnored(path, info.IsDir()) {
+			return nil
+		}
+
+		if info.IsDir() || info.Mode().IsRegular() {
+			w.record(Create, path, info, now)
+		}
+		return nil
+	})
 }
 
 func (w *Watcher) SendToChan(e *Event) {
@@ -164,6 +327,8 @@ func (w *Watcher) SendToChan(e *Event) {
 		w.ModifyEventChan <- e
 	case Delete:
 		w.DeleteEventChan <- e
+	case Rename:
+		w.RenameEventChan <- e
 	}
 }
 
@@ -174,7 +339,7 @@ func getEvent(eventType EventType, fullPath string) (*Event, error) {
 	var size int64
 
 	switch eventType {
-	case Create, Modify:
+	case Create, Modify, Rename:
 		info, err := os.Stat(fullPath)
 
 		if err != nil {
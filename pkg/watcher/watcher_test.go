@@ -2,9 +2,11 @@ package watcher
 
 import (
 	"github.com/hippo-an/sync-net/pkg/config"
+	"github.com/hippo-an/sync-net/pkg/ignore"
 	"github.com/stretchr/testify/require"
 	"os"
 	"path/filepath"
+	"slices"
 	"testing"
 	"time"
 )
@@ -41,13 +43,14 @@ func createConf(t *testing.T) *config.Config {
 	conf, err := config.NewConfig()
 	require.NoError(t, err)
 	conf.Watcher.Path = t.TempDir()
+	conf.Watcher.QuietPeriod = 50 * time.Millisecond
 
 	return conf
 }
 
 func TestFileCreate(t *testing.T) {
 	conf := createConf(t)
-	w, err := NewWatcher(conf)
+	w, err := NewWatcher(conf, nil)
 	require.NoError(t, err)
 
 	defer w.TearDown()
@@ -60,7 +63,7 @@ func TestFileCreate(t *testing.T) {
 func TestFileModify(t *testing.T) {
 	conf := createConf(t)
 
-	w, err := NewWatcher(conf)
+	w, err := NewWatcher(conf, nil)
 	require.NoError(t, err)
 
 	defer w.TearDown()
@@ -89,7 +92,7 @@ func TestFileModify(t *testing.T) {
 func TestFileDelete(t *testing.T) {
 	conf := createConf(t)
 
-	w, err := NewWatcher(conf)
+	w, err := NewWatcher(conf, nil)
 	require.NoError(t, err)
 
 	defer w.TearDown()
@@ -117,7 +120,7 @@ func TestFileDelete(t *testing.T) {
 func TestNestedFolderCreate(t *testing.T) {
 	conf := createConf(t)
 
-	w, err := NewWatcher(conf)
+	w, err := NewWatcher(conf, nil)
 	require.NoError(t, err)
 	defer w.TearDown()
 
@@ -133,14 +136,118 @@ func TestNestedFolderCreate(t *testing.T) {
 	_, err = os.Create(testFile)
 	require.NoError(t, err)
 
+	// the directories below nested may or may not be reported on their own,
+	// depending on whether they were created before nested got its watch
+	e := nextFileEvent(t, w.CreateEventChan)
+	require.Equal(t, testFileName, e.Name)
+	require.Equal(t, nestedDir, e.Path)
+	require.Equal(t, testFile, e.FullPath)
+	require.Equal(t, File, e.FileType)
+	require.Equal(t, Create, e.EventType)
+	require.WithinDuration(t, time.Now(), e.ModifiedAt, time.Second)
+}
+
+// nextFileEvent returns the next event on ch that is not for a directory.
+func nextFileEvent(t *testing.T, ch chan *Event) *Event {
+	t.Helper()
+
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case e := <-ch:
+			if e.FileType != Directory {
+				return e
+			}
+		case <-timeout:
+			t.Fatal("timeout waiting for event")
+		}
+	}
+}
+
+func TestTempFileIgnored(t *testing.T) {
+	conf := createConf(t)
+
+	w, err := NewWatcher(conf, nil)
+	require.NoError(t, err)
+	defer w.TearDown()
+
+	go StartWatch(w)
+
+	tempFile := filepath.Join(conf.Watcher.Path, TempFilePrefix+"123")
+	err = os.WriteFile(tempFile, []byte("data"), 0644)
+	require.NoError(t, err)
+
+	create(t, w)
+}
+
+func TestConflictCopyIgnored(t *testing.T) {
+	conf := createConf(t)
+
+	w, err := NewWatcher(conf, nil)
+	require.NoError(t, err)
+	defer w.TearDown()
+
+	go StartWatch(w)
+
+	conflictCopy := filepath.Join(conf.Watcher.Path, "testFile"+ConflictMarker+"20240830-130405-abcdef0.txt")
+	err = os.WriteFile(conflictCopy, []byte("data"), 0644)
+	require.NoError(t, err)
+
+	create(t, w)
+}
+
+func TestMetaDirIgnored(t *testing.T) {
+	conf := createConf(t)
+
+	versions := filepath.Join(conf.Watcher.Path, MetaDirName, "versions")
+	err := os.MkdirAll(versions, 0755)
+	require.NoError(t, err)
+
+	w, err := NewWatcher(conf, nil)
+	require.NoError(t, err)
+	defer w.TearDown()
+
+	go StartWatch(w)
+
+	err = os.WriteFile(filepath.Join(versions, "a~20240830-130405.txt"), []byte("data"), 0644)
+	require.NoError(t, err)
+	err = os.Mkdir(filepath.Join(conf.Watcher.Path, "sub"), 0755)
+	require.NoError(t, err)
+	<-w.CreateEventChan
+	err = os.Mkdir(filepath.Join(conf.Watcher.Path, "sub", MetaDirName), 0755)
+	require.NoError(t, err)
+
+	create(t, w)
+}
+
+func TestIgnoredPathsDropped(t *testing.T) {
+	conf := createConf(t)
+	build := filepath.Join(conf.Watcher.Path, "build")
+	require.NoError(t, os.Mkdir(build, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(conf.Watcher.Path, ignore.FileName), []byte("*.swp\nbuild/\n"), 0644))
+
+	ignores, err := ignore.Load(conf)
+	require.NoError(t, err)
+	w, err := NewWatcher(conf, ignores)
+	require.NoError(t, err)
+	defer w.TearDown()
+	require.NotContains(t, w.WatchList(), build)
+
+	go StartWatch(w)
+
+	require.NoError(t, os.WriteFile(filepath.Join(conf.Watcher.Path, ".testFile.txt.swp"), []byte("swap"), 0644))
+	create(t, w)
+
+	// no longer ignored directories are watched once the file changes
+	require.NoError(t, os.WriteFile(filepath.Join(conf.Watcher.Path, ignore.FileName), []byte("*.swp\n"), 0644))
+	require.Eventually(t, func() bool {
+		return slices.Contains(w.WatchList(), build)
+	}, 2*time.Second, 10*time.Millisecond)
+
+	require.NoError(t, os.WriteFile(filepath.Join(build, "out.bin"), []byte("data"), 0644))
 	select {
 	case e := <-w.CreateEventChan:
-		require.Equal(t, testFileName, e.Name)
-		require.Equal(t, nestedDir, e.Path)
-		require.Equal(t, testFile, e.FullPath)
-		require.Equal(t, File, e.FileType)
-		require.Equal(t, Create, e.EventType)
-		require.WithinDuration(t, time.Now(), e.ModifiedAt, time.Second)
+		require.Equal(t, "out.bin", e.Name)
 	case <-time.After(2 * time.Second):
 		t.Fatal("timeout waiting for event")
 	}